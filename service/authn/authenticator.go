@@ -2,29 +2,40 @@
 package authn
 
 import (
+	"context"
 	"errors"
+	"log"
+	"slices"
 	"sync"
 	"user-service/config"
+	"user-service/errorx"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
-// Hardcoded clientId, to be used as audience during token generation.
+// The client_id of the sample confidential client, which is also the default audience of the tokens issued on a login.
 // A clientId is generally issued by the auth server when a client registers with the server.
-const clientId = "client1"
+const clientId = config.DefaultAudience
 
 // Service implements Authenticator interface
 type Service struct {
 	sync.RWMutex
-	Name   string
-	Secret string // To be used when using HMAC signing method for token
-	Cfg    *config.Config
+	Tokens TokenSettings // The issuer, audiences and lifetimes of the tokens
+	// The secrets of the HMAC signing method. The first one signs the tokens, and the previous ones are only accepted on validation.
+	Secrets []string
+	Cfg     *config.Config
+	// The policy that the passwords are checked against when they are set
+	PasswordPolicy *PasswordPolicy
+	store          Store
+	keys           *keyCache // nil until WatchKeys is called, in which case the keys are read from disk on every use
 }
 
-// InitService initializes the Service with hardcoded values of name and secret.
-// The secret is included here to enable testing for HMAC signed token mechanism.
-func InitService() *Service {
+// InitService initializes the Service with the default token settings.
+// The secrets of the HMAC signing method are set from the config, as they must never be part of the source.
+func InitService(db Store) *Service {
 	return &Service{
-		Name:   "platform/user-service",
-		Secret: "mysupersecret",
+		Tokens: DefaultTokenSettings(),
+		store:  db,
 	}
 }
 
@@ -35,29 +46,264 @@ type ClientClaims struct {
 	UserID string `json:"user_id"`
 }
 
-func (s *Service) GenerateToken(id string) (string, error) {
+// WatchKeys loads the key set into memory, and keeps it in sync with the key directory until the context is done.
+// It is a no-op for the signing methods that do not use the key directory.
+func (s *Service) WatchKeys(ctx context.Context, wg *sync.WaitGroup) error {
+	if !usesKeySet(s.Cfg.SigningMethod) {
+		return nil
+	}
+	keys, err := newKeyCache(s.Cfg.KeyDir, s.Cfg.SigningKeyID)
+	if err != nil {
+		return err
+	}
+	if err := keys.watch(ctx, wg); err != nil {
+		return err
+	}
+	s.keys = keys
+	return nil
+}
+
+// CheckSigningKey checks that the key directory holds an active signing key that matches the signing method,
+// so that a missing or mismatched key fails the startup, rather than the first login.
+// It is a no-op for the signing methods that do not use the key directory.
+func (s *Service) CheckSigningKey() error {
+	if !usesKeySet(s.Cfg.SigningMethod) {
+		return nil
+	}
+	keySet, err := s.keySet()
+	if err != nil {
+		return err
+	}
+	_, _, err = activeSigningKey(keySet, signingMethods[s.Cfg.SigningMethod])
+	return err
+}
+
+// The jwt algorithms accepted by each of the signing methods that use the key set
+var signingMethods = map[string][]string{
+	"rsa":   rsaSigningMethods,
+	"ecdsa": ecdsaSigningMethods,
+	"eddsa": eddsaSigningMethods,
+}
+
+// usesKeySet reports whether the signing method signs with the keys of the key directory, as opposed to a shared secret.
+func usesKeySet(signingMethod string) bool {
+	_, ok := signingMethods[signingMethod]
+	return ok
+}
+
+// keySet returns the cached key set, or reads it from disk if the keys are not being watched.
+func (s *Service) keySet() (*KeySet, error) {
+	if s.keys != nil {
+		return s.keys.keySet(), nil
+	}
+	return LoadKeySet(s.Cfg.KeyDir, s.Cfg.SigningKeyID)
+}
+
+// GenerateToken issues an access token to the user. The optional amr values are the methods the user authenticated with.
+func (s *Service) GenerateToken(id string, amr ...string) (string, error) {
 	// We use mutext to remove any rare possibility of two tokens having the same properties because of concurrent calls.
 	// This lock only applies to writes.
 	// The goal is to not block any readers of the Service object.
 	s.Lock()
 	defer s.Unlock()
+	claims, err := newUserAccessTokenClaims(s.Tokens, id, s.Tokens.loginAudience(), loginScopes)
+	if err != nil {
+		return "", err
+	}
+	setAMR(claims, amr)
+	return s.sign(claims)
+}
+
+// sign signs the claims with the configured signing method.
+func (s *Service) sign(claims jwt.MapClaims) (string, error) {
 	switch s.Cfg.SigningMethod {
-	case "rsa":
-		return GenerateRSASignedToken(s.Cfg, id, s.Name)
+	case "rsa", "ecdsa", "eddsa":
+		keySet, err := s.keySet()
+		if err != nil {
+			return "", err
+		}
+		return signWithKeySet(keySet, signingMethods[s.Cfg.SigningMethod], claims)
 	case "hmac":
-		return GenerateHMACSignedToken(id, s.Name, s.Secret)
+		if len(s.Secrets) == 0 {
+			return "", errors.New("missing secret")
+		}
+		return SignHMACToken(claims, s.Secrets[0])
 	default:
 		return "", errors.New("invalid signing-method")
 	}
 }
 
-func (s *Service) ValidateToken(token string) (string, error) {
+// signIDToken signs the claims of an ID token, which is only issued with an asymmetric signing method, see OpenIDConfiguration.
+func (s *Service) signIDToken(claims jwt.MapClaims) (string, error) {
+	if !usesKeySet(s.Cfg.SigningMethod) {
+		return "", errors.New("OpenID Connect requires an asymmetric signing-method")
+	}
+	return s.sign(claims)
+}
+
+func (s *Service) ValidateToken(token string) (Claims, error) {
 	switch s.Cfg.SigningMethod {
 	case "rsa":
-		return ValidateRSASignedToken(s.Cfg, token, s.Name)
+		keySet, err := s.keySet()
+		if err != nil {
+			return Claims{}, err
+		}
+		return ValidateRSASignedToken(keySet, token, s.Tokens)
+	case "ecdsa":
+		keySet, err := s.keySet()
+		if err != nil {
+			return Claims{}, err
+		}
+		return ValidateECDSASignedToken(keySet, token, s.Tokens)
+	case "eddsa":
+		keySet, err := s.keySet()
+		if err != nil {
+			return Claims{}, err
+		}
+		return ValidateEdDSASignedToken(keySet, token, s.Tokens)
 	case "hmac":
-		return ValidateHMACSignedToken(token, s.Name, s.Secret)
+		return ValidateHMACSignedToken(token, s.Tokens, s.Secrets)
 	default:
-		return "", errors.New("invalid signing-method")
+		return Claims{}, errors.New("invalid signing-method")
+	}
+}
+
+// AuthenticateClient checks the credentials of a registered client.
+func (s *Service) AuthenticateClient(ctx context.Context, id, secret string) (Client, error) {
+	return AuthenticateClient(ctx, s.store, id, secret)
+}
+
+// ClientCredentialsToken issues an access token to a registered client, as per the client_credentials grant.
+func (s *Service) ClientCredentialsToken(ctx context.Context, req ClientCredentialsRequest) (AccessToken, error) {
+	return IssueClientCredentialsToken(ctx, s.store, s.sign, s.Tokens, req)
+}
+
+// ValidateAuthorizationRequest checks the authorization request of the authorization code flow against the client registry.
+func (s *Service) ValidateAuthorizationRequest(ctx context.Context, req AuthorizationRequest) error {
+	if err := s.checkOpenIDScope(req); err != nil {
+		return err
+	}
+	_, err := ValidateAuthorizationRequest(ctx, s.store, req)
+	return err
+}
+
+// IssueAuthorizationCode issues an authorization code to the client, on behalf of the user, who authenticated with the amr methods.
+func (s *Service) IssueAuthorizationCode(ctx context.Context, req AuthorizationRequest, id string, amr ...string) (string, error) {
+	if err := s.checkOpenIDScope(req); err != nil {
+		return "", err
+	}
+	return IssueAuthorizationCode(ctx, s.store, req, id, amr)
+}
+
+// checkOpenIDScope refuses the openid scope when the service is not an OpenID Provider, so that no ID token is ever issued.
+func (s *Service) checkOpenIDScope(req AuthorizationRequest) error {
+	if !usesKeySet(s.Cfg.SigningMethod) && slices.Contains(req.Scopes, ScopeOpenID) {
+		log.Println("DEBUG: the openid scope requires an asymmetric signing-method")
+		return errorx.Error{Code: errorx.InvalidScope}
+	}
+	return nil
+}
+
+// AuthorizationCodeToken exchanges an authorization code for an access token, as per the authorization_code grant.
+func (s *Service) AuthorizationCodeToken(ctx context.Context, req AuthorizationCodeRequest) (AccessToken, error) {
+	return ExchangeAuthorizationCode(ctx, s.store, s.sign, s.signIDToken, s.Tokens, req)
+}
+
+// Login checks the password of the user, with the brute-force protection of the account and of the IP address of the client.
+// It returns an MFA challenge token if the user has to complete the login with a second factor.
+func (s *Service) Login(ctx context.Context, id, password, ip string) (string, error) {
+	return Login(ctx, s.store, id, password, ip)
+}
+
+// VerifyMFAChallenge completes a login with a TOTP code or a recovery code, and returns the id of the user along with the amr values.
+func (s *Service) VerifyMFAChallenge(ctx context.Context, challenge, code, ip string) (string, []string, error) {
+	return VerifyMFAChallenge(ctx, s.store, challenge, code, ip)
+}
+
+// EnrollTOTP starts the TOTP enrollment of the user.
+func (s *Service) EnrollTOTP(ctx context.Context, id string) (TOTPEnrollment, error) {
+	return EnrollTOTP(ctx, s.store, s.Tokens.IssuerName(), id)
+}
+
+// ConfirmTOTP enables MFA for the user, and returns the recovery codes.
+func (s *Service) ConfirmTOTP(ctx context.Context, id, code string) ([]string, error) {
+	return ConfirmTOTP(ctx, s.store, id, code)
+}
+
+// DisableMFA removes the second factor of the user.
+func (s *Service) DisableMFA(ctx context.Context, id string) error {
+	return DisableMFA(ctx, s.store, id)
+}
+
+// UnlockAccount lifts the lockout of an account.
+func (s *Service) UnlockAccount(ctx context.Context, id string) error {
+	return UnlockAccount(ctx, s.store, id)
+}
+
+// SetPassword checks the password against the password policy, and stores its hash.
+func (s *Service) SetPassword(ctx context.Context, id, password string) error {
+	return SetPassword(ctx, s.store, s.PasswordPolicy, id, password)
+}
+
+// IssueRefreshToken issues a refresh token that starts a new token family for the user.
+// The optional amr values are the methods the user authenticated with, which carry over to the refreshed access tokens.
+func (s *Service) IssueRefreshToken(ctx context.Context, id string, amr ...string) (string, error) {
+	return IssueRefreshToken(ctx, s.store, s.Tokens.RefreshTokenTTL, id, "", amr)
+}
+
+// RefreshToken rotates the supplied refresh token, and returns a new access token along with the new refresh token.
+func (s *Service) RefreshToken(ctx context.Context, refreshToken string) (string, string, error) {
+	rt, newRefreshToken, err := RotateRefreshToken(ctx, s.store, s.Tokens.RefreshTokenTTL, refreshToken)
+	if err != nil {
+		return "", "", err
+	}
+	token, err := s.GenerateToken(rt.UserID, rt.AMR...)
+	if err != nil {
+		return "", "", err
+	}
+	return token, newRefreshToken, nil
+}
+
+// RevokeToken revokes an access token or a refresh token. See RevokeToken function for details.
+func (s *Service) RevokeToken(ctx context.Context, token string, hint string) error {
+	return RevokeToken(ctx, s.ValidateToken, s.store, token, hint)
+}
+
+// IntrospectToken reports the state of an access token, as per RFC 7662.
+func (s *Service) IntrospectToken(ctx context.Context, token string) (Introspection, error) {
+	return IntrospectToken(ctx, s.ValidateToken, s.store, token)
+}
+
+// IsTokenRevoked checks if the access token with the supplied jti is in the deny list.
+func (s *Service) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	return s.store.IsTokenRevoked(ctx, jti)
+}
+
+// OpenIDConfiguration returns the discovery document, with the endpoints relative to the issuer.
+// The service is only an OpenID Provider with an asymmetric signing method, as the relying parties validate the ID tokens
+// with the published keys. An HMAC secret would have to be shared with them, which would let them forge the tokens as well.
+// Otherwise, an errorx.Error with errorx.NotFound code is returned.
+func (s *Service) OpenIDConfiguration() (ProviderMetadata, error) {
+	algs, ok := signingMethods[s.Cfg.SigningMethod]
+	if !ok {
+		return ProviderMetadata{}, errorx.Error{Code: errorx.NotFound, Message: "OpenID Connect requires an asymmetric signing-method"}
+	}
+	return OpenIDConfiguration(s.Tokens.Issuer, algs), nil
+}
+
+// JWKS returns the public keys that can be used to validate the issued tokens.
+// With HMAC signing method, the key is a shared secret, so the returned key set is always empty.
+func (s *Service) JWKS() (JWKSet, error) {
+	switch s.Cfg.SigningMethod {
+	case "rsa", "ecdsa", "eddsa":
+		keySet, err := s.keySet()
+		if err != nil {
+			return JWKSet{}, err
+		}
+		return keySet.JWKS(), nil
+	case "hmac":
+		return JWKSet{Keys: []JWK{}}, nil
+	default:
+		return JWKSet{}, errors.New("invalid signing-method")
 	}
 }
@@ -0,0 +1,271 @@
+package authn
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"user-service/errorx"
+	"user-service/timesource"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/*
+Note about the authorization code flow:
+
+The browser and mobile apps get the tokens of a user via the authorization code flow of RFC 6749 section 4.1. The app sends the user
+to the authorization endpoint, where the user logs in, and the user comes back to the redirect URI of the app with a code, which the
+app exchanges for the tokens at the token endpoint. The redirect URIs are registered per client, and compared as exact strings, so that
+a code can not be sent anywhere else.
+
+PKCE (RFC 7636) is mandatory, with the S256 method only. The app keeps a random code verifier, and sends its hash along with the
+authorization request, so a code that leaks on the way back, e.g. via another app that claims the same redirect URI, is of no use
+without the verifier. For the public clients, PKCE is the only protection, as they have no secret.
+
+The codes are single-use and short-lived. Only their SHA-256 hashes are stored, and a code is removed from the datastore as it is
+exchanged, so two concurrent exchanges of the same code can not both succeed. No refresh token is issued, as the refresh tokens do
+not carry the scopes and the client yet - the app runs the flow again once the access token expires.
+*/
+
+const (
+	authorizationCodeValidity = time.Minute
+	CodeChallengeMethodS256   = "S256"
+)
+
+// The scopes of OpenID Connect, which any client may request in the authorization code flow.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+)
+
+// AuthorizationRequest is an authorization request of the authorization code flow, as defined by RFC 6749 section 4.1.1 and RFC 7636.
+type AuthorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	Scopes              []string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string // Put into the ID token as is, for the relying party to match it with its session
+}
+
+// AuthorizationCode is the server-side state of an issued authorization code.
+type AuthorizationCode struct {
+	Hash          string
+	ClientID      string
+	UserID        string
+	RedirectURI   string
+	CodeChallenge string
+	Scopes        []string
+	Nonce         string
+	AMR           []string // The methods the user authenticated with
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+// AuthorizationCodeRepository persists the authorization codes, keyed by the hash of the code.
+// UseAuthorizationCode atomically removes a code and returns it, so that a code can only be exchanged once.
+// It returns an errorx.Error with errorx.NotFound code if the code does not exist.
+// The implementations may prune the expired codes when a new one is created.
+type AuthorizationCodeRepository interface {
+	CreateAuthorizationCode(ctx context.Context, c AuthorizationCode) error
+	UseAuthorizationCode(ctx context.Context, hash string) (AuthorizationCode, error)
+}
+
+// AuthorizationCodeStore is the subset of the datastore that the authorization code flow works on.
+type AuthorizationCodeStore interface {
+	ClientRepository
+	AuthorizationCodeRepository
+}
+
+// AuthorizationCodeRequest is a token request of the authorization_code grant, as defined by RFC 6749 section 4.1.3.
+// The ClientSecret is left empty for the public clients.
+type AuthorizationCodeRequest struct {
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+}
+
+// S256CodeChallenge derives the code challenge from the code verifier, with the S256 method of RFC 7636 section 4.2.
+func S256CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// hashAuthorizationCode hashes a code, as stored in the datastore. Same as the refresh tokens, the codes are long random strings.
+func hashAuthorizationCode(code string) string {
+	return hashRefreshToken(code)
+}
+
+// validCodeVerifier checks the format of the code verifier, as per RFC 7636 section 4.1.
+func validCodeVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, r := range verifier {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("-._~", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateAuthorizationRequest checks the authorization request against the client registry.
+// An unknown client results in an errorx.InvalidClient error, and a redirect URI that is not registered for the client in an
+// errorx.InvalidRedirectURI error - these two must not be sent to the redirect URI. A missing or malformed PKCE challenge
+// results in an errorx.BadRequestData error, and a scope that the client may not request in an errorx.InvalidScope error.
+func ValidateAuthorizationRequest(ctx context.Context, repo ClientRepository, req AuthorizationRequest) (Client, error) {
+	if req.ClientID == "" {
+		return Client{}, errorx.Error{Code: errorx.InvalidClient}
+	}
+	c, err := getClient(ctx, repo, req.ClientID)
+	if err != nil {
+		return Client{}, err
+	}
+	if req.RedirectURI == "" || !slices.Contains(c.RedirectURIs, req.RedirectURI) {
+		log.Println("DEBUG: redirect URI not registered for the client", c.ID)
+		return Client{}, errorx.Error{Code: errorx.InvalidRedirectURI}
+	}
+	if req.CodeChallengeMethod != CodeChallengeMethodS256 {
+		return Client{}, errorx.Error{Code: errorx.BadRequestData, Message: "code_challenge_method must be S256"}
+	}
+	// A S256 challenge is the base64url encoding of a SHA-256 hash, without padding
+	if b, err := base64.RawURLEncoding.DecodeString(req.CodeChallenge); err != nil || len(b) != sha256.Size {
+		return Client{}, errorx.Error{Code: errorx.BadRequestData, Message: "Missing or malformed code_challenge"}
+	}
+	for _, scope := range req.Scopes {
+		if scope != ScopeOpenID && scope != ScopeProfile && !slices.Contains(c.Scopes, scope) {
+			log.Println("DEBUG: scope not allowed for the client", c.ID, scope)
+			return Client{}, errorx.Error{Code: errorx.InvalidScope}
+		}
+	}
+	return c, nil
+}
+
+// IssueAuthorizationCode issues a code for the authorization request, on behalf of the user, who authenticated with the amr methods.
+// Unlike the client_credentials grant, omitting the scope grants none of the scopes of the client.
+func IssueAuthorizationCode(ctx context.Context, db AuthorizationCodeStore, req AuthorizationRequest, userId string, amr []string) (string, error) {
+	if userId == "" {
+		return "", errors.New("missing id")
+	}
+	c, err := ValidateAuthorizationRequest(ctx, db, req)
+	if err != nil {
+		return "", err
+	}
+	code, err := randomString(32)
+	if err != nil {
+		log.Println("ERROR: error generating authorization code", err)
+		return "", err
+	}
+	now := timesource.CurrentTime()
+	ac := AuthorizationCode{
+		Hash:          hashAuthorizationCode(code),
+		ClientID:      c.ID,
+		UserID:        userId,
+		RedirectURI:   req.RedirectURI,
+		CodeChallenge: req.CodeChallenge,
+		Scopes:        slices.Clone(req.Scopes),
+		Nonce:         req.Nonce,
+		AMR:           slices.Clone(amr),
+		AuthTime:      now,
+		ExpiresAt:     now.Add(authorizationCodeValidity),
+	}
+	if err := db.CreateAuthorizationCode(ctx, ac); err != nil {
+		log.Println("ERROR: error storing authorization code", err)
+		return "", err
+	}
+	return code, nil
+}
+
+// authenticateCodeClient authenticates the client of an authorization code exchange. The public clients only identify themselves,
+// as the code verifier stands in for their authentication.
+func authenticateCodeClient(ctx context.Context, repo ClientRepository, id, secret string) (Client, error) {
+	if id == "" {
+		return Client{}, errorx.Error{Code: errorx.InvalidClient}
+	}
+	c, err := getClient(ctx, repo, id)
+	if err != nil {
+		return Client{}, err
+	}
+	if !c.Public {
+		return AuthenticateClient(ctx, repo, id, secret)
+	}
+	if secret != "" {
+		log.Println("DEBUG: secret presented for a public client", id)
+		return Client{}, errorx.Error{Code: errorx.InvalidClient}
+	}
+	return c, nil
+}
+
+// ExchangeAuthorizationCode authenticates the client, consumes the code, and issues an access token to the user, on behalf of the client.
+// An ID token is issued alongside if the openid scope was granted. The sign function signs the claims of the access token with the configured
+// signing method, and signIDToken those of the ID token.
+// A code that is unknown, expired, already used, issued to another client or for another redirect URI, or that does not match the code
+// verifier, results in an errorx.InvalidGrant error.
+func ExchangeAuthorizationCode(ctx context.Context, db AuthorizationCodeStore, sign, signIDToken func(jwt.MapClaims) (string, error), settings TokenSettings, req AuthorizationCodeRequest) (AccessToken, error) {
+	c, err := authenticateCodeClient(ctx, db, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	if req.Code == "" {
+		return AccessToken{}, errorx.Error{Code: errorx.InvalidGrant}
+	}
+	ac, err := db.UseAuthorizationCode(ctx, hashAuthorizationCode(req.Code))
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			log.Println("DEBUG: authorization code not found, or already used")
+			return AccessToken{}, errorx.Error{Code: errorx.InvalidGrant}
+		}
+		return AccessToken{}, err
+	}
+	if !timesource.CurrentTime().Before(ac.ExpiresAt) {
+		log.Println("DEBUG: authorization code expired")
+		return AccessToken{}, errorx.Error{Code: errorx.InvalidGrant}
+	}
+	if ac.ClientID != c.ID || ac.RedirectURI != req.RedirectURI {
+		log.Println("DEBUG: authorization code issued to another client or redirect URI")
+		return AccessToken{}, errorx.Error{Code: errorx.InvalidGrant}
+	}
+	if !validCodeVerifier(req.CodeVerifier) ||
+		subtle.ConstantTimeCompare([]byte(S256CodeChallenge(req.CodeVerifier)), []byte(ac.CodeChallenge)) != 1 {
+		log.Println("DEBUG: code verifier does not match the code challenge")
+		return AccessToken{}, errorx.Error{Code: errorx.InvalidGrant}
+	}
+	if len(c.Audiences) == 0 {
+		log.Println("DEBUG: no audience allowed for the client", c.ID)
+		return AccessToken{}, errorx.Error{Code: errorx.InvalidTarget}
+	}
+
+	claims, err := newUserAccessTokenClaims(settings, ac.UserID, c.Audiences, ac.Scopes)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	claims["client_id"] = c.ID
+	setAMR(claims, ac.AMR)
+	token, err := sign(claims)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	res := AccessToken{Token: token, ExpiresIn: settings.AccessTokenTTL, Scopes: ac.Scopes}
+	if slices.Contains(ac.Scopes, ScopeOpenID) {
+		res.IDToken, err = GenerateIDToken(signIDToken, settings, IDTokenRequest{
+			Subject:  ac.UserID,
+			Audience: c.ID,
+			Nonce:    ac.Nonce,
+			AMR:      ac.AMR,
+			AuthTime: ac.AuthTime,
+		})
+		if err != nil {
+			return AccessToken{}, err
+		}
+	}
+	return res, nil
+}
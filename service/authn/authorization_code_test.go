@@ -0,0 +1,13 @@
+package authn_test
+
+import (
+	"testing"
+	"user-service/authn"
+)
+
+func TestS256CodeChallenge(t *testing.T) {
+	// The example of RFC 7636 appendix B
+	if got := authn.S256CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("unexpected code challenge %s", got)
+	}
+}
@@ -0,0 +1,191 @@
+package authn
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"user-service/errorx"
+	"user-service/timesource"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims holds the validated claims of an access token that are of interest to the rest of the service.
+type Claims struct {
+	UserID    string // The user the token was issued to. Empty for the tokens that the clients get for themselves.
+	ID        string // The jti claim, which uniquely identifies a token, e.g. for the revocation purposes.
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	AMR       []string // The amr claim, i.e. the methods the user authenticated with. Empty for the tokens that were not issued on a login.
+	Scopes    []string // The scope claim, i.e. the scopes the token may be used for
+	ClientID  string   // The client_id claim, i.e. the registered client the token was issued to. Empty for the tokens of the users.
+}
+
+// The authentication method references of the amr claim, as registered by RFC 8176
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRMFA      = "mfa"
+)
+
+// loginScopes are the scopes of the tokens that are issued to the users on a login. Such a token is used by the user directly,
+// rather than by a client on behalf of the user, so it carries all the scopes of the users, and the role of the user decides what the user may do.
+// The openid scope is left out, as it is only granted to a relying party.
+var loginScopes = []string{ScopeUsersRead, ScopeUsersWrite}
+
+// Subject returns the sub claim, i.e. the user the token was issued to, or the client for the tokens that the clients get for themselves.
+func (c Claims) Subject() string {
+	if c.UserID == "" {
+		return c.ClientID
+	}
+	return c.UserID
+}
+
+// newAccessTokenClaims builds the claims of an access token issued to the subject, which is either a user or a client.
+// The scope claim is only set if there are scopes, as a space-delimited list as per RFC 8693.
+func newAccessTokenClaims(settings TokenSettings, subject string, audiences, scopes []string) (jwt.MapClaims, error) {
+	if subject == "" || settings.Issuer == "" {
+		return nil, errors.New("missing id or issuer")
+	}
+	if len(audiences) == 0 {
+		return nil, errors.New("missing audience")
+	}
+	jti, err := newTokenID()
+	if err != nil {
+		log.Println("ERROR: error generating token id", err)
+		return nil, err
+	}
+	claims := jwt.MapClaims{
+		"sub": subject,
+		"jti": jti,
+		"iss": settings.Issuer,
+		"iat": timesource.CurrentTime().Unix(),
+		"exp": timesource.CurrentTime().Add(settings.AccessTokenTTL).Unix(),
+	}
+	// A single audience is kept as a string, the same as the tokens issued before multiple audiences were supported
+	if len(audiences) == 1 {
+		claims["aud"] = audiences[0]
+	} else {
+		claims["aud"] = audiences
+	}
+	if len(scopes) > 0 {
+		claims["scope"] = strings.Join(scopes, " ")
+	}
+	return claims, nil
+}
+
+// newUserAccessTokenClaims builds the claims of an access token issued to a user, which carry the user id in the userClaims.
+// The tokens that the clients get for themselves lack them, so that such a token is never taken for the token of a user.
+func newUserAccessTokenClaims(settings TokenSettings, userId string, audiences, scopes []string) (jwt.MapClaims, error) {
+	claims, err := newAccessTokenClaims(settings, userId, audiences, scopes)
+	if err != nil {
+		return nil, err
+	}
+	// The user claims just contains an id.
+	// Therefore, there is no need to encrypt the claims.
+	claims["userClaims"] = ClientClaims{
+		UserID: userId,
+	}
+	return claims, nil
+}
+
+// setAMR sets the amr claim, unless there are no authentication methods to carry.
+func setAMR(claims jwt.MapClaims, amr []string) {
+	if len(amr) > 0 {
+		claims["amr"] = amr
+	}
+}
+
+// newTokenID generates a random value for the jti claim.
+func newTokenID() (string, error) {
+	return randomString(16)
+}
+
+// claimsFromToken extracts the Claims from a parsed and validated token.
+func claimsFromToken(t *jwt.Token) (Claims, error) {
+	claims, ok := t.Claims.(jwt.MapClaims)
+	if !ok {
+		log.Println("DEBUG: invalid claims")
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+	if claims["typ"] == idTokenType {
+		log.Println("DEBUG: ID token presented as an access token")
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+
+	// The userClaims are absent from the tokens that the clients get for themselves, which leaves the user id empty
+	var id string
+	if v, present := claims["userClaims"]; present {
+		userClaims, ok := v.(map[string]interface{})
+		if !ok {
+			log.Println("DEBUG: invalid userClaims in claims")
+			return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+		}
+		if id, ok = userClaims["user_id"].(string); !ok || id == "" {
+			log.Println("DEBUG: invalid user_id in claims")
+			return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+		}
+		if claims["sub"] != id {
+			log.Println("DEBUG: invalid sub in token claims")
+			return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+		}
+	}
+	jti, ok := claims["jti"].(string)
+	if !ok || jti == "" {
+		log.Println("DEBUG: missing jti in token claims")
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+	// The presence of iat and exp has already been enforced by the parser
+	iat, err := claims.GetIssuedAt()
+	if err != nil || iat == nil {
+		log.Println("DEBUG: invalid iat in token claims")
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		log.Println("DEBUG: invalid exp in token claims")
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+	var amr []string
+	if v, ok := claims["amr"]; ok {
+		values, ok := v.([]interface{})
+		if !ok {
+			log.Println("DEBUG: invalid amr in token claims")
+			return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+		}
+		for _, value := range values {
+			method, ok := value.(string)
+			if !ok {
+				log.Println("DEBUG: invalid amr in token claims")
+				return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+			}
+			amr = append(amr, method)
+		}
+	}
+
+	scope, ok := claims["scope"].(string)
+	if _, present := claims["scope"]; present && !ok {
+		log.Println("DEBUG: invalid scope in token claims")
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+	clientID, ok := claims["client_id"].(string)
+	if _, present := claims["client_id"]; present && !ok {
+		log.Println("DEBUG: invalid client_id in token claims")
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+	if id == "" && (clientID == "" || claims["sub"] != clientID) {
+		log.Println("DEBUG: token of neither a user nor a client")
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+
+	return Claims{
+		UserID:    id,
+		ID:        jti,
+		IssuedAt:  iat.Time,
+		ExpiresAt: exp.Time,
+		AMR:       amr,
+		Scopes:    ParseScope(scope),
+		ClientID:  clientID,
+	}, nil
+}
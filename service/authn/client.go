@@ -0,0 +1,214 @@
+package authn
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"user-service/errorx"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/*
+Note about the client registry:
+
+Every client that can obtain tokens has to be registered, with a client_id and a client_secret, along with the scopes it may request,
+and the audiences it may request tokens for. The secrets are generated by the server as long random strings, so, same as for the
+refresh tokens, a SHA-256 hash is enough to keep a leaked datastore from leaking usable secrets. Unlike a password, such a secret can
+not be guessed from its hash.
+
+The browser and mobile apps can not keep a secret, as it would ship with the app. They are registered as public clients, without a
+secret, and may only use the authorization code flow, where PKCE takes the place of the client authentication.
+*/
+
+// Scopes that can be granted to the clients.
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+)
+
+// The sample clients, seeded by InitClientData.
+const (
+	sampleClientID          = clientId
+	samplePublicClientID    = "webapp"
+	samplePublicRedirectURI = "http://localhost:8080/callback"
+)
+
+// Client is a registered OAuth2 client. Only a hash of its secret is stored.
+type Client struct {
+	ID         string
+	SecretHash string
+	Scopes     []string // The scopes the client may request
+	Audiences  []string // The audiences the client may request tokens for
+	// The redirect URIs that the authorization codes may be sent to, compared as exact strings
+	RedirectURIs []string
+	Public       bool // Set for the clients without a secret, which may only use the authorization code flow
+}
+
+// ClientRepository persists the registered clients.
+// GetClient returns an errorx.Error with errorx.NotFound code if the client does not exist,
+// and CreateClient returns one with errorx.Conflict code if it already exists.
+type ClientRepository interface {
+	GetClient(ctx context.Context, id string) (Client, error)
+	CreateClient(ctx context.Context, c Client) error
+}
+
+// HashClientSecret returns the hash of the client secret, as stored in the client registry.
+func HashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthenticateClient checks the credentials of a client against the client registry.
+// Unknown clients and wrong secrets both result in an errorx.InvalidClient error, so that the response does not reveal which clients exist.
+func AuthenticateClient(ctx context.Context, repo ClientRepository, id, secret string) (Client, error) {
+	if id == "" || secret == "" {
+		return Client{}, errorx.Error{Code: errorx.InvalidClient}
+	}
+	c, err := getClient(ctx, repo, id)
+	if err != nil {
+		return Client{}, err
+	}
+	if c.Public {
+		log.Println("DEBUG: secret presented for a public client", id)
+		return Client{}, errorx.Error{Code: errorx.InvalidClient}
+	}
+	if subtle.ConstantTimeCompare([]byte(HashClientSecret(secret)), []byte(c.SecretHash)) != 1 {
+		log.Println("DEBUG: invalid client secret")
+		return Client{}, errorx.Error{Code: errorx.InvalidClient}
+	}
+	return c, nil
+}
+
+// getClient fetches a registered client, and turns an unknown client into an errorx.InvalidClient error.
+func getClient(ctx context.Context, repo ClientRepository, id string) (Client, error) {
+	c, err := repo.GetClient(ctx, id)
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			log.Println("DEBUG: client not found")
+			return Client{}, errorx.Error{Code: errorx.InvalidClient}
+		}
+		return Client{}, err
+	}
+	return c, nil
+}
+
+// Grant narrows down the requested scopes and audiences to the ones the client is allowed to request.
+// Requesting none grants all the allowed ones, while requesting one that is not allowed fails the whole request,
+// with an errorx.InvalidScope or errorx.InvalidTarget error.
+func (c Client) Grant(scopes, audiences []string) ([]string, []string, error) {
+	for _, scope := range scopes {
+		if !slices.Contains(c.Scopes, scope) {
+			log.Println("DEBUG: scope not allowed for the client", c.ID, scope)
+			return nil, nil, errorx.Error{Code: errorx.InvalidScope}
+		}
+	}
+	for _, aud := range audiences {
+		if !slices.Contains(c.Audiences, aud) {
+			log.Println("DEBUG: audience not allowed for the client", c.ID, aud)
+			return nil, nil, errorx.Error{Code: errorx.InvalidTarget}
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = c.Scopes
+	}
+	if len(audiences) == 0 {
+		audiences = c.Audiences
+	}
+	if len(audiences) == 0 {
+		log.Println("DEBUG: no audience allowed for the client", c.ID)
+		return nil, nil, errorx.Error{Code: errorx.InvalidTarget}
+	}
+	return slices.Clone(scopes), slices.Clone(audiences), nil
+}
+
+// ClientCredentialsRequest is a token request of the client_credentials grant, as defined by RFC 6749 section 4.4.
+type ClientCredentialsRequest struct {
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Audiences    []string
+}
+
+// AccessToken is an issued access token, along with the details that are returned to the client next to it.
+type AccessToken struct {
+	Token     string
+	ExpiresIn time.Duration
+	Scopes    []string
+	IDToken   string // Only set in the authorization code flow, if the openid scope was granted
+}
+
+// IssueClientCredentialsToken authenticates the client, and issues an access token to the client itself, i.e. its client_id is the subject.
+// The sign function signs the claims of the token with the configured signing method.
+func IssueClientCredentialsToken(ctx context.Context, repo ClientRepository, sign func(jwt.MapClaims) (string, error), settings TokenSettings, req ClientCredentialsRequest) (AccessToken, error) {
+	c, err := AuthenticateClient(ctx, repo, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	scopes, audiences, err := c.Grant(req.Scopes, req.Audiences)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	claims, err := newAccessTokenClaims(settings, c.ID, audiences, scopes)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	// As per RFC 9068, the client_id claim identifies the client, which happens to be the subject as well for this grant
+	claims["client_id"] = c.ID
+	token, err := sign(claims)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	return AccessToken{Token: token, ExpiresIn: settings.AccessTokenTTL, Scopes: scopes}, nil
+}
+
+// ParseScope splits a space-delimited scope parameter, as defined by RFC 6749 section 3.3.
+func ParseScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// InitClientData registers the sample clients, unless they are already registered.
+// The clients may request tokens for the audience, which is generally the one this service is known by.
+// The confidential sample client is only registered with a secret, as a secret in the source would let anyone obtain its tokens.
+func InitClientData(ctx context.Context, repo ClientRepository, audience, secret string) error {
+	samples := []Client{
+		{
+			ID:           samplePublicClientID,
+			Scopes:       []string{ScopeUsersRead},
+			Audiences:    []string{audience},
+			RedirectURIs: []string{samplePublicRedirectURI},
+			Public:       true,
+		},
+	}
+	if secret != "" {
+		samples = append(samples, Client{
+			ID:         sampleClientID,
+			SecretHash: HashClientSecret(secret),
+			Scopes:     []string{ScopeUsersRead, ScopeUsersWrite},
+			Audiences:  []string{audience},
+		})
+	} else {
+		log.Println("INFO: SAMPLE_CLIENT_SECRET is not set, the sample client", sampleClientID, "is not registered")
+	}
+	for _, c := range samples {
+		_, err := repo.GetClient(ctx, c.ID)
+		if err == nil {
+			continue
+		}
+		var e errorx.Error
+		if !errors.As(err, &e) || e.Code != errorx.NotFound {
+			return err
+		}
+		if err := repo.CreateClient(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+package authn
+
+// KeyReloads returns the number of reloads done by the key directory watcher of the service.
+func KeyReloads(s *Service) int64 {
+	return s.keys.reloads.Load()
+}
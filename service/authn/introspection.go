@@ -0,0 +1,47 @@
+package authn
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+// Introspection is the introspection response of RFC 7662 section 2.2.
+// An inactive token only ever has the active member, so that nothing is disclosed about an invalid token.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// IntrospectToken reports the state of an access token, in the manner of RFC 7662. A token is active if it validates,
+// and it has not been revoked. The refresh tokens are opaque to the resource servers, so they are never reported as active.
+func IntrospectToken(ctx context.Context, validate func(token string) (Claims, error), repo RevokedTokenRepository, token string) (Introspection, error) {
+	claims, err := validate(token)
+	if err != nil {
+		// The reason is of no concern to the caller, which only needs to know that the token can not be accepted
+		log.Println("DEBUG: introspected token is not valid", err)
+		return Introspection{Active: false}, nil
+	}
+	revoked, err := repo.IsTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if revoked {
+		log.Println("DEBUG: introspected token is revoked")
+		return Introspection{Active: false}, nil
+	}
+	return Introspection{
+		Active:    true,
+		Subject:   claims.Subject(),
+		ExpiresAt: claims.ExpiresAt.Unix(),
+		IssuedAt:  claims.IssuedAt.Unix(),
+		Scope:     strings.Join(claims.Scopes, " "),
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+	}, nil
+}
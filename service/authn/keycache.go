@@ -0,0 +1,87 @@
+package authn
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// keyCache keeps the parsed key set in memory, so that the key files are not read and parsed on every request.
+// The key directory is watched for changes, and a new key set is swapped in atomically once it has been loaded successfully.
+// The readers never block, and always see either the old or the new key set as a whole.
+type keyCache struct {
+	dir       string
+	activeKid string
+	current   atomic.Pointer[KeySet]
+	reloads   atomic.Int64 // The number of reloads done by the watcher, successful or not, for the tests to wait on
+}
+
+func newKeyCache(dir, activeKid string) (*keyCache, error) {
+	c := &keyCache{dir: dir, activeKid: activeKid}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *keyCache) keySet() *KeySet {
+	return c.current.Load()
+}
+
+// reload keeps the current key set if the new one can not be loaded, e.g. because a key file is only partially written.
+// A later change to the directory triggers another reload.
+func (c *keyCache) reload() error {
+	ks, err := LoadKeySet(c.dir, c.activeKid)
+	if err != nil {
+		return err
+	}
+	c.current.Store(ks)
+	return nil
+}
+
+// watch reloads the key set on every change to the key directory, until the context is done.
+// The directory is watched instead of the files, so that files replaced via rename (e.g. mounted secrets) are picked up as well.
+func (c *keyCache) watch(ctx context.Context, wg *sync.WaitGroup) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(c.dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+					continue
+				}
+				err := c.reload()
+				c.reloads.Add(1)
+				if err != nil {
+					log.Println("ERROR: error reloading key set, keeping the previous keys", err)
+					continue
+				}
+				log.Println("INFO: reloaded key set after a change to", event.Name)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("ERROR: error watching key directory", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,141 @@
+package authn_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"user-service/authn"
+	"user-service/config"
+	"user-service/testutils"
+)
+
+func keyDirService(method, dir, kid string) *authn.Service {
+	svc := authn.InitService(testutils.InitTestStore())
+	svc.Cfg = &config.Config{SigningMethod: method, KeyDir: dir, SigningKeyID: kid}
+	return svc
+}
+
+// eventually polls the condition, as the key directory changes are picked up asynchronously.
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestWatchKeysReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	testutils.WriteRSAKeyPair(t, dir, "k1")
+	svc := keyDirService("rsa", dir, "k1")
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	if err := svc.WatchKeys(ctx, wg); err != nil {
+		t.Fatalf("error watching keys: %v", err)
+	}
+
+	oldToken, err := svc.GenerateToken("client_user")
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	if _, err := svc.ValidateToken(oldToken); err != nil {
+		t.Fatalf("error validating token: %v", err)
+	}
+
+	// Replacing the key pair swaps the cached keys, so the tokens of the old key pair are no longer valid.
+	testutils.WriteRSAKeyPair(t, dir, "k1")
+	if !eventually(func() bool { _, err := svc.ValidateToken(oldToken); return err != nil }) {
+		t.Fatal("expected the old token to be rejected after the key change")
+	}
+	newToken, err := svc.GenerateToken("client_user")
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	if _, err := svc.ValidateToken(newToken); err != nil {
+		t.Errorf("error validating token: %v", err)
+	}
+
+	// A broken key file does not replace the working key set
+	reloads := authn.KeyReloads(svc)
+	testutils.WriteFile(t, filepath.Join(dir, "k2.public.pem"), []byte("not a key"))
+	if !eventually(func() bool { return authn.KeyReloads(svc) > reloads }) {
+		t.Fatal("expected the key set to be reloaded after the broken key file was written")
+	}
+	if _, err := svc.ValidateToken(newToken); err != nil {
+		t.Errorf("expected the previous keys to be kept, got %v", err)
+	}
+	os.Remove(filepath.Join(dir, "k2.public.pem"))
+}
+
+// BenchmarkValidateToken compares reading the keys from disk on every validation with the cached keys.
+func BenchmarkValidateToken(b *testing.B) {
+	dir := b.TempDir()
+	testutils.WriteRSAKeyPair(b, dir, "k1")
+
+	b.Run("disk", func(b *testing.B) {
+		svc := keyDirService("rsa", dir, "k1")
+		token, err := svc.GenerateToken("client_user")
+		if err != nil {
+			b.Fatalf("error generating token: %v", err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := svc.ValidateToken(token); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		svc := keyDirService("rsa", dir, "k1")
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		defer func() {
+			cancel()
+			wg.Wait()
+		}()
+		if err := svc.WatchKeys(ctx, wg); err != nil {
+			b.Fatalf("error watching keys: %v", err)
+		}
+		token, err := svc.GenerateToken("client_user")
+		if err != nil {
+			b.Fatalf("error generating token: %v", err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := svc.ValidateToken(token); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCheckSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	if err := keyDirService("rsa", dir, "").CheckSigningKey(); err == nil {
+		t.Error("expected an error for an empty key directory")
+	}
+	testutils.WriteRSAKeyPair(t, dir, "k1")
+	if err := keyDirService("rsa", dir, "").CheckSigningKey(); err != nil {
+		t.Errorf("expected the single key to be accepted, got %v", err)
+	}
+	if err := keyDirService("rsa", dir, "k2").CheckSigningKey(); err == nil {
+		t.Error("expected an error for an unknown signing-kid")
+	}
+	if err := keyDirService("eddsa", dir, "k1").CheckSigningKey(); err == nil {
+		t.Error("expected an error for a key that does not match the signing method")
+	}
+	if err := keyDirService("hmac", t.TempDir(), "").CheckSigningKey(); err != nil {
+		t.Errorf("expected no key to be required for hmac, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package authn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/*
+Note about the key set:
+
+The key directory may hold several key pairs, each one identified by a key id (kid), using the following file names:
+	<kid>.private.pem and <kid>.public.pem
+
+The original private.pem and public.pem files are still supported, and are given the kid "default".
+
+Only the active key, selected via config, is used to sign new tokens. Every other key is a retiring key, which is only used
+to validate the tokens that it signed before the rotation. A retiring key only needs its public key file, and it can be removed
+from the directory once the tokens it signed have expired.
+*/
+
+// Kid given to the key pair stored with the original private.pem and public.pem file names
+const defaultKid = "default"
+
+// Key is a single key pair of the key set. The PrivateKey is nil for the keys that can only be used for validation.
+type Key struct {
+	ID         string
+	PublicKey  crypto.PublicKey
+	PrivateKey crypto.PrivateKey
+}
+
+// KeySet holds all the keys found in the key directory.
+type KeySet struct {
+	Keys     []Key
+	ActiveID string
+}
+
+// kidFromFileName returns the kid and the kind of key of a key file, or ok as false if it is not a key file.
+func kidFromFileName(name string) (kid string, private bool, ok bool) {
+	switch {
+	case name == privateKeyFile:
+		return defaultKid, true, true
+	case name == publicKeyFile:
+		return defaultKid, false, true
+	case strings.HasSuffix(name, ".private.pem"):
+		kid = strings.TrimSuffix(name, ".private.pem")
+		return kid, true, kid != ""
+	case strings.HasSuffix(name, ".public.pem"):
+		kid = strings.TrimSuffix(name, ".public.pem")
+		return kid, false, kid != ""
+	}
+	return "", false, false
+}
+
+// LoadKeySet reads all the key files of the directory.
+// An empty activeKid selects the only key with a private key, if there is exactly one such key.
+func LoadKeySet(dir string, activeKid string) (*KeySet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println("ERROR: error reading key directory", err)
+		return nil, err
+	}
+	keys := map[string]*Key{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		kid, private, ok := kidFromFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		key, found := keys[kid]
+		if !found {
+			key = &Key{ID: kid}
+			keys[kid] = key
+		}
+		path := filepath.Join(dir, entry.Name())
+		if private {
+			pKey, err := ReadPrivatekey(path)
+			if err != nil {
+				return nil, err
+			}
+			key.PrivateKey = pKey
+			// The public key is derived from the private key, so that a separate public key file is optional
+			if key.PublicKey == nil {
+				key.PublicKey = pKey.Public()
+			}
+		} else {
+			pubKey, err := ReadPublickey(path)
+			if err != nil {
+				return nil, err
+			}
+			key.PublicKey = pubKey
+		}
+	}
+
+	ks := &KeySet{ActiveID: activeKid}
+	for _, key := range keys {
+		ks.Keys = append(ks.Keys, *key)
+	}
+	// A stable order keeps the JWKS output stable
+	slices.SortFunc(ks.Keys, func(a, b Key) int { return strings.Compare(a.ID, b.ID) })
+
+	if ks.ActiveID == "" {
+		var signers []string
+		for _, key := range ks.Keys {
+			if key.PrivateKey != nil {
+				signers = append(signers, key.ID)
+			}
+		}
+		if len(signers) == 1 {
+			ks.ActiveID = signers[0]
+		}
+	}
+	return ks, nil
+}
+
+// SigningKey returns the active key, which is used to sign new tokens.
+func (ks *KeySet) SigningKey() (Key, error) {
+	if ks.ActiveID == "" {
+		return Key{}, errors.New("no active signing key")
+	}
+	key, err := ks.VerificationKey(ks.ActiveID)
+	if err != nil {
+		return Key{}, err
+	}
+	if key.PrivateKey == nil {
+		return Key{}, errors.New("no private key found for the active signing key")
+	}
+	return key, nil
+}
+
+// VerificationKey returns the key with the supplied kid.
+// An empty kid is only accepted when there is no ambiguity, i.e. there is a single key in the set.
+func (ks *KeySet) VerificationKey(kid string) (Key, error) {
+	if kid == "" {
+		if len(ks.Keys) == 1 {
+			return ks.Keys[0], nil
+		}
+		return Key{}, errors.New("missing kid")
+	}
+	for _, key := range ks.Keys {
+		if key.ID == kid {
+			return key, nil
+		}
+	}
+	return Key{}, errors.New("unknown kid")
+}
+
+// JWK is the JSON Web Key representation (RFC 7517) of a public key.
+// RSA keys use the n and e members, EC keys use crv, x and y, and Ed25519 keys (RFC 8037) use crv and x.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the JSON Web Key Set document, as served on the jwks endpoint.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the key set, including the retiring ones, so that the tokens they signed can still be validated.
+func (ks *KeySet) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range ks.Keys {
+		jwk, err := publicJWK(key)
+		if err != nil {
+			log.Println("WARN: skipping key in jwks", key.ID, err)
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func publicJWK(key Key) (JWK, error) {
+	method, err := signingMethodForKey(key.PublicKey)
+	if err != nil {
+		return JWK{}, err
+	}
+	jwk := JWK{Kid: key.ID, Use: "sig", Alg: method.Alg()}
+	switch pub := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// The uncompressed point is 0x04 || x || y, with both coordinates padded to the size of the curve
+		ecdhKey, err := pub.ECDH()
+		if err != nil {
+			return JWK{}, err
+		}
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(point[1 : 1+size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(point[1+size:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return jwk, nil
+}
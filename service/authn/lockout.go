@@ -0,0 +1,168 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+	"user-service/errorx"
+	"user-service/timesource"
+)
+
+/*
+Note about the brute-force protection:
+
+The failed login attempts are counted per account, and per IP address. Once a counter reaches the threshold of its policy, every further
+failure locks the account (or the IP address) out for twice as long as the previous one, up to a maximum delay. While locked, the login
+attempts are rejected without checking the password, and are not counted. The counters are forgotten once there has not been any failure
+for a while.
+
+The per-account counter slows down the guessing of the password of a single account, from any number of IP addresses. The per-IP counter
+slows down the guessing of the passwords of many accounts from a single IP address, which would not trip the per-account counters.
+A successful login only resets the per-account counter, otherwise a valid account would let an attacker reset the per-IP counter.
+
+Note that the unknown accounts are counted and locked out the same way, so that the lockout does not reveal which accounts exist.
+*/
+
+// LockoutPolicy is the policy of one kind of failed login attempt counter.
+type LockoutPolicy struct {
+	Threshold  int           // The number of failures that lock the account (or the IP address) out for the first time
+	BaseDelay  time.Duration // The duration of the first lockout, which is doubled with every further failure
+	MaxDelay   time.Duration
+	ResetAfter time.Duration // The counter is forgotten after this long without any failure
+}
+
+// The policies are fixed for this sample service. A deployment that needs other thresholds or delays would make them configurable,
+// like the token lifetimes.
+var (
+	accountLockoutPolicy = LockoutPolicy{Threshold: 5, BaseDelay: 30 * time.Second, MaxDelay: 15 * time.Minute, ResetAfter: time.Hour}
+	ipLockoutPolicy      = LockoutPolicy{Threshold: 20, BaseDelay: 30 * time.Second, MaxDelay: 15 * time.Minute, ResetAfter: time.Hour}
+)
+
+// LoginAttempts is the failed login attempt counter of an account or an IP address.
+type LoginAttempts struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+}
+
+// LoginAttemptRepository persists the failed login attempt counters, keyed by the account or IP address they count.
+// RecordLoginFailure atomically increments the counter and returns its new state, so that concurrent failures are never lost.
+// A counter whose last failure is before resetBefore starts over from a single failure. The implementations may prune such counters.
+// GetLoginAttempts returns a zero counter if there is none.
+type LoginAttemptRepository interface {
+	GetLoginAttempts(ctx context.Context, key string) (LoginAttempts, error)
+	RecordLoginFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (LoginAttempts, error)
+	ResetLoginAttempts(ctx context.Context, key string) error
+}
+
+// LockoutError is returned for the login attempts that are rejected because of a lockout.
+// It unwraps to an errorx.Error with errorx.AccountLocked code.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e LockoutError) Error() string {
+	return string(errorx.AccountLocked)
+}
+
+func (e LockoutError) Unwrap() error {
+	return errorx.Error{Code: errorx.AccountLocked}
+}
+
+func accountLockoutKey(userId string) string {
+	return "user:" + userId
+}
+
+func ipLockoutKey(ip string) string {
+	return "ip:" + ip
+}
+
+// lockedFor returns how long the counter is still locked out for, or zero if it is not.
+func (p LockoutPolicy) lockedFor(attempts LoginAttempts, now time.Time) time.Duration {
+	if attempts.Failures < p.Threshold || now.Sub(attempts.LastFailure) >= p.ResetAfter {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.Threshold; i < attempts.Failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+	return max(attempts.LastFailure.Add(delay).Sub(now), 0)
+}
+
+// checkLockout returns a LockoutError if the counter under the key is locked out.
+func checkLockout(ctx context.Context, repo LoginAttemptRepository, policy LockoutPolicy, key string, now time.Time) error {
+	attempts, err := repo.GetLoginAttempts(ctx, key)
+	if err != nil {
+		return err
+	}
+	if d := policy.lockedFor(attempts, now); d > 0 {
+		log.Println("WARN: login attempt during lockout", key)
+		return LockoutError{RetryAfter: d}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login attempt, and logs the lockouts that it causes.
+func recordLoginFailure(ctx context.Context, repo LoginAttemptRepository, policy LockoutPolicy, key string, now time.Time) error {
+	attempts, err := repo.RecordLoginFailure(ctx, key, now, now.Add(-policy.ResetAfter))
+	if err != nil {
+		return err
+	}
+	if d := policy.lockedFor(attempts, now); d > 0 {
+		log.Println("WARN: locked out after failed login attempts", key, attempts.Failures, d)
+	}
+	return nil
+}
+
+// LoginStore groups the repositories that the login works with.
+type LoginStore interface {
+	PasswordRepository
+	LoginAttemptRepository
+	MFARepository
+	MFAChallengeRepository
+}
+
+// Login checks the password of the user, unless the account or the IP address of the client is locked out.
+// It returns a LockoutError during a lockout, and an errorx.InvalidCredentials error for wrong credentials.
+// For a user with MFA enabled, it returns an MFA challenge token, which has to be completed with VerifyMFAChallenge.
+// Otherwise, the returned token is empty and the login is complete.
+func Login(ctx context.Context, db LoginStore, userId, password, ip string) (string, error) {
+	now := timesource.CurrentTime()
+	if err := checkLockout(ctx, db, accountLockoutPolicy, accountLockoutKey(userId), now); err != nil {
+		return "", err
+	}
+	if err := checkLockout(ctx, db, ipLockoutPolicy, ipLockoutKey(ip), now); err != nil {
+		return "", err
+	}
+	err := AuthenticateUser(ctx, db, userId, password)
+	var e errorx.Error
+	if errors.As(err, &e) && e.Code == errorx.InvalidCredentials {
+		if err := recordLoginFailure(ctx, db, accountLockoutPolicy, accountLockoutKey(userId), now); err != nil {
+			return "", err
+		}
+		if err := recordLoginFailure(ctx, db, ipLockoutPolicy, ipLockoutKey(ip), now); err != nil {
+			return "", err
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	challenge, err := startMFAChallenge(ctx, db, userId)
+	if err != nil || challenge != "" {
+		// The counter is only reset once the second factor is verified as well, otherwise the password alone would reset it
+		return challenge, err
+	}
+	return "", db.ResetLoginAttempts(ctx, accountLockoutKey(userId))
+}
+
+// UnlockAccount lifts the lockout of an account, by resetting its failed login attempt counter.
+func UnlockAccount(ctx context.Context, repo LoginAttemptRepository, userId string) error {
+	if userId == "" {
+		return errors.New("missing id")
+	}
+	log.Println("INFO: unlocking account", userId)
+	return repo.ResetLoginAttempts(ctx, accountLockoutKey(userId))
+}
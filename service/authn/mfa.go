@@ -0,0 +1,375 @@
+package authn
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+	"user-service/errorx"
+	"user-service/timesource"
+)
+
+/*
+Note about the multi-factor authentication:
+
+A user can opt in to TOTP (RFC 6238), as the second factor after the password. The enrollment stores a new secret, which the user
+loads into an authenticator app via the returned otpauth:// URI, and it only takes effect once confirmed with a valid code. The
+confirmation returns a set of single-use recovery codes, for when the authenticator app is lost. Only their SHA-256 hashes are kept.
+
+Once MFA is enabled, a valid password does not return a token pair any more, but an opaque MFA challenge token, which is exchanged
+for the token pair along with a TOTP or a recovery code. The access tokens carry the methods used for the login in the amr claim,
+so that the sensitive endpoints can require a login with a second factor.
+
+The accepted codes can not be replayed, as the time step of the last accepted code is stored. The wrong codes count as failed login
+attempts, so the brute-force protection of the password login covers the codes as well.
+*/
+const (
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+	// The number of time steps that a code is accepted before and after the current one, to allow for the clock drift of the devices
+	totpSkew             = 1
+	totpSecretLen        = 20 // bytes, the length of the HMAC-SHA1 output as recommended by RFC 4226
+	recoveryCodeCount    = 10
+	recoveryCodeLen      = 10
+	mfaChallengeValidity = 5 * time.Minute
+)
+
+// MFA is the second factor enrollment of a user.
+type MFA struct {
+	UserID string
+	// The base32 encoded TOTP secret. Unlike the passwords, it can not be hashed, as it is needed to compute the codes.
+	Secret        string
+	Enabled       bool     // Set once the enrollment is confirmed with a valid code
+	LastUsedStep  int64    // The time step of the last accepted code
+	RecoveryCodes []string // The hashes of the unused recovery codes
+}
+
+// MFARepository persists the second factor enrollments, keyed by the user id.
+// UseTOTPStep atomically raises the last used time step, and returns an errorx.Error with errorx.Conflict code if the step is not
+// after the last used one, so that a code can not be accepted twice. UseRecoveryCode atomically removes a recovery code, and returns
+// an errorx.Error with errorx.NotFound code if there is no such unused code.
+// GetMFA returns an errorx.Error with errorx.NotFound code if the user has no enrollment.
+type MFARepository interface {
+	GetMFA(ctx context.Context, userId string) (MFA, error)
+	SetMFA(ctx context.Context, mfa MFA) error
+	DeleteMFA(ctx context.Context, userId string) error
+	UseTOTPStep(ctx context.Context, userId string, step int64) error
+	UseRecoveryCode(ctx context.Context, userId string, hash string) error
+}
+
+// MFAChallenge is the server-side state of an MFA challenge token, which is issued for a valid password.
+type MFAChallenge struct {
+	Hash      string
+	UserID    string
+	ExpiresAt time.Time
+}
+
+// MFAChallengeRepository persists the MFA challenges, keyed by the hash of their token.
+// The implementations may prune the expired challenges when a new one is created.
+// UseMFAChallenge atomically removes a challenge and returns it, so that a challenge can only be verified once at a time.
+// It returns an errorx.Error with errorx.NotFound code if the challenge does not exist.
+type MFAChallengeRepository interface {
+	CreateMFAChallenge(ctx context.Context, c MFAChallenge) error
+	UseMFAChallenge(ctx context.Context, hash string) (MFAChallenge, error)
+}
+
+// TOTPEnrollment is returned on the enrollment, for the user to set up an authenticator app.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// hashMFASecret hashes the recovery codes and the challenge tokens, which are long random strings, so a fast hash is enough.
+func hashMFASecret(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// hotp computes the code of the counter, as per RFC 4226.
+func hotp(key []byte, counter int64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// TOTPCode returns the code of the secret at the supplied time, as an authenticator app would compute it.
+func TOTPCode(secret string, at time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, totpStep(at)), nil
+}
+
+// normalizeCode strips the separators that the users may type along with a code.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// verifyTOTP checks the code against the time steps around now, and marks the matching step as used.
+func verifyTOTP(ctx context.Context, repo MFARepository, mfa MFA, code string, now time.Time) (bool, error) {
+	key, err := decodeTOTPSecret(mfa.Secret)
+	if err != nil {
+		log.Println("ERROR: invalid TOTP secret", err)
+		return false, err
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= mfa.LastUsedStep || subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) != 1 {
+			continue
+		}
+		if err := repo.UseTOTPStep(ctx, mfa.UserID, step); err != nil {
+			var e errorx.Error
+			if errors.As(err, &e) && e.Code == errorx.Conflict {
+				log.Println("WARN: TOTP code replayed for the user", mfa.UserID)
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// verifySecondFactor checks either a TOTP code or a recovery code, which are told apart by their length.
+// It returns the amr values of the second factor, i.e. otp and mfa for a TOTP code, and only mfa for a recovery code,
+// which is not a one-time password of RFC 8176. A wrong code results in no values.
+func verifySecondFactor(ctx context.Context, repo MFARepository, mfa MFA, code string, now time.Time) ([]string, error) {
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		ok, err := verifyTOTP(ctx, repo, mfa, code, now)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return []string{AMROTP, AMRMFA}, nil
+	}
+	err := repo.UseRecoveryCode(ctx, mfa.UserID, hashMFASecret(code))
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	log.Println("INFO: recovery code used for the user", mfa.UserID)
+	return []string{AMRMFA}, nil
+}
+
+// newRecoveryCodes returns the recovery codes to show to the user once, along with their hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeLen)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		// 256 is a multiple of the alphabet size, so every character is equally likely
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		hashes[i] = hashMFASecret(string(b))
+		codes[i] = string(b[:recoveryCodeLen/2]) + "-" + string(b[recoveryCodeLen/2:])
+	}
+	return codes, hashes, nil
+}
+
+// EnrollTOTP starts the TOTP enrollment of the user, replacing any unconfirmed enrollment.
+// It returns an errorx.Error with errorx.Conflict code if MFA is already enabled, in which case it has to be disabled first.
+func EnrollTOTP(ctx context.Context, repo MFARepository, issuer, userId string) (TOTPEnrollment, error) {
+	if userId == "" || issuer == "" {
+		return TOTPEnrollment{}, errors.New("missing id or issuer")
+	}
+	existing, err := repo.GetMFA(ctx, userId)
+	var e errorx.Error
+	if err != nil && !(errors.As(err, &e) && e.Code == errorx.NotFound) {
+		return TOTPEnrollment{}, err
+	}
+	if err == nil && existing.Enabled {
+		return TOTPEnrollment{}, errorx.Error{Code: errorx.Conflict, Message: "MFA is already enabled"}
+	}
+	key := make([]byte, totpSecretLen)
+	if _, err := rand.Read(key); err != nil {
+		log.Println("ERROR: error generating TOTP secret", err)
+		return TOTPEnrollment{}, err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	if err := repo.SetMFA(ctx, MFA{UserID: userId, Secret: secret}); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	// The key URI format of the authenticator apps, see https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	uri := fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(userId), params.Encode())
+	return TOTPEnrollment{Secret: secret, URI: uri}, nil
+}
+
+// ConfirmTOTP enables MFA for the user, once the enrollment is confirmed with a valid code, and returns the recovery codes.
+// A wrong code results in an errorx.InvalidCredentials error, and a missing enrollment in an errorx.NotFound error.
+func ConfirmTOTP(ctx context.Context, repo MFARepository, userId, code string) ([]string, error) {
+	mfa, err := repo.GetMFA(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if mfa.Enabled {
+		return nil, errorx.Error{Code: errorx.Conflict, Message: "MFA is already enabled"}
+	}
+	ok, err := verifyTOTP(ctx, repo, mfa, normalizeCode(code), timesource.CurrentTime())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		log.Println("DEBUG: invalid TOTP code on the enrollment")
+		return nil, errorx.Error{Code: errorx.InvalidCredentials}
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Println("ERROR: error generating recovery codes", err)
+		return nil, err
+	}
+	if mfa, err = repo.GetMFA(ctx, userId); err != nil {
+		return nil, err
+	}
+	mfa.Enabled = true
+	mfa.RecoveryCodes = hashes
+	if err := repo.SetMFA(ctx, mfa); err != nil {
+		return nil, err
+	}
+	log.Println("INFO: MFA enabled for the user", userId)
+	return codes, nil
+}
+
+// DisableMFA removes the second factor of the user, whether the enrollment was confirmed or not.
+// The refresh tokens of the logins made with the second factor are revoked, as they would otherwise outlive it.
+func DisableMFA(ctx context.Context, repo interface {
+	MFARepository
+	RefreshTokenRepository
+}, userId string) error {
+	if userId == "" {
+		return errors.New("missing id")
+	}
+	log.Println("INFO: disabling MFA for the user", userId)
+	if err := repo.DeleteMFA(ctx, userId); err != nil {
+		return err
+	}
+	return repo.RevokeUserRefreshTokens(ctx, userId, AMRMFA)
+}
+
+// startMFAChallenge issues an MFA challenge token if the user has MFA enabled, or returns an empty token otherwise.
+func startMFAChallenge(ctx context.Context, db LoginStore, userId string) (string, error) {
+	mfa, err := db.GetMFA(ctx, userId)
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	if !mfa.Enabled {
+		return "", nil
+	}
+	token, err := randomString(32)
+	if err != nil {
+		log.Println("ERROR: error generating MFA challenge", err)
+		return "", err
+	}
+	c := MFAChallenge{
+		Hash:      hashMFASecret(token),
+		UserID:    userId,
+		ExpiresAt: timesource.CurrentTime().Add(mfaChallengeValidity),
+	}
+	if err := db.CreateMFAChallenge(ctx, c); err != nil {
+		log.Println("ERROR: error storing MFA challenge", err)
+		return "", err
+	}
+	return token, nil
+}
+
+// VerifyMFAChallenge completes a login with the second factor, which is either a TOTP code or a recovery code.
+// It returns the id of the user, along with the amr values of the login, and consumes the challenge. An unknown or expired challenge results in an errorx.InvalidToken error.
+// A wrong code results in an errorx.InvalidCredentials error, and counts as a failed login attempt, while the challenge stays valid.
+//
+// The challenge is consumed before the code is verified, so that the concurrent attempts on the same challenge can not each get a guess
+// past the lockout, or each complete the login. It is only put back after a wrong code, once the failure has been recorded.
+func VerifyMFAChallenge(ctx context.Context, db LoginStore, challenge, code, ip string) (string, []string, error) {
+	if challenge == "" {
+		return "", nil, errorx.Error{Code: errorx.InvalidToken}
+	}
+	now := timesource.CurrentTime()
+	c, err := db.UseMFAChallenge(ctx, hashMFASecret(challenge))
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			log.Println("DEBUG: MFA challenge not found")
+			return "", nil, errorx.Error{Code: errorx.InvalidToken}
+		}
+		return "", nil, err
+	}
+	if !now.Before(c.ExpiresAt) {
+		log.Println("DEBUG: MFA challenge expired")
+		return "", nil, errorx.Error{Code: errorx.InvalidToken}
+	}
+	if err := checkLockout(ctx, db, accountLockoutPolicy, accountLockoutKey(c.UserID), now); err != nil {
+		return "", nil, err
+	}
+	if err := checkLockout(ctx, db, ipLockoutPolicy, ipLockoutKey(ip), now); err != nil {
+		return "", nil, err
+	}
+	mfa, err := db.GetMFA(ctx, c.UserID)
+	if err != nil {
+		// MFA might have been disabled in the meantime, in which case the challenge is of no use any more
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			return "", nil, errorx.Error{Code: errorx.InvalidToken}
+		}
+		return "", nil, err
+	}
+	amr, err := verifySecondFactor(ctx, db, mfa, code, now)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(amr) == 0 {
+		log.Println("DEBUG: invalid MFA code")
+		if err := recordLoginFailure(ctx, db, accountLockoutPolicy, accountLockoutKey(c.UserID), now); err != nil {
+			return "", nil, err
+		}
+		if err := recordLoginFailure(ctx, db, ipLockoutPolicy, ipLockoutKey(ip), now); err != nil {
+			return "", nil, err
+		}
+		if err := db.CreateMFAChallenge(ctx, c); err != nil {
+			return "", nil, err
+		}
+		return "", nil, errorx.Error{Code: errorx.InvalidCredentials}
+	}
+	if err := db.ResetLoginAttempts(ctx, accountLockoutKey(c.UserID)); err != nil {
+		return "", nil, err
+	}
+	return c.UserID, append([]string{AMRPassword}, amr...), nil
+}
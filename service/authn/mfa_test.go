@@ -0,0 +1,28 @@
+package authn_test
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+	"user-service/authn"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		code, err := authn.TOTPCode(secret, time.Unix(tt.unix, 0))
+		if err != nil || code != tt.code {
+			t.Errorf("expected %s at %d, got %s, err %v", tt.code, tt.unix, code, err)
+		}
+	}
+}
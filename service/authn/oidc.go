@@ -0,0 +1,106 @@
+package authn
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"user-service/timesource"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/*
+Note about OpenID Connect:
+
+The service acts as a minimal OpenID Provider, so that the off-the-shelf relying parties can use it. The relying parties find the
+endpoints and the supported algorithms via the discovery document, validate the ID tokens with the keys of the JWKS endpoint,
+and fetch the profile of the user from the userinfo endpoint. The ID tokens only carry the claims about the authentication itself,
+and the profile claims are left to the userinfo endpoint, which keeps the authn package free of the user data.
+
+An ID token is meant for the relying party, and is not an access token. It carries the typ claim of idTokenType, as some providers do,
+and the access token validation rejects any token with it, rather than relying on the claims that an ID token happens to lack.
+*/
+
+// The typ claim of the ID tokens, which marks them apart from the access tokens
+const idTokenType = "ID"
+
+// ProviderMetadata is the discovery document of OpenID Connect Discovery 1.0 section 3.
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// OpenIDConfiguration builds the discovery document. The endpoints are relative to the issuer, which is the URL the service is reached at,
+// and algs are the algorithms that the configured signing method signs with.
+func OpenIDConfiguration(issuer string, algs []string) ProviderMetadata {
+	baseURL := strings.TrimSuffix(issuer, "/")
+	return ProviderMetadata{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             baseURL + "/api/oauth/authorize",
+		TokenEndpoint:                     baseURL + "/api/oauth/token",
+		UserinfoEndpoint:                  baseURL + "/api/userinfo",
+		JWKSURI:                           baseURL + "/.well-known/jwks.json",
+		IntrospectionEndpoint:             baseURL + "/api/token/introspect",
+		RevocationEndpoint:                baseURL + "/api/token/revoke",
+		ScopesSupported:                   []string{ScopeOpenID, ScopeProfile, ScopeUsersRead, ScopeUsersWrite},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  algs,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{CodeChallengeMethodS256},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr", "preferred_username"},
+	}
+}
+
+// IDTokenRequest holds the details of an authentication, that an ID token is issued for.
+type IDTokenRequest struct {
+	Subject  string
+	Audience string // The client_id of the relying party
+	Nonce    string // Echoed back as is, if the relying party sent one along with the authentication request
+	AMR      []string
+	AuthTime time.Time
+}
+
+// GenerateIDToken issues an ID token, as defined by OpenID Connect Core 1.0 section 2.
+// It is only issued to a relying party, whose client_id is its audience, in the authorization code flow.
+// The sign function signs the claims of the token with the configured signing method.
+func GenerateIDToken(sign func(jwt.MapClaims) (string, error), settings TokenSettings, req IDTokenRequest) (string, error) {
+	if req.Subject == "" || req.Audience == "" || settings.Issuer == "" {
+		return "", errors.New("missing id, audience or issuer")
+	}
+	now := timesource.CurrentTime()
+	claims := jwt.MapClaims{
+		"iss":       settings.Issuer,
+		"sub":       req.Subject,
+		"aud":       req.Audience,
+		"iat":       now.Unix(),
+		"exp":       now.Add(settings.AccessTokenTTL).Unix(),
+		"auth_time": req.AuthTime.Unix(),
+		"typ":       idTokenType,
+	}
+	if req.Nonce != "" {
+		claims["nonce"] = req.Nonce
+	}
+	setAMR(claims, req.AMR)
+	token, err := sign(claims)
+	if err != nil {
+		log.Println("ERROR: error signing ID token", err)
+		return "", err
+	}
+	return token, nil
+}
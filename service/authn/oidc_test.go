@@ -0,0 +1,96 @@
+package authn_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"user-service/authn"
+	"user-service/errorx"
+	"user-service/testutils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestOpenIDConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		method string
+		algs   string
+	}{
+		{"rsa", "[RS256]"},
+		{"ecdsa", "[ES256 ES384]"},
+		{"eddsa", "[EdDSA]"},
+	}
+	for _, tt := range tests {
+		// The endpoints are built from the issuer, with or without a trailing slash
+		svc := keyDirService(tt.method, dir, "")
+		svc.Tokens.Issuer = "https://users.example.com/"
+		metadata, err := svc.OpenIDConfiguration()
+		if err != nil || fmt.Sprint(metadata.IDTokenSigningAlgValuesSupported) != tt.algs {
+			t.Errorf("expected %s for %s, got %v, err %v", tt.algs, tt.method, metadata.IDTokenSigningAlgValuesSupported, err)
+		}
+		if metadata.Issuer != "https://users.example.com/" || metadata.JWKSURI != "https://users.example.com/.well-known/jwks.json" {
+			t.Errorf("unexpected discovery document %+v", metadata)
+		}
+	}
+	// The relying parties could not validate the ID tokens signed with an HMAC secret
+	for _, method := range []string{"hmac", "none"} {
+		if _, err := keyDirService(method, dir, "").OpenIDConfiguration(); err == nil || err.Error() != string(errorx.NotFound) {
+			t.Errorf("expected not found for %s, got %v", method, err)
+		}
+	}
+}
+
+func TestNoIDTokenWithHMAC(t *testing.T) {
+	svc := keyDirService("hmac", t.TempDir(), "")
+	svc.Secrets = []string{testutils.TestHMACSecret}
+	if _, err := idTokenFlow(svc); err == nil || err.Error() != string(errorx.InvalidScope) {
+		t.Errorf("expected the openid scope to be refused, got %v", err)
+	}
+}
+
+// idTokenFlow runs the authorization code flow of the public test client on the service, with the openid scope.
+func idTokenFlow(svc *authn.Service) (authn.AccessToken, error) {
+	ctx := context.Background()
+	verifier := strings.Repeat("v", 43)
+	req := authn.AuthorizationRequest{
+		ClientID:            testutils.TestPublicClientID,
+		RedirectURI:         testutils.TestRedirectURI,
+		Scopes:              []string{authn.ScopeOpenID},
+		CodeChallenge:       authn.S256CodeChallenge(verifier),
+		CodeChallengeMethod: authn.CodeChallengeMethodS256,
+	}
+	code, err := svc.IssueAuthorizationCode(ctx, req, "user1", authn.AMRPassword)
+	if err != nil {
+		return authn.AccessToken{}, err
+	}
+	return svc.AuthorizationCodeToken(ctx, authn.AuthorizationCodeRequest{
+		ClientID:     testutils.TestPublicClientID,
+		Code:         code,
+		RedirectURI:  testutils.TestRedirectURI,
+		CodeVerifier: verifier,
+	})
+}
+
+func TestIDTokenIsNotAnAccessToken(t *testing.T) {
+	dir := t.TempDir()
+	testutils.WriteRSAKeyPair(t, dir, "rsa")
+	svc := keyDirService("rsa", dir, "rsa")
+	token, err := idTokenFlow(svc)
+	if err != nil || token.IDToken == "" {
+		t.Fatalf("expected an ID token, got %+v, err %v", token, err)
+	}
+	// The audience of the ID token is the relying party
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token.IDToken, claims); err != nil || claims["aud"] != testutils.TestPublicClientID {
+		t.Errorf("unexpected ID token claims %v, err %v", claims, err)
+	}
+	if _, err := svc.ValidateToken(token.IDToken); err == nil {
+		t.Error("expected an ID token to be rejected as an access token")
+	}
+	sign := func(jwt.MapClaims) (string, error) { return "signed", nil }
+	if _, err := authn.GenerateIDToken(sign, authn.DefaultTokenSettings(), authn.IDTokenRequest{Subject: "user1"}); err == nil {
+		t.Error("expected an error for a missing audience")
+	}
+}
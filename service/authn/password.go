@@ -0,0 +1,145 @@
+package authn
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"user-service/errorx"
+
+	"golang.org/x/crypto/argon2"
+)
+
+/*
+Note about the password hashes:
+
+Passwords are hashed with argon2id, which is memory-hard, so that a leaked datastore is expensive to brute force even on GPUs.
+The hashes are stored in the PHC string format, e.g.
+
+	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+
+which keeps the parameters next to each hash, so that the parameters can be raised later without invalidating the existing hashes.
+The parameters below are the minimum recommended by OWASP.
+*/
+const (
+	argon2Memory  = 19 * 1024 // KiB
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// PasswordRepository persists the password hashes of the users, keyed by the user id.
+// GetPasswordHash returns an errorx.Error with errorx.NotFound code if the user has no password.
+type PasswordRepository interface {
+	GetPasswordHash(ctx context.Context, userId string) (string, error)
+	SetPasswordHash(ctx context.Context, userId string, hash string) error
+	DeletePasswordHash(ctx context.Context, userId string) error
+}
+
+// HashPassword returns the argon2id hash of the password, in the PHC string format.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks the password against a hash returned by HashPassword.
+func VerifyPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errors.New("unsupported password hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported argon2 version")
+	}
+	var (
+		memory, time uint32
+		threads      uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errors.New("invalid argon2 parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// verifyDummyPassword spends the same time as a real password check, so that the response time does not reveal
+// whether a user exists or has a password.
+func verifyDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = HashPassword("dummy-password")
+	})
+	VerifyPassword(dummyHash, password)
+}
+
+// AuthenticateUser checks the password of the user.
+// Unknown users, users without a password and wrong passwords all result in an errorx.InvalidCredentials error.
+func AuthenticateUser(ctx context.Context, repo PasswordRepository, userId, password string) error {
+	if userId == "" || password == "" {
+		return errorx.Error{Code: errorx.InvalidCredentials}
+	}
+	hash, err := repo.GetPasswordHash(ctx, userId)
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			log.Println("DEBUG: no password found for the user")
+			verifyDummyPassword(password)
+			return errorx.Error{Code: errorx.InvalidCredentials}
+		}
+		return err
+	}
+	ok, err := VerifyPassword(hash, password)
+	if err != nil {
+		log.Println("ERROR: error verifying password", err)
+		return err
+	}
+	if !ok {
+		log.Println("DEBUG: invalid password")
+		return errorx.Error{Code: errorx.InvalidCredentials}
+	}
+	return nil
+}
+
+// SetPassword checks the password against the policy, and stores its hash.
+// The refresh tokens of the user are revoked, as the password may be set because the previous one leaked.
+func SetPassword(ctx context.Context, repo interface {
+	PasswordRepository
+	RefreshTokenRepository
+}, policy *PasswordPolicy, userId, password string) error {
+	if err := policy.Check(userId, password); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		log.Println("ERROR: error hashing password", err)
+		return err
+	}
+	if err := repo.SetPasswordHash(ctx, userId, hash); err != nil {
+		return err
+	}
+	return repo.RevokeUserRefreshTokens(ctx, userId)
+}
@@ -0,0 +1,65 @@
+package authn
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+	"user-service/errorx"
+)
+
+// Upper limit on the length of a password, which bounds the cost of hashing it.
+const maxPasswordLength = 128
+
+// PasswordPolicy is checked whenever a password is set. In line with the NIST guidelines, it does not require any composition
+// of character classes, but a minimum length, and that the password is not a known breached or common password.
+type PasswordPolicy struct {
+	MinLength int
+	// The known breached passwords, in lower case
+	breached map[string]struct{}
+}
+
+// LoadPasswordPolicy reads the breach list from a local file, holding one password per line.
+// An empty path disables the breach list check.
+func LoadPasswordPolicy(minLength int, breachListPath string) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{MinLength: minLength, breached: map[string]struct{}{}}
+	if breachListPath == "" {
+		return policy, nil
+	}
+	f, err := os.Open(breachListPath)
+	if err != nil {
+		log.Println("ERROR: error opening password breach list", err)
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			policy.breached[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("ERROR: error reading password breach list", err)
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Check returns an errorx.Error with errorx.BadRequestData code, and the reason in the message, if the password violates the policy.
+func (p *PasswordPolicy) Check(userId, password string) error {
+	n := utf8.RuneCountInString(password)
+	if n < p.MinLength {
+		return errorx.Error{Code: errorx.BadRequestData, Message: "Password is too short"}
+	}
+	if n > maxPasswordLength {
+		return errorx.Error{Code: errorx.BadRequestData, Message: "Password is too long"}
+	}
+	if strings.EqualFold(password, userId) {
+		return errorx.Error{Code: errorx.BadRequestData, Message: "Password can not be the user id"}
+	}
+	if _, ok := p.breached[strings.ToLower(password)]; ok {
+		return errorx.Error{Code: errorx.BadRequestData, Message: "Password is known to be breached"}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package authn_test
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+	"user-service/authn"
+	"user-service/testutils"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := authn.HashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("unexpected hash format %q", hash)
+	}
+	if other, _ := authn.HashPassword("correct horse battery staple"); other == hash {
+		t.Error("expected a random salt for every hash")
+	}
+	if ok, err := authn.VerifyPassword(hash, "correct horse battery staple"); err != nil || !ok {
+		t.Errorf("expected the password to match, got %v, err %v", ok, err)
+	}
+	if ok, err := authn.VerifyPassword(hash, "correct horse battery stapler"); err != nil || ok {
+		t.Errorf("expected the password not to match, got %v, err %v", ok, err)
+	}
+	// The parameters are read from the hash, so the hashes of weaker parameters can still be verified
+	salt := []byte("saltsaltsaltsalt")
+	key := argon2.IDKey([]byte("password"), salt, 1, 8, 1, 32)
+	weak := "$argon2id$v=19$m=8,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+	if ok, err := authn.VerifyPassword(weak, "password"); err != nil || !ok {
+		t.Errorf("expected the password to match, got %v, err %v", ok, err)
+	}
+	if _, err := authn.VerifyPassword("$2a$10$bcrypt", "password"); err == nil {
+		t.Error("expected an error for an unsupported hash")
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	testutils.WriteFile(t, path, []byte("password123456\n\n  Qwertyuiop123 \n"))
+	policy, err := authn.LoadPasswordPolicy(12, path)
+	if err != nil {
+		t.Fatalf("error loading policy: %v", err)
+	}
+
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"a-long-enough-password", true},
+		{"short", false},
+		{"ünïcödé-pässwörd", true},
+		{strings.Repeat("a", 129), false},
+		{"password123456", false},
+		{"QWERTYUIOP123", false},
+		{"the-user-id-1", false},
+	}
+	for _, tt := range tests {
+		err := policy.Check("the-user-id-1", tt.password)
+		if (err == nil) != tt.ok {
+			t.Errorf("unexpected result for %q: %v", tt.password, err)
+		}
+	}
+
+	if _, err := authn.LoadPasswordPolicy(12, filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("expected an error for a missing breach list")
+	}
+}
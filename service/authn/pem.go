@@ -0,0 +1,81 @@
+package authn
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log"
+	"os"
+)
+
+const (
+	// Hardcoded file names of the original single key pair. See keyset.go for the naming of multiple key pairs.
+	privateKeyFile = "private.pem"
+	publicKeyFile  = "public.pem"
+)
+
+// ReadPrivatekey reads an RSA, ECDSA (P-256 or P-384) or Ed25519 private key.
+// The key is expected in a PKCS #8 "PRIVATE KEY" block, or in a SEC 1 "EC PRIVATE KEY" block for ECDSA keys,
+// which is what openssl ecparam generates.
+func ReadPrivatekey(filePath string) (crypto.Signer, error) {
+	keyBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		log.Println("ERROR: error reading private key file", err)
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyBytes)
+	if keyBlock == nil {
+		log.Println("ERROR: error decoding private key block")
+		return nil, errors.New("error decoding private key block")
+	}
+	var pKey any
+	switch keyBlock.Type {
+	case "PRIVATE KEY":
+		pKey, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	case "EC PRIVATE KEY":
+		pKey, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	default:
+		log.Println("ERROR: error decoding private key block")
+		return nil, errors.New("error decoding private key block")
+	}
+	if err != nil {
+		log.Println("ERROR: error parsing private key", err)
+		return nil, err
+	}
+	signer, ok := pKey.(crypto.Signer)
+	if !ok {
+		log.Println("ERROR: invalid key type found")
+		return nil, errors.New("invalid key type found")
+	}
+	// Rules out the key types and curves that can not be used to sign tokens, e.g. ECDH keys or a P-521 curve
+	if _, err := signingMethodForKey(signer.Public()); err != nil {
+		log.Println("ERROR: invalid key type found", err)
+		return nil, err
+	}
+	return signer, nil
+}
+
+// ReadPublickey reads an RSA, ECDSA (P-256 or P-384) or Ed25519 public key from a PKIX "PUBLIC KEY" block.
+func ReadPublickey(filePath string) (crypto.PublicKey, error) {
+	keyBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		log.Println("ERROR: error reading public key file", err)
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyBytes)
+	if keyBlock == nil || keyBlock.Type != "PUBLIC KEY" {
+		log.Println("ERROR: error decoding public key block")
+		return nil, errors.New("error decoding public key block")
+	}
+	pKey, err := x509.ParsePKIXPublicKey(keyBlock.Bytes)
+	if err != nil {
+		log.Println("ERROR: error parsing public key", err)
+		return nil, err
+	}
+	if _, err := signingMethodForKey(pKey); err != nil {
+		log.Println("ERROR: invalid key type found", err)
+		return nil, err
+	}
+	return pKey, nil
+}
@@ -0,0 +1,151 @@
+package authn
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+	"user-service/errorx"
+	"user-service/timesource"
+)
+
+/*
+Note about refresh tokens:
+
+A refresh token is an opaque random string. Only its SHA-256 hash is stored, so a leaked datastore does not leak usable tokens.
+Every refresh rotates the token - the presented token is marked as used and a new one is issued in its place.
+All the tokens that descend from the same login share a FamilyID.
+
+If an already used token is presented again, either the legit client or an attacker holds a stolen copy.
+We can not tell which, so the whole family is revoked, and the user has to authenticate again.
+*/
+
+// RefreshToken is the server-side state of an issued refresh token.
+type RefreshToken struct {
+	Hash      string
+	FamilyID  string
+	UserID    string
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+	AMR       []string // The methods the user authenticated with on the login that started the family
+}
+
+// RefreshTokenRepository persists the refresh tokens.
+// UseRefreshToken atomically marks a token as used and returns its state from before the call,
+// so that two concurrent refreshes with the same token can not both succeed.
+// GetRefreshToken and UseRefreshToken return an errorx.Error with errorx.NotFound code if the token does not exist.
+// RevokeUserRefreshTokens revokes all the tokens of the user, or with amr values, only the ones whose amr includes all of them.
+type RefreshTokenRepository interface {
+	CreateRefreshToken(ctx context.Context, rt RefreshToken) error
+	GetRefreshToken(ctx context.Context, hash string) (RefreshToken, error)
+	UseRefreshToken(ctx context.Context, hash string) (RefreshToken, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userId string, amr ...string) error
+}
+
+// SubjectRepository tells whether the user that the tokens are issued to still exists.
+type SubjectRepository interface {
+	UserExists(ctx context.Context, userId string) (bool, error)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueRefreshToken creates a new refresh token for the user, valid for the ttl.
+// An empty familyID starts a new token family. The amr values are kept along with the token, for the access tokens it is exchanged for.
+// The refresh tokens are long-lived compared to the access tokens, as they are only ever sent to the token refresh endpoint.
+func IssueRefreshToken(ctx context.Context, repo RefreshTokenRepository, ttl time.Duration, userId, familyID string, amr []string) (string, error) {
+	if userId == "" {
+		return "", errors.New("missing id")
+	}
+	token, err := randomString(32)
+	if err != nil {
+		log.Println("ERROR: error generating refresh token", err)
+		return "", err
+	}
+	if familyID == "" {
+		if familyID, err = randomString(16); err != nil {
+			log.Println("ERROR: error generating refresh token family", err)
+			return "", err
+		}
+	}
+	rt := RefreshToken{
+		Hash:      hashRefreshToken(token),
+		FamilyID:  familyID,
+		UserID:    userId,
+		ExpiresAt: timesource.CurrentTime().Add(ttl),
+		AMR:       amr,
+	}
+	if err := repo.CreateRefreshToken(ctx, rt); err != nil {
+		log.Println("ERROR: error storing refresh token", err)
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateRefreshToken consumes the supplied refresh token and issues its replacement within the same family, valid for the ttl.
+// It returns the state of the consumed token, which identifies the user, along with the new refresh token.
+// The tokens of a user that no longer exists are revoked rather than rotated.
+func RotateRefreshToken(ctx context.Context, repo interface {
+	RefreshTokenRepository
+	SubjectRepository
+}, ttl time.Duration, token string) (RefreshToken, string, error) {
+	if token == "" {
+		return RefreshToken{}, "", errorx.Error{Code: errorx.InvalidToken}
+	}
+	rt, err := repo.UseRefreshToken(ctx, hashRefreshToken(token))
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			log.Println("DEBUG: refresh token not found")
+			return RefreshToken{}, "", errorx.Error{Code: errorx.InvalidToken}
+		}
+		return RefreshToken{}, "", err
+	}
+	if rt.Revoked {
+		log.Println("DEBUG: refresh token revoked")
+		return RefreshToken{}, "", errorx.Error{Code: errorx.InvalidToken}
+	}
+	if rt.Used {
+		log.Println("WARN: refresh token reused, revoking the token family", rt.FamilyID)
+		if err := repo.RevokeRefreshTokenFamily(ctx, rt.FamilyID); err != nil {
+			return RefreshToken{}, "", err
+		}
+		return RefreshToken{}, "", errorx.Error{Code: errorx.InvalidToken}
+	}
+	if !timesource.CurrentTime().Before(rt.ExpiresAt) {
+		log.Println("DEBUG: refresh token expired")
+		return RefreshToken{}, "", errorx.Error{Code: errorx.InvalidToken}
+	}
+	exists, err := repo.UserExists(ctx, rt.UserID)
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+	if !exists {
+		log.Println("DEBUG: refresh token of a deleted user, revoking the user's refresh tokens")
+		if err := repo.RevokeUserRefreshTokens(ctx, rt.UserID); err != nil {
+			return RefreshToken{}, "", err
+		}
+		return RefreshToken{}, "", errorx.Error{Code: errorx.InvalidToken}
+	}
+	newToken, err := IssueRefreshToken(ctx, repo, ttl, rt.UserID, rt.FamilyID, rt.AMR)
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+	return rt, newToken, nil
+}
@@ -0,0 +1,85 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+	"user-service/errorx"
+)
+
+// RevokedTokenRepository persists the deny list of revoked access tokens, keyed by their jti.
+// An entry only needs to be kept until the token expires on its own, so expired entries may be pruned by the implementation.
+type RevokedTokenRepository interface {
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// Store groups the repositories that the authn package works with.
+type Store interface {
+	RefreshTokenRepository
+	SubjectRepository
+	RevokedTokenRepository
+	ClientRepository
+	PasswordRepository
+	LoginAttemptRepository
+	MFARepository
+	MFAChallengeRepository
+	AuthorizationCodeRepository
+}
+
+// Token type hints, as defined by RFC 7009
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// RevokeRefreshToken revokes the whole family of the supplied refresh token.
+// Unknown tokens are ignored, as RFC 7009 treats them the same as successfully revoked tokens.
+func RevokeRefreshToken(ctx context.Context, repo RefreshTokenRepository, token string) (bool, error) {
+	rt, err := repo.GetRefreshToken(ctx, hashRefreshToken(token))
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := repo.RevokeRefreshTokenFamily(ctx, rt.FamilyID); err != nil {
+		log.Println("ERROR: error revoking refresh token family", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// RevokeToken revokes either an access token or a refresh token, in the manner of RFC 7009.
+// The hint only decides which kind of token is looked up first.
+// Invalid or unknown tokens are not an error, since there is nothing left to revoke for them.
+func RevokeToken(ctx context.Context, validate func(token string) (Claims, error), db Store, token, hint string) error {
+	revokeAccessToken := func() (bool, error) {
+		claims, err := validate(token)
+		if err != nil {
+			return false, nil
+		}
+		if err := db.RevokeToken(ctx, claims.ID, claims.ExpiresAt); err != nil {
+			log.Println("ERROR: error revoking access token", err)
+			return false, err
+		}
+		return true, nil
+	}
+	revokeRefreshToken := func() (bool, error) {
+		return RevokeRefreshToken(ctx, db, token)
+	}
+
+	order := []func() (bool, error){revokeAccessToken, revokeRefreshToken}
+	if hint == TokenTypeHintRefreshToken {
+		order = []func() (bool, error){revokeRefreshToken, revokeAccessToken}
+	}
+	for _, revoke := range order {
+		done, err := revoke()
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package authn
+
+import (
+	"log"
+	"net/url"
+	"slices"
+	"time"
+	"user-service/config"
+	"user-service/timesource"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenSettings are the configurable properties of the issued tokens, and of their validation.
+type TokenSettings struct {
+	Issuer string
+	// The audiences that the validation accepts, i.e. the names this service is known by.
+	// The tokens issued on a login carry the first one.
+	Audiences       []string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	Leeway          time.Duration // The clock skew tolerated on the exp, iat and nbf claims of the validated tokens
+}
+
+// NewTokenSettings takes the token settings from the config, which has been validated on load.
+func NewTokenSettings(cfg *config.Config) TokenSettings {
+	return TokenSettings{
+		Issuer:          cfg.Issuer,
+		Audiences:       slices.Clone(cfg.Audiences),
+		AccessTokenTTL:  cfg.AccessTokenTTL,
+		RefreshTokenTTL: cfg.RefreshTokenTTL,
+		Leeway:          cfg.TokenLeeway,
+	}
+}
+
+// DefaultTokenSettings returns the settings of the default config.
+func DefaultTokenSettings() TokenSettings {
+	return TokenSettings{
+		Issuer:          config.DefaultIssuer,
+		Audiences:       []string{config.DefaultAudience},
+		AccessTokenTTL:  config.DefaultAccessTokenTTL,
+		RefreshTokenTTL: config.DefaultRefreshTokenTTL,
+		Leeway:          config.DefaultTokenLeeway,
+	}
+}
+
+// loginAudience is the audience of the tokens issued on a login, which are meant for this service.
+func (t TokenSettings) loginAudience() []string {
+	if len(t.Audiences) == 0 {
+		return nil
+	}
+	return t.Audiences[:1]
+}
+
+// IssuerName is the host of the issuer URL, e.g. for the label of a TOTP enrollment, whose format does not allow for a URL.
+func (t TokenSettings) IssuerName() string {
+	if u, err := url.Parse(t.Issuer); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return t.Issuer
+}
+
+// parserOptions are the options of the jwt parser that validate the registered claims of an access token, except the audience.
+func (t TokenSettings) parserOptions(algs []string) []jwt.ParserOption {
+	return []jwt.ParserOption{
+		jwt.WithValidMethods(algs),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(t.Issuer),
+		jwt.WithLeeway(t.Leeway),
+		jwt.WithTimeFunc(func() time.Time { return timesource.CurrentTime() }),
+	}
+}
+
+// acceptsAudience checks that the token is meant for this service. The jwt parser only checks for a single audience,
+// while a token is accepted if any of its audiences is one of the configured ones.
+func (t TokenSettings) acceptsAudience(token *jwt.Token) bool {
+	aud, err := token.Claims.GetAudience()
+	if err != nil {
+		log.Println("DEBUG: invalid aud in token claims")
+		return false
+	}
+	for _, a := range aud {
+		if slices.Contains(t.Audiences, a) {
+			return true
+		}
+	}
+	log.Println("DEBUG: token audience not accepted", aud)
+	return false
+}
@@ -0,0 +1,12 @@
+package authn
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The ECDSA signing method uses ES256 with P-256 keys, and ES384 with P-384 keys.
+var ecdsaSigningMethods = []string{jwt.SigningMethodES256.Alg(), jwt.SigningMethodES384.Alg()}
+
+func ValidateECDSASignedToken(keySet *KeySet, token string, settings TokenSettings) (Claims, error) {
+	return validateKeySetSignedToken(keySet, ecdsaSigningMethods, token, settings)
+}
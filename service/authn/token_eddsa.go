@@ -0,0 +1,12 @@
+package authn
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The EdDSA signing method only supports Ed25519 keys.
+var eddsaSigningMethods = []string{jwt.SigningMethodEdDSA.Alg()}
+
+func ValidateEdDSASignedToken(keySet *KeySet, token string, settings TokenSettings) (Claims, error) {
+	return validateKeySetSignedToken(keySet, eddsaSigningMethods, token, settings)
+}
@@ -3,37 +3,35 @@ package authn
 import (
 	"errors"
 	"log"
-	"time"
 	"user-service/errorx"
-	"user-service/timesource"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 /*
 GenerateHMACSignedToken generates a jwt token, using HMAC signing mechanism.
-The token is valid for 30 min for the purpose of this sample service to offer enough duration for easy testing.
+The token is valid for the configured access-token-ttl, 30 min by default to offer enough duration for easy testing.
 However, in production, it is advisable to have lower validity period, such as 10 mins.
+The optional amr values are the methods the user authenticated with.
 */
-func GenerateHMACSignedToken(id, issuer, secret string) (string, error) {
-	if id == "" || issuer == "" || secret == "" {
+func GenerateHMACSignedToken(id string, settings TokenSettings, secret string, amr ...string) (string, error) {
+	if id == "" || settings.Issuer == "" || secret == "" {
 		return "", errors.New("missing id, issuer, or secret")
 	}
-	// The user claims just contains an id.
-	// Therefore, there is no need to encrypt the claims.
-	userClaims := ClientClaims{
-		UserID: id,
+	claims, err := newUserAccessTokenClaims(settings, id, settings.loginAudience(), loginScopes)
+	if err != nil {
+		return "", err
 	}
+	setAMR(claims, amr)
+	return SignHMACToken(claims, secret)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub":        id,
-		"aud":        clientId,
-		"iss":        issuer,
-		"iat":        timesource.CurrentTime().Unix(),
-		"exp":        timesource.CurrentTime().Add(time.Minute * 30).Unix(),
-		"userClaims": userClaims,
-	}, nil)
-
+// SignHMACToken signs the supplied claims, using HMAC signing mechanism.
+func SignHMACToken(claims jwt.MapClaims, secret string) (string, error) {
+	if secret == "" {
+		return "", errors.New("missing secret")
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims, nil)
 	signedToken, err := token.SignedString([]byte(secret))
 	if err != nil {
 		log.Println("ERROR: error during signing", err)
@@ -43,9 +41,17 @@ func GenerateHMACSignedToken(id, issuer, secret string) (string, error) {
 	return signedToken, nil
 }
 
-func ValidateHMACSignedToken(token, issuer, secret string) (string, error) {
-	if token == "" || issuer == "" || secret == "" {
-		return "", errors.New("missing token, issuer, or secret")
+// ValidateHMACSignedToken validates a token signed with any of the secrets, i.e. the current one or one of the previous ones.
+func ValidateHMACSignedToken(token string, settings TokenSettings, secrets []string) (Claims, error) {
+	if token == "" || settings.Issuer == "" || len(secrets) == 0 {
+		return Claims{}, errors.New("missing token, issuer, or secret")
+	}
+	keys := jwt.VerificationKeySet{}
+	for _, secret := range secrets {
+		if secret == "" {
+			return Claims{}, errors.New("missing secret")
+		}
+		keys.Keys = append(keys.Keys, []byte(secret))
 	}
 	t, err := jwt.Parse(
 		token,
@@ -55,40 +61,19 @@ func ValidateHMACSignedToken(token, issuer, secret string) (string, error) {
 				log.Println("DEBUG: invalid signing method")
 				return nil, errorx.Error{Code: errorx.InvalidToken}
 			}
-			return []byte(secret), nil
+			return keys, nil
 		},
-		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
-		jwt.WithIssuedAt(),
-		jwt.WithExpirationRequired(),
-		jwt.WithAudience(clientId),
-		jwt.WithIssuer(issuer),
-		jwt.WithTimeFunc(func() time.Time { return timesource.CurrentTime() }),
+		settings.parserOptions([]string{jwt.SigningMethodHS256.Alg()})...,
 	)
 
 	if err != nil {
 		log.Println("DEBUG: error during token parsing and validation", err)
-		return "", errorx.Error{Code: errorx.InvalidToken}
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
 	}
-	if !t.Valid {
+	if !t.Valid || !settings.acceptsAudience(t) {
 		log.Println("DEBUG: token not valid")
-		return "", errorx.Error{Code: errorx.InvalidToken}
-	}
-
-	claims, ok := t.Claims.(jwt.MapClaims)
-	if !ok {
-		log.Println("DEBUG: invalid claims")
-		return "", errorx.Error{Code: errorx.InvalidToken}
-	}
-
-	id, ok := claims["userClaims"].(map[string]interface{})["user_id"].(string)
-	if !ok {
-		log.Println("DEBUG: invalid user_id in claims")
-		return "", errorx.Error{Code: errorx.InvalidToken}
-	}
-	if claims["sub"] != id {
-		log.Println("DEBUG: invalid sub in token claims")
-		return "", errorx.Error{Code: errorx.InvalidToken}
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
 	}
 
-	return id, nil
+	return claimsFromToken(t)
 }
@@ -0,0 +1,115 @@
+package authn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"user-service/errorx"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/*
+Note about the asymmetric signing methods:
+
+The rsa, ecdsa and eddsa signing methods all sign with the active key of the key set, and only differ in the type of key they accept.
+The jwt algorithm is derived from the key itself, and never from the token header alone. A token is only accepted if its alg header
+matches the algorithm of the key selected by its kid, which rules out any algorithm confusion between the keys of the set.
+*/
+
+// signingMethodForKey returns the jwt signing method to use with the public key.
+func signingMethodForKey(pub crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		}
+		return nil, errors.New("unsupported elliptic curve")
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+// signWithKeySet signs the supplied claims with the active key, which must be usable with one of the allowed algorithms.
+func signWithKeySet(keySet *KeySet, algs []string, claims jwt.MapClaims) (string, error) {
+	key, method, err := activeSigningKey(keySet, algs)
+	if err != nil {
+		log.Println("ERROR: error selecting the signing key", err)
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(method, claims, nil)
+	// The kid header lets the validating party pick the right key out of the key set
+	token.Header["kid"] = key.ID
+	signedToken, err := token.SignedString(key.PrivateKey)
+	if err != nil {
+		log.Println("ERROR: error during signing", err)
+		return "", err
+	}
+
+	return signedToken, nil
+}
+
+// activeSigningKey returns the active key of the set, and the jwt algorithm it signs with, which must be one of algs.
+func activeSigningKey(keySet *KeySet, algs []string) (Key, jwt.SigningMethod, error) {
+	key, err := keySet.SigningKey()
+	if err != nil {
+		return Key{}, nil, err
+	}
+	method, err := signingMethodForKey(key.PublicKey)
+	if err != nil {
+		return Key{}, nil, err
+	}
+	if !slices.Contains(algs, method.Alg()) {
+		return Key{}, nil, fmt.Errorf("the active signing key %q (%s) does not match the signing method", key.ID, method.Alg())
+	}
+	return key, method, nil
+}
+
+// validateKeySetSignedToken validates a token signed with one of the allowed algorithms, by the key named in its kid header.
+func validateKeySetSignedToken(keySet *KeySet, algs []string, token string, settings TokenSettings) (Claims, error) {
+	if token == "" || settings.Issuer == "" {
+		return Claims{}, errors.New("missing token or issuer")
+	}
+	t, err := jwt.Parse(
+		token,
+		func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			key, err := keySet.VerificationKey(kid)
+			if err != nil {
+				log.Println("DEBUG: no verification key found", err)
+				return nil, errorx.Error{Code: errorx.InvalidToken}
+			}
+			method, err := signingMethodForKey(key.PublicKey)
+			if err != nil || method.Alg() != token.Method.Alg() {
+				log.Println("DEBUG: invalid signing method")
+				return nil, errorx.Error{Code: errorx.InvalidToken}
+			}
+			return key.PublicKey, nil
+		},
+		settings.parserOptions(algs)...,
+	)
+
+	if err != nil {
+		log.Println("DEBUG: error during token parsing and validation", err)
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+	if !t.Valid || !settings.acceptsAudience(t) {
+		log.Println("DEBUG: token not valid")
+		return Claims{}, errorx.Error{Code: errorx.InvalidToken}
+	}
+
+	return claimsFromToken(t)
+}
@@ -0,0 +1,258 @@
+package authn_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"user-service/authn"
+	"user-service/config"
+	"user-service/testutils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenHeader decodes the header of the token, without validating it.
+func tokenHeader(t *testing.T, token string) map[string]string {
+	t.Helper()
+	raw, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatalf("error decoding token header: %v", err)
+	}
+	header := map[string]string{}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		t.Fatalf("error decoding token header: %v", err)
+	}
+	return header
+}
+
+func TestSigningMethods(t *testing.T) {
+	tests := []struct {
+		method   string
+		writeKey func(t *testing.T, dir string)
+		alg      string
+		jwk      authn.JWK
+	}{
+		{"rsa", func(t *testing.T, dir string) { testutils.WriteRSAKeyPair(t, dir, "k1") }, "RS256", authn.JWK{Kty: "RSA"}},
+		{"ecdsa", func(t *testing.T, dir string) { testutils.WriteECDSAKeyPair(t, dir, "k1", elliptic.P256()) }, "ES256", authn.JWK{Kty: "EC", Crv: "P-256"}},
+		{"ecdsa", func(t *testing.T, dir string) { testutils.WriteECDSAKeyPair(t, dir, "k1", elliptic.P384()) }, "ES384", authn.JWK{Kty: "EC", Crv: "P-384"}},
+		{"eddsa", func(t *testing.T, dir string) { testutils.WriteEd25519KeyPair(t, dir, "k1") }, "EdDSA", authn.JWK{Kty: "OKP", Crv: "Ed25519"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.writeKey(t, dir)
+			svc := keyDirService(tt.method, dir, "k1")
+
+			token, err := svc.GenerateToken("client_user")
+			if err != nil {
+				t.Fatalf("error generating token: %v", err)
+			}
+			header := tokenHeader(t, token)
+			if header["alg"] != tt.alg || header["kid"] != "k1" {
+				t.Errorf("unexpected token header: %v", header)
+			}
+			claims, err := svc.ValidateToken(token)
+			if err != nil {
+				t.Fatalf("error validating token: %v", err)
+			}
+			if claims.UserID != "client_user" {
+				t.Errorf("expected user client_user, got %q", claims.UserID)
+			}
+
+			jwks, err := svc.JWKS()
+			if err != nil {
+				t.Fatalf("error building jwks: %v", err)
+			}
+			if len(jwks.Keys) != 1 {
+				t.Fatalf("expected one key, got %d", len(jwks.Keys))
+			}
+			jwk := jwks.Keys[0]
+			if jwk.Kty != tt.jwk.Kty || jwk.Crv != tt.jwk.Crv || jwk.Alg != tt.alg || jwk.Kid != "k1" {
+				t.Errorf("unexpected jwk: %+v", jwk)
+			}
+			if tt.jwk.Kty == "EC" && (jwk.X == "" || jwk.Y == "") || tt.jwk.Kty == "OKP" && jwk.X == "" {
+				t.Errorf("missing key coordinates: %+v", jwk)
+			}
+		})
+	}
+}
+
+func TestSigningMethodKeyMismatch(t *testing.T) {
+	dir := t.TempDir()
+	testutils.WriteRSAKeyPair(t, dir, "rsa")
+	testutils.WriteEd25519KeyPair(t, dir, "ed")
+
+	// The active key must match the signing method
+	if _, err := keyDirService("ecdsa", dir, "rsa").GenerateToken("client_user"); err == nil {
+		t.Error("expected an error signing with an RSA key under the ecdsa signing method")
+	}
+
+	// A token signed with a key of another type is rejected, even if its key is part of the key set
+	edToken, err := keyDirService("eddsa", dir, "ed").GenerateToken("client_user")
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	if _, err := keyDirService("rsa", dir, "rsa").ValidateToken(edToken); err == nil {
+		t.Error("expected an EdDSA token to be rejected under the rsa signing method")
+	}
+
+	// The alg header must match the key selected by the kid, so a token can not claim another key's algorithm
+	rsaToken, err := keyDirService("rsa", dir, "rsa").GenerateToken("client_user")
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	parts := strings.Split(rsaToken, ".")
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"ed","typ":"JWT"}`))
+	if _, err := keyDirService("rsa", dir, "rsa").ValidateToken(strings.Join(parts, ".")); err == nil {
+		t.Error("expected a token with a mismatching kid to be rejected")
+	}
+}
+
+func TestReadPrivatekeySEC1(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error encoding key: %v", err)
+	}
+	path := filepath.Join(dir, "k1.private.pem")
+	testutils.WriteFile(t, path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+
+	pKey, err := authn.ReadPrivatekey(path)
+	if err != nil {
+		t.Fatalf("error reading key: %v", err)
+	}
+	if !key.Equal(pKey) {
+		t.Error("expected the parsed key to match the generated key")
+	}
+
+	// P-521 keys are not supported by the ES256 and ES384 algorithms
+	key521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	testutils.WriteKeyPair(t, dir, "k2", key521)
+	if _, err := authn.ReadPrivatekey(filepath.Join(dir, "k2.private.pem")); err == nil {
+		t.Error("expected an error reading a P-521 key")
+	}
+}
+
+func TestTokenSettings(t *testing.T) {
+	const secret = "mysupersecret"
+	settings := authn.DefaultTokenSettings()
+	settings.Audiences = []string{"client1", "reports-service"}
+
+	signed := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("error signing token: %v", err)
+		}
+		return token
+	}
+	now := time.Now()
+	claims := func(aud any, exp time.Time) jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "user1", "jti": "jti1", "iss": settings.Issuer, "aud": aud, "iat": now.Add(-time.Hour).Unix(), "exp": exp.Unix(),
+			"userClaims": map[string]string{"user_id": "user1"},
+		}
+	}
+	valid := now.Add(time.Minute)
+
+	// A token is accepted if any of its audiences is one of the configured ones
+	if _, err := authn.ValidateHMACSignedToken(signed(claims([]string{"other", "reports-service"}, valid)), settings, []string{secret}); err != nil {
+		t.Errorf("expected a token for one of the audiences to be accepted: %v", err)
+	}
+	if _, err := authn.ValidateHMACSignedToken(signed(claims("other", valid)), settings, []string{secret}); err == nil {
+		t.Error("expected a token for another audience to be rejected")
+	}
+	// An ID token is never accepted as an access token, even with all the claims of one
+	idToken := claims("client1", valid)
+	idToken["typ"] = "ID"
+	if _, err := authn.ValidateHMACSignedToken(signed(idToken), settings, []string{secret}); err == nil {
+		t.Error("expected an ID token to be rejected")
+	}
+	other := settings
+	other.Issuer = "another-service"
+	if _, err := authn.ValidateHMACSignedToken(signed(claims("client1", valid)), other, []string{secret}); err == nil {
+		t.Error("expected a token from another issuer to be rejected")
+	}
+
+	// The leeway tolerates a token that has just expired
+	expired := signed(claims("client1", now.Add(-10*time.Second)))
+	if _, err := authn.ValidateHMACSignedToken(expired, settings, []string{secret}); err == nil {
+		t.Error("expected an expired token to be rejected without leeway")
+	}
+	lenient := settings
+	lenient.Leeway = 30 * time.Second
+	if _, err := authn.ValidateHMACSignedToken(expired, lenient, []string{secret}); err != nil {
+		t.Errorf("expected a token expired within the leeway to be accepted: %v", err)
+	}
+
+	// The tokens issued on a login carry the first audience, and the configured lifetime
+	short := settings
+	short.AccessTokenTTL = 5 * time.Minute
+	token, err := authn.GenerateHMACSignedToken("user1", short, secret)
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("error parsing token: %v", err)
+	}
+	aud, _ := parsed.Claims.GetAudience()
+	exp, _ := parsed.Claims.GetExpirationTime()
+	if len(aud) != 1 || aud[0] != "client1" {
+		t.Errorf("expected audience client1, got %v", aud)
+	}
+	if d := exp.Sub(time.Now()); d > 5*time.Minute || d < 4*time.Minute {
+		t.Errorf("expected the token to expire in 5m, got %s", d)
+	}
+}
+
+func TestHMACSecretRotation(t *testing.T) {
+	const previous, current = "previous-secret-5d1f0a7c3e9b2846", "current-secret-c47e92a1b0d35f68"
+	settings := authn.DefaultTokenSettings()
+	svc := authn.InitService(nil)
+	svc.Cfg = &config.Config{SigningMethod: "hmac"}
+	if _, err := svc.GenerateToken("user1"); err == nil {
+		t.Error("expected an error signing without a secret")
+	}
+
+	svc.Secrets = []string{previous}
+	oldToken, err := svc.GenerateToken("user1")
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+
+	// During the rotation, the tokens are signed with the current secret, and the ones signed with the previous secret are still accepted
+	svc.Secrets = []string{current, previous}
+	newToken, err := svc.GenerateToken("user1")
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := svc.ValidateToken(token); err != nil {
+			t.Errorf("expected the token to be accepted during the rotation: %v", err)
+		}
+	}
+	if _, err := authn.ValidateHMACSignedToken(newToken, settings, []string{previous}); err == nil {
+		t.Error("expected the token to be signed with the current secret")
+	}
+
+	// Once the previous secret is dropped, its tokens are rejected
+	svc.Secrets = []string{current}
+	if _, err := svc.ValidateToken(oldToken); err == nil {
+		t.Error("expected a token signed with a dropped secret to be rejected")
+	}
+}
@@ -2,9 +2,11 @@
 package authz
 
 import (
+	"context"
+	"errors"
 	"log"
+	"maps"
 	"slices"
-	"user-service/commons"
 	"user-service/errorx"
 )
 
@@ -12,6 +14,8 @@ type Role string
 type Resource string
 type Permission string
 type CondKey string
+
+// Conditions of a grant hold a plain value or a Condition per key, which the attributes of a request, held as Conditions too, have to meet.
 type Conditions map[CondKey]interface{}
 
 // AccessRights specifies a schema for RBAC policy.
@@ -33,71 +37,222 @@ It is also possible to keep both a rich policy schema as well as a simple RBAC s
 These two types of schema work together in deciding the final authorization for a user.
 
 For this sample user-service, we will continue with a relatively simple AccessRights data structure.
+A Role is defined by a Policy, which holds one AccessRights grant per Resource, so that a role such as admin can have rights on
+several resources at once.
 */
 
 // Some hardcoded states. Ideally, they should be kept in a datastore.
 const (
+	RoleUser   Role = "user" // May read and update the own user of the subject only
 	RoleViewer Role = "viewer"
+	RoleAdmin  Role = "admin"
 
 	ResourceUser Resource = "user"
 
-	PermissionRead Permission = "read"
+	PermissionRead   Permission = "read"
+	PermissionCreate Permission = "create"
+	PermissionUpdate Permission = "update"
+	PermissionDelete Permission = "delete"
 
 	CondKeyResourceID CondKey = "resource_id"
 
 	ResourceIDAny = "*"
 )
 
-type RbacInDB map[Role]AccessRights
+// Policy is the definition of a Role, with its grants keyed by the Resource they are on.
+// The Role and the Resource of each grant match the ones of the Policy and the key.
+// The Role inherits all the grants of its Parents, and of their parents in turn.
+type Policy struct {
+	Role    Role
+	Grants  map[Resource]AccessRights
+	Parents []Role
+}
+
+type RbacInDB map[Role]Policy
+
+// Match tells whether all of the requested permissions are required, or any one of them.
+type Match int
+
+const (
+	MatchAll Match = iota
+	MatchAny
+)
+
+// Clone returns a deep copy of the access-rights.
+// Note that the condition values are copied as is, which is fine as long as they are immutable values such as strings.
+func (ar AccessRights) Clone() AccessRights {
+	ar.Permissions = slices.Clone(ar.Permissions)
+	ar.Conditions = maps.Clone(ar.Conditions)
+	return ar
+}
+
+// Clone returns a deep copy of the policy.
+func (p Policy) Clone() Policy {
+	grants := make(map[Resource]AccessRights, len(p.Grants))
+	for resource, ar := range p.Grants {
+		grants[resource] = ar.Clone()
+	}
+	p.Grants = grants
+	p.Parents = slices.Clone(p.Parents)
+	return p
+}
+
+// PolicyRepository persists the Policy of each Role.
+// GetPolicy returns an errorx.Error with errorx.NotFound code if there is neither a grant nor a parent for the role.
+// SetGrant adds the AccessRights to the policy of its Role, replacing the grant on the same Resource, if any.
+// SetRoleParents replaces the parents of the role. It does not check for cycles, which is left to the SetRoleParents function.
+type PolicyRepository interface {
+	GetPolicy(ctx context.Context, role Role) (Policy, error)
+	SetGrant(ctx context.Context, ar AccessRights) error
+	SetRoleParents(ctx context.Context, role Role, parents []Role) error
+}
 
 // Service implements Authorizer interface
 type Service struct {
-	store commons.Datastore
+	store PolicyRepository
+	cache *grantsCache
 }
 
 // Sample initialization
-func InitService(db commons.Datastore) *Service {
-	return &Service{store: db}
+func InitService(db PolicyRepository) *Service {
+	return &Service{store: db, cache: newGrantsCache()}
 }
 
-// IsRoleAuthorized checks if a Role has the requested Permission on a requested Resource under the requested Conditions.
-func IsRoleAuthorized(db commons.Datastore, role string, resource string, permission string, conditions interface{}) (bool, error) {
-	rbacInDB, ok := db.Get("rbac").(RbacInDB)
-	if !ok {
-		log.Println("DEBUG: rbac not found in store")
-		return false, errorx.Error{Code: errorx.AccessDenied}
+// IsRoleAuthorized checks if a Role has the requested Permission on a requested Resource under the requested Conditions,
+// either via its own grants or via the ones it inherits. The requested Conditions are the attributes of the request.
+func IsRoleAuthorized(ctx context.Context, db PolicyRepository, role string, resource string, permission string, conditions interface{}) (bool, error) {
+	return isRoleAuthorized(ctx, resolverOf(db), role, resource, permission, conditions)
+}
+
+// resolver returns the effective grants of a role, either by resolving them from the datastore, or from the cache.
+type resolver func(ctx context.Context, role Role) (EffectiveGrants, error)
+
+func resolverOf(db PolicyRepository) resolver {
+	return func(ctx context.Context, role Role) (EffectiveGrants, error) {
+		return ResolveGrants(ctx, db, role)
 	}
-	// get the access-rights (ar) of the supplied role
-	aRights, ok := rbacInDB[Role(role)]
-	if !ok {
-		log.Println("DEBUG: role not found")
-		return false, errorx.Error{Code: errorx.AccessDenied}
+}
+
+func isRoleAuthorized(ctx context.Context, resolve resolver, role string, resource string, permission string, conditions interface{}) (bool, error) {
+	// get the effective grants of the supplied role
+	grants, err := resolve(ctx, Role(role))
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			log.Println("DEBUG: role not found")
+			return false, errorx.Error{Code: errorx.AccessDenied}
+		}
+		log.Println("ERROR: error reading rbac policy", err)
+		return false, err
 	}
 	expectedConds, ok := conditions.(Conditions)
 	if !ok {
 		log.Println("DEBUG: malformed rbac conditions")
 		return false, errorx.Error{Code: errorx.AccessDenied}
 	}
-	// Ensure that the expected resource matches the one in the access-rights retrieved from db.
-	if aRights.Resource != Resource(resource) {
-		log.Println("DEBUG: rbac resource mismatch")
+	// Get the access-rights (ar) that the role has on the expected resource, if any.
+	// There may be several of them, from the role itself and from its ancestors, and any one of them may allow the request.
+	rights, ok := grants[Resource(resource)]
+	if !ok {
+		log.Println("DEBUG: no rbac grant on the resource")
 		return false, errorx.Error{Code: errorx.AccessDenied}
 	}
-	// Ensure that the expected permission is part of the permissions list retrieved from db.
-	if !slices.Contains(aRights.Permissions, Permission(permission)) {
-		log.Println("DEBUG: requested permission not allowed")
+	for _, aRights := range rights {
+		// Ensure that the expected permission is part of the permissions list retrieved from db.
+		if !slices.Contains(aRights.Permissions, Permission(permission)) {
+			continue
+		}
+		// Ensure that the expected conditions, i.e. the attributes of the request, meet the conditions of the access-rights retrieved from db.
+		if !aRights.Conditions.Match(expectedConds) {
+			continue
+		}
+		return true, nil
+	}
+	log.Println("DEBUG: requested permission not allowed under the rbac conditions")
+	return false, errorx.Error{Code: errorx.AccessDenied}
+}
+
+// AreRolesAuthorized checks if a set of roles has the requested permissions on a requested resource under the requested conditions.
+// A permission is granted if any of the roles grants it, so the order of the roles does not matter. With MatchAll, every one of
+// the permissions has to be granted, possibly by different roles, and with MatchAny, one of them is enough.
+func AreRolesAuthorized(ctx context.Context, db PolicyRepository, roles []string, resource string, permissions []string, match Match, conditions interface{}) (bool, error) {
+	return areRolesAuthorized(ctx, resolverOf(db), roles, resource, permissions, match, conditions)
+}
+
+func areRolesAuthorized(ctx context.Context, resolve resolver, roles []string, resource string, permissions []string, match Match, conditions interface{}) (bool, error) {
+	if len(roles) == 0 || len(permissions) == 0 {
+		log.Println("DEBUG: no roles or permissions to be matched")
 		return false, errorx.Error{Code: errorx.AccessDenied}
 	}
-	// Ensure that the expected conditions match the one in the access-rights retrieved from db.
-	// Since we know that we are dealing with just one condition key in this sample service, we will just check the match for that key.
-	if aRights.Conditions[CondKeyResourceID] != expectedConds[CondKeyResourceID] {
-		log.Println("DEBUG: rbac conditions mismatch")
+	for _, permission := range permissions {
+		granted, err := isPermissionGranted(ctx, resolve, roles, resource, permission, conditions)
+		if err != nil {
+			return false, err
+		}
+		if granted && match == MatchAny {
+			return true, nil
+		}
+		if !granted && match == MatchAll {
+			log.Println("DEBUG: requested permission not granted by any role", permission)
+			return false, errorx.Error{Code: errorx.AccessDenied}
+		}
+	}
+	if match == MatchAny {
+		log.Println("DEBUG: none of the requested permissions granted by any role")
 		return false, errorx.Error{Code: errorx.AccessDenied}
 	}
-
 	return true, nil
 }
 
-func (s *Service) IsAuthorized(role string, resource string, permission string, conditions interface{}) (bool, error) {
-	return IsRoleAuthorized(s.store, role, resource, permission, conditions)
+// isPermissionGranted checks the permission against each of the roles in turn, until one grants it.
+// A denial by a role is not an error here, as another role may still grant the permission.
+func isPermissionGranted(ctx context.Context, resolve resolver, roles []string, resource string, permission string, conditions interface{}) (bool, error) {
+	for _, role := range roles {
+		authorized, err := isRoleAuthorized(ctx, resolve, role, resource, permission, conditions)
+		if err != nil {
+			var e errorx.Error
+			if errors.As(err, &e) && e.Code == errorx.AccessDenied {
+				continue
+			}
+			return false, err
+		}
+		if authorized {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Service) IsAuthorized(ctx context.Context, role string, resource string, permission string, conditions interface{}) (bool, error) {
+	return isRoleAuthorized(ctx, s.effectiveGrants, role, resource, permission, conditions)
+}
+
+func (s *Service) AreRolesAuthorized(ctx context.Context, roles []string, resource string, permissions []string, match Match, conditions interface{}) (bool, error) {
+	return areRolesAuthorized(ctx, s.effectiveGrants, roles, resource, permissions, match, conditions)
+}
+
+// SetGrant adds a grant to the policy of its role. The cached effective grants are dropped, as the grant is inherited by other roles.
+func (s *Service) SetGrant(ctx context.Context, ar AccessRights) error {
+	defer s.cache.invalidate()
+	return s.store.SetGrant(ctx, ar)
+}
+
+// SetRoleParents replaces the parents of the role, unless it would result in a cycle. The cached effective grants are dropped.
+func (s *Service) SetRoleParents(ctx context.Context, role Role, parents []Role) error {
+	defer s.cache.invalidate()
+	return SetRoleParents(ctx, s.store, role, parents)
+}
+
+// effectiveGrants returns the cached effective grants of the role, resolving and caching them first if needed.
+func (s *Service) effectiveGrants(ctx context.Context, role Role) (EffectiveGrants, error) {
+	grants, generation, ok := s.cache.get(role)
+	if ok {
+		return grants, nil
+	}
+	grants, err := ResolveGrants(ctx, s.store, role)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.set(role, grants, generation)
+	return grants, nil
 }
@@ -0,0 +1,236 @@
+package authz
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+/*
+Note about the conditions:
+
+The Conditions of a grant constrain the attributes of a request, which the middleware passes in as Conditions as well, e.g. the id of
+the resource, the id of the subject and the time of the request. Each condition of a grant has to be met by the attribute of the same
+key, and a request that lacks the attribute does not meet it. The attributes that the grant has no condition on are not constrained.
+
+A condition is either a plain value, which the attribute has to be equal to, or a Condition with one of the operators below. The plain
+"*" value (ResourceIDAny) matches any value of the attribute. A string value of the form ${key} refers to another attribute of the request,
+e.g. {"resource_id": {"op": "eq", "value": "${subject.id}"}} grants the permission on the subject's own resource only.
+
+The numeric operators compare numbers, or times, as time.Time values or RFC 3339 strings. A condition with an unknown operator, or on
+values of mismatching types, is not met, so a malformed grant denies rather than allows.
+*/
+
+// Operator is the comparison of a Condition.
+type Operator string
+
+const (
+	OpEq     Operator = "eq"     // Equal to the value
+	OpIn     Operator = "in"     // Equal to one of the values of a list
+	OpGlob   Operator = "glob"   // Matches a pattern, as per path.Match, e.g. "team-*"
+	OpPrefix Operator = "prefix" // Starts with the value
+	OpGt     Operator = "gt"
+	OpGte    Operator = "gte"
+	OpLt     Operator = "lt"
+	OpLte    Operator = "lte"
+)
+
+// Attribute keys that the middleware puts into the request conditions, next to the ones of the route.
+const (
+	CondKeySubjectID   CondKey = "subject.id"
+	CondKeyRequestTime CondKey = "request.time"
+)
+
+// Condition compares an attribute of the request with its Value, via its Operator.
+type Condition struct {
+	Op    Operator    `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// UnmarshalJSON decodes the operator conditions back into a Condition, and keeps the plain values as they are.
+func (c *Conditions) UnmarshalJSON(b []byte) error {
+	var raw map[CondKey]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*c = nil
+		return nil
+	}
+	conds := make(Conditions, len(raw))
+	for key, v := range raw {
+		if trimmed := strings.TrimSpace(string(v)); strings.HasPrefix(trimmed, "{") {
+			var cond Condition
+			if err := json.Unmarshal(v, &cond); err != nil {
+				return err
+			}
+			conds[key] = cond
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(v, &value); err != nil {
+			return err
+		}
+		conds[key] = value
+	}
+	*c = conds
+	return nil
+}
+
+// Match checks if the attributes of a request meet all of the conditions.
+func (c Conditions) Match(attrs Conditions) bool {
+	for key, want := range c {
+		got, ok := attrs[key]
+		if !ok {
+			log.Println("DEBUG: missing attribute for rbac condition", key)
+			return false
+		}
+		cond, ok := want.(Condition)
+		if !ok {
+			cond = Condition{Op: OpEq, Value: want}
+		}
+		if !cond.match(got, attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Condition) match(got interface{}, attrs Conditions) bool {
+	want, ok := resolve(c.Value, attrs)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case OpEq:
+		return want == ResourceIDAny || equal(got, want)
+	case OpIn:
+		values, ok := want.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range values {
+			if v, ok := resolve(v, attrs); ok && equal(got, v) {
+				return true
+			}
+		}
+		return false
+	case OpGlob:
+		pattern, ok1 := want.(string)
+		s, ok2 := got.(string)
+		if !ok1 || !ok2 {
+			return false
+		}
+		matched, err := path.Match(pattern, s)
+		return err == nil && matched
+	case OpPrefix:
+		prefix, ok1 := want.(string)
+		s, ok2 := got.(string)
+		return ok1 && ok2 && strings.HasPrefix(s, prefix)
+	case OpGt, OpGte, OpLt, OpLte:
+		cmp, ok := compare(got, want)
+		if !ok {
+			return false
+		}
+		switch c.Op {
+		case OpGt:
+			return cmp > 0
+		case OpGte:
+			return cmp >= 0
+		case OpLt:
+			return cmp < 0
+		default:
+			return cmp <= 0
+		}
+	default:
+		log.Println("DEBUG: unknown rbac condition operator", c.Op)
+		return false
+	}
+}
+
+// resolve replaces a ${key} reference with the attribute of the request. A list is left as is, as its items are resolved one by one.
+func resolve(v interface{}, attrs Conditions) (interface{}, bool) {
+	if list, ok := v.([]string); ok {
+		values := make([]interface{}, len(list))
+		for i, s := range list {
+			values[i] = s
+		}
+		return values, true
+	}
+	s, ok := v.(string)
+	if !ok || !strings.HasPrefix(s, "${") || !strings.HasSuffix(s, "}") {
+		return v, true
+	}
+	value, ok := attrs[CondKey(s[2:len(s)-1])]
+	if !ok {
+		log.Println("DEBUG: unknown attribute referred by rbac condition", s)
+	}
+	return value, ok
+}
+
+func equal(a, b interface{}) bool {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		return ok && x == y
+	}
+	if x, ok := a.(string); ok {
+		y, ok := b.(string)
+		return ok && x == y
+	}
+	if x, ok := a.(bool); ok {
+		y, ok := b.(bool)
+		return ok && x == y
+	}
+	return false
+}
+
+// compare compares two numbers, or two times, and fails for any other values.
+func compare(a, b interface{}) (int, bool) {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	x, ok1 := toTime(a)
+	y, ok2 := toTime(b)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return x.Compare(y), true
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case string:
+		parsed, err := time.Parse(time.RFC3339, t)
+		return parsed, err == nil
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,73 @@
+package authz_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+	"user-service/authz"
+)
+
+func TestConditionsMatch(t *testing.T) {
+	now := time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC)
+	attrs := authz.Conditions{
+		authz.CondKeyResourceID:  "user1",
+		authz.CondKeySubjectID:   "user1",
+		authz.CondKeyRequestTime: now,
+		"team":                   "team-blue",
+		"level":                  3,
+	}
+	tests := []struct {
+		name  string
+		conds authz.Conditions
+		want  bool
+	}{
+		{"no conditions", nil, true},
+		{"plain value", authz.Conditions{authz.CondKeyResourceID: "user1"}, true},
+		{"plain value mismatch", authz.Conditions{authz.CondKeyResourceID: "user2"}, false},
+		{"any resource", authz.Conditions{authz.CondKeyResourceID: authz.ResourceIDAny}, true},
+		{"missing attribute", authz.Conditions{"region": "eu"}, false},
+		{"self", authz.Conditions{authz.CondKeyResourceID: authz.Condition{Op: authz.OpEq, Value: "${subject.id}"}}, true},
+		{"unknown reference", authz.Conditions{authz.CondKeyResourceID: authz.Condition{Op: authz.OpEq, Value: "${subject.team}"}}, false},
+		{"in", authz.Conditions{"team": authz.Condition{Op: authz.OpIn, Value: []string{"team-red", "team-blue"}}}, true},
+		{"not in", authz.Conditions{"team": authz.Condition{Op: authz.OpIn, Value: []string{"team-red"}}}, false},
+		{"in with reference", authz.Conditions{authz.CondKeyResourceID: authz.Condition{Op: authz.OpIn, Value: []string{"admin", "${subject.id}"}}}, true},
+		{"glob", authz.Conditions{"team": authz.Condition{Op: authz.OpGlob, Value: "team-*"}}, true},
+		{"glob mismatch", authz.Conditions{"team": authz.Condition{Op: authz.OpGlob, Value: "group-?"}}, false},
+		{"prefix", authz.Conditions{authz.CondKeyResourceID: authz.Condition{Op: authz.OpPrefix, Value: "user"}}, true},
+		{"gte", authz.Conditions{"level": authz.Condition{Op: authz.OpGte, Value: 3.0}}, true},
+		{"gt", authz.Conditions{"level": authz.Condition{Op: authz.OpGt, Value: 3}}, false},
+		{"lt string", authz.Conditions{"level": authz.Condition{Op: authz.OpLt, Value: "5"}}, false},
+		{"before a time", authz.Conditions{authz.CondKeyRequestTime: authz.Condition{Op: authz.OpLt, Value: "2026-02-01T00:00:00Z"}}, true},
+		{"after a time", authz.Conditions{authz.CondKeyRequestTime: authz.Condition{Op: authz.OpGte, Value: "2026-02-01T00:00:00Z"}}, false},
+		{"unknown operator", authz.Conditions{"team": authz.Condition{Op: "regex", Value: ".*"}}, false},
+		{"all of the conditions", authz.Conditions{"team": "team-blue", "level": authz.Condition{Op: authz.OpLte, Value: 2}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.conds.Match(attrs); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestConditionsJSON(t *testing.T) {
+	conds := authz.Conditions{
+		authz.CondKeyResourceID: authz.Condition{Op: authz.OpIn, Value: []string{"${subject.id}", "user2"}},
+		"level":                 2,
+		"team":                  "team-blue",
+	}
+	b, err := json.Marshal(conds)
+	if err != nil {
+		t.Fatalf("error marshalling conditions: %v", err)
+	}
+	var decoded authz.Conditions
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("error unmarshalling conditions: %v", err)
+	}
+	if _, ok := decoded[authz.CondKeyResourceID].(authz.Condition); !ok || decoded["team"] != "team-blue" {
+		t.Fatalf("unexpected decoded conditions %#v", decoded)
+	}
+	attrs := authz.Conditions{authz.CondKeyResourceID: "user1", authz.CondKeySubjectID: "user1", "level": 2, "team": "team-blue"}
+	if !decoded.Match(attrs) {
+		t.Error("expected the decoded conditions to match")
+	}
+}
@@ -0,0 +1,147 @@
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"user-service/errorx"
+)
+
+/*
+Note about the role hierarchy:
+
+A role inherits the grants of its parent roles, e.g. admin has editor as its parent, which has viewer as its parent, so that the grants
+of viewer are not repeated for editor and admin. The hierarchy is a directed acyclic graph - a role may have several parents, and a
+cycle is refused when the parents of a role are set.
+
+The effective grants of a role, i.e. its own grants along with the ones of all its ancestors, are resolved once and cached by the Service.
+As a change to a role changes the effective grants of all its descendants, the whole cache is dropped on a change made via the Service.
+A change made directly on the datastore, e.g. by another instance of the service, is only picked up on a restart. This is fine for this
+sample service, where the policies are only seeded on startup. Otherwise, the cache entries would need an expiry.
+*/
+
+// EffectiveGrants are the grants of a role and of all its ancestors, keyed by the Resource they are on.
+// A Resource may have several grants, as the role and each of its ancestors may have one on it.
+type EffectiveGrants map[Resource][]AccessRights
+
+// ResolveGrants walks up the hierarchy of the role, and collects the grants of the role and of its ancestors.
+// It returns an errorx.Error with errorx.NotFound code if the role does not exist. A missing ancestor has no grants to inherit.
+func ResolveGrants(ctx context.Context, db PolicyRepository, role Role) (EffectiveGrants, error) {
+	p, err := db.GetPolicy(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	grants := EffectiveGrants{}
+	// The visited roles guard against a cycle, which SetRoleParents refuses, but which two concurrent writes could still produce
+	visited := map[Role]bool{role: true}
+	queue := []Policy{p}
+	for len(queue) > 0 {
+		p, queue = queue[0], queue[1:]
+		for resource, ar := range p.Grants {
+			grants[resource] = append(grants[resource], ar.Clone())
+		}
+		for _, parent := range p.Parents {
+			if visited[parent] {
+				continue
+			}
+			visited[parent] = true
+			pp, err := db.GetPolicy(ctx, parent)
+			if err != nil {
+				var e errorx.Error
+				if errors.As(err, &e) && e.Code == errorx.NotFound {
+					log.Println("DEBUG: parent role not found", parent)
+					continue
+				}
+				return nil, err
+			}
+			queue = append(queue, pp)
+		}
+	}
+	return grants, nil
+}
+
+// SetRoleParents replaces the parents of the role, once it has checked that the parents exist, and that none of them is the role
+// itself or one of its descendants. Such a parent results in an errorx.Error with errorx.BadRequestData code.
+func SetRoleParents(ctx context.Context, db PolicyRepository, role Role, parents []Role) error {
+	for _, parent := range parents {
+		if err := checkNoCycle(ctx, db, role, parent); err != nil {
+			return err
+		}
+	}
+	var unique []Role
+	for _, parent := range parents {
+		if !slices.Contains(unique, parent) {
+			unique = append(unique, parent)
+		}
+	}
+	return db.SetRoleParents(ctx, role, unique)
+}
+
+// checkNoCycle walks up the hierarchy from the parent, and fails if it reaches the role.
+func checkNoCycle(ctx context.Context, db PolicyRepository, role, parent Role) error {
+	visited := map[Role]bool{}
+	queue := []Role{parent}
+	for len(queue) > 0 {
+		r := queue[0]
+		queue = queue[1:]
+		if r == role {
+			log.Println("DEBUG: role hierarchy cycle", role, parent)
+			return errorx.Error{Code: errorx.BadRequestData, Message: fmt.Sprintf("Role %s can not inherit from %s, as it would result in a cycle", role, parent)}
+		}
+		if visited[r] {
+			continue
+		}
+		visited[r] = true
+		p, err := db.GetPolicy(ctx, r)
+		if err != nil {
+			var e errorx.Error
+			if errors.As(err, &e) && e.Code == errorx.NotFound {
+				if r == parent {
+					return errorx.Error{Code: errorx.BadRequestData, Message: fmt.Sprintf("Unknown parent role %s", parent)}
+				}
+				continue
+			}
+			return err
+		}
+		queue = append(queue, p.Parents...)
+	}
+	return nil
+}
+
+// grantsCache holds the effective grants of the roles, which are only ever read once cached.
+// The generation is bumped on every invalidation, so that the grants resolved before an invalidation are not cached after it.
+type grantsCache struct {
+	mu         sync.RWMutex
+	grants     map[Role]EffectiveGrants
+	generation uint64
+}
+
+func newGrantsCache() *grantsCache {
+	return &grantsCache{grants: map[Role]EffectiveGrants{}}
+}
+
+func (c *grantsCache) get(role Role) (EffectiveGrants, uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	grants, ok := c.grants[role]
+	return grants, c.generation, ok
+}
+
+// set caches the grants, unless the cache has been invalidated since the generation they were resolved in.
+func (c *grantsCache) set(role Role, grants EffectiveGrants, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.grants[role] = grants
+	}
+}
+
+func (c *grantsCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.grants = map[Role]EffectiveGrants{}
+	c.generation++
+}
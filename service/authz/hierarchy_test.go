@@ -0,0 +1,118 @@
+package authz_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"user-service/authz"
+	"user-service/datastore"
+	"user-service/errorx"
+)
+
+const (
+	roleEditor  authz.Role     = "editor"
+	resourceLog authz.Resource = "audit_log"
+)
+
+var anyResource = authz.Conditions{authz.CondKeyResourceID: authz.ResourceIDAny}
+
+// hierarchyStore holds admin ⊇ editor ⊇ viewer, with each role granting one more permission on the users than its parent.
+func hierarchyStore(t *testing.T) *datastore.Store {
+	t.Helper()
+	ctx := context.Background()
+	store := datastore.InitStore()
+	for role, permission := range map[authz.Role]authz.Permission{
+		authz.RoleViewer: authz.PermissionRead,
+		roleEditor:       authz.PermissionUpdate,
+		authz.RoleAdmin:  authz.PermissionDelete,
+	} {
+		store.SetGrant(ctx, authz.AccessRights{Role: role, Resource: authz.ResourceUser, Permissions: []authz.Permission{permission}, Conditions: anyResource})
+	}
+	store.SetGrant(ctx, authz.AccessRights{Role: authz.RoleAdmin, Resource: resourceLog, Permissions: []authz.Permission{authz.PermissionRead}, Conditions: anyResource})
+	if err := authz.SetRoleParents(ctx, store, roleEditor, []authz.Role{authz.RoleViewer}); err != nil {
+		t.Fatalf("error setting parents: %v", err)
+	}
+	if err := authz.SetRoleParents(ctx, store, authz.RoleAdmin, []authz.Role{roleEditor}); err != nil {
+		t.Fatalf("error setting parents: %v", err)
+	}
+	return store
+}
+
+func TestRoleInheritance(t *testing.T) {
+	ctx := context.Background()
+	store := hierarchyStore(t)
+	tests := []struct {
+		role       authz.Role
+		resource   authz.Resource
+		permission authz.Permission
+		want       bool
+	}{
+		{authz.RoleAdmin, authz.ResourceUser, authz.PermissionRead, true},
+		{authz.RoleAdmin, authz.ResourceUser, authz.PermissionUpdate, true},
+		{authz.RoleAdmin, authz.ResourceUser, authz.PermissionDelete, true},
+		{authz.RoleAdmin, resourceLog, authz.PermissionRead, true},
+		{roleEditor, authz.ResourceUser, authz.PermissionRead, true},
+		{roleEditor, authz.ResourceUser, authz.PermissionDelete, false},
+		{roleEditor, resourceLog, authz.PermissionRead, false},
+		{authz.RoleViewer, authz.ResourceUser, authz.PermissionUpdate, false},
+	}
+	for _, tt := range tests {
+		ok, err := authz.IsRoleAuthorized(ctx, store, string(tt.role), string(tt.resource), string(tt.permission), anyResource)
+		if ok != tt.want || (err == nil) != tt.want {
+			t.Errorf("%s %s %s: expected %v, got %v %v", tt.role, tt.permission, tt.resource, tt.want, ok, err)
+		}
+	}
+
+	grants, err := authz.ResolveGrants(ctx, store, authz.RoleAdmin)
+	if err != nil || len(grants[authz.ResourceUser]) != 3 || len(grants[resourceLog]) != 1 {
+		t.Errorf("unexpected effective grants %v, err %v", grants, err)
+	}
+}
+
+func TestRoleHierarchyCycles(t *testing.T) {
+	ctx := context.Background()
+	store := hierarchyStore(t)
+	for _, parent := range []authz.Role{authz.RoleViewer, roleEditor, authz.RoleAdmin} {
+		var e errorx.Error
+		err := authz.SetRoleParents(ctx, store, authz.RoleViewer, []authz.Role{parent})
+		if !errors.As(err, &e) || e.Code != errorx.BadRequestData {
+			t.Errorf("expected a cycle via %s to be refused, got %v", parent, err)
+		}
+	}
+	if err := authz.SetRoleParents(ctx, store, authz.RoleViewer, []authz.Role{"unknown"}); err == nil {
+		t.Error("expected an unknown parent to be refused")
+	}
+	if p, _ := store.GetPolicy(ctx, authz.RoleViewer); len(p.Parents) != 0 {
+		t.Errorf("expected the refused parents not to be stored, got %v", p.Parents)
+	}
+	// A role may have several parents, which share an ancestor
+	if err := authz.SetRoleParents(ctx, store, "auditor", []authz.Role{roleEditor, authz.RoleViewer}); err != nil {
+		t.Errorf("expected a diamond to be allowed, got %v", err)
+	}
+}
+
+func TestServiceCachesEffectiveGrants(t *testing.T) {
+	ctx := context.Background()
+	store := hierarchyStore(t)
+	svc := authz.InitService(store)
+	if ok, _ := svc.IsAuthorized(ctx, string(authz.RoleAdmin), string(authz.ResourceUser), string(authz.PermissionCreate), anyResource); ok {
+		t.Fatal("expected admin not to have the create permission yet")
+	}
+
+	// A change made directly on the datastore is not seen, as the effective grants are cached
+	create := authz.AccessRights{Role: authz.RoleViewer, Resource: authz.ResourceUser, Permissions: []authz.Permission{authz.PermissionRead, authz.PermissionCreate}, Conditions: anyResource}
+	store.SetGrant(ctx, create)
+	if ok, _ := svc.IsAuthorized(ctx, string(authz.RoleAdmin), string(authz.ResourceUser), string(authz.PermissionCreate), anyResource); ok {
+		t.Error("expected the cached effective grants to be used")
+	}
+	// A change made via the service drops the cache, and a change to an ancestor is inherited
+	if err := svc.SetGrant(ctx, create); err != nil {
+		t.Fatalf("error setting grant: %v", err)
+	}
+	if ok, err := svc.IsAuthorized(ctx, string(authz.RoleAdmin), string(authz.ResourceUser), string(authz.PermissionCreate), anyResource); !ok {
+		t.Errorf("expected admin to inherit the new permission of viewer, got %v", err)
+	}
+	if err := svc.SetRoleParents(ctx, authz.RoleViewer, []authz.Role{authz.RoleAdmin}); err == nil {
+		t.Error("expected a cycle to be refused via the service")
+	}
+}
@@ -5,19 +5,88 @@
 // I do not have a strong preference on this matter.
 package commons
 
-// Datastore exposes simple Get and Set methods
+import (
+	"context"
+	"user-service/authn"
+	"user-service/authz"
+	"user-service/users"
+)
+
+// Datastore groups the typed repositories of all the domain packages.
+// The repository interfaces themselves are defined next to the types they persist, to avoid import cycles.
 type Datastore interface {
-	Get(key string) interface{}
-	Set(key string, val interface{}) error
+	users.UserRepository
+	users.RoleBindingRepository
+	authz.PolicyRepository
+	authn.RefreshTokenRepository
+	authn.SubjectRepository
+	authn.RevokedTokenRepository
+	authn.ClientRepository
+	authn.PasswordRepository
+	authn.LoginAttemptRepository
+	authn.MFARepository
+	authn.MFAChallengeRepository
+	authn.AuthorizationCodeRepository
 }
 
-// Authenticator handles token generation and validation
+// Authenticator groups the authentication facilities, which are consumed together by the request handlers.
 type Authenticator interface {
-	GenerateToken(id string) (string, error)
-	ValidateToken(token string) (string, error)
+	TokenIssuer
+	OpenIDProvider
+	ClientAuthenticator
+	OAuth
+	PasswordLogin
+	MFA
+}
+
+// TokenIssuer issues, validates, refreshes, revokes and introspects the access tokens, and exposes the keys that validate them.
+type TokenIssuer interface {
+	GenerateToken(id string, amr ...string) (string, error)
+	ValidateToken(token string) (authn.Claims, error)
+	IssueRefreshToken(ctx context.Context, id string, amr ...string) (string, error)
+	RefreshToken(ctx context.Context, refreshToken string) (string, string, error)
+	RevokeToken(ctx context.Context, token string, hint string) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+	IntrospectToken(ctx context.Context, token string) (authn.Introspection, error)
+	JWKS() (authn.JWKSet, error)
+}
+
+// OpenIDProvider describes the provider in the OpenID Connect discovery document.
+// The ID tokens themselves are issued in the authorization code flow, see OAuth.
+type OpenIDProvider interface {
+	OpenIDConfiguration() (authn.ProviderMetadata, error)
+}
+
+// ClientAuthenticator authenticates the registered clients, and issues them the tokens for themselves.
+type ClientAuthenticator interface {
+	AuthenticateClient(ctx context.Context, id, secret string) (authn.Client, error)
+	ClientCredentialsToken(ctx context.Context, req authn.ClientCredentialsRequest) (authn.AccessToken, error)
+}
+
+// OAuth runs the authorization code flow, which issues the tokens of a user to a client.
+type OAuth interface {
+	ValidateAuthorizationRequest(ctx context.Context, req authn.AuthorizationRequest) error
+	IssueAuthorizationCode(ctx context.Context, req authn.AuthorizationRequest, id string, amr ...string) (string, error)
+	AuthorizationCodeToken(ctx context.Context, req authn.AuthorizationCodeRequest) (authn.AccessToken, error)
+}
+
+// PasswordLogin checks the password credentials of the users, sets them, and lifts the lockouts of the accounts.
+type PasswordLogin interface {
+	Login(ctx context.Context, id, password, ip string) (string, error)
+	UnlockAccount(ctx context.Context, id string) error
+	SetPassword(ctx context.Context, id, password string) error
+}
+
+// MFA enrolls and disables the second factor of the users, and completes the logins that require it.
+type MFA interface {
+	VerifyMFAChallenge(ctx context.Context, challenge, code, ip string) (string, []string, error)
+	EnrollTOTP(ctx context.Context, id string) (authn.TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, id, code string) ([]string, error)
+	DisableMFA(ctx context.Context, id string) error
 }
 
-// Authorizer exposes a method to check if a role has a required permission(s) on a resource under certain conditions.
+// Authorizer exposes methods to check if a role, or a set of roles, has the required permission(s) on a resource under certain conditions.
 type Authorizer interface {
-	IsAuthorized(role string, resource string, permission string, conditions interface{}) (bool, error)
+	IsAuthorized(ctx context.Context, role string, resource string, permission string, conditions interface{}) (bool, error)
+	AreRolesAuthorized(ctx context.Context, roles []string, resource string, permissions []string, match authz.Match, conditions interface{}) (bool, error)
 }
@@ -3,25 +3,77 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 const (
-	DefaultHost          = "0.0.0.0"
-	DefaultPort          = "3030"
-	ConfigFileName       = "config"
-	ConfigFileDir        = "../service_config"
-	DefaultKeyDir        = "../keys"
-	DefaultSigningMethod = "rsa"
+	DefaultHost               = "0.0.0.0"
+	DefaultPort               = "3030"
+	ConfigFileName            = "config"
+	ConfigFileDir             = "../service_config"
+	DefaultKeyDir             = "../keys"
+	DefaultSigningMethod      = "rsa"
+	DefaultDatastore          = "memory"
+	DefaultDatastorePath      = "../data/user-service.db"
+	DefaultSeedSampleData     = false
+	DefaultPasswordMinLength  = 12
+	DefaultPasswordBreachList = "../service_config/breached-passwords.txt"
+	DefaultIssuer             = "http://localhost:3030"
+	DefaultAudience           = "client1"
+	DefaultAccessTokenTTL     = 30 * time.Minute
+	DefaultRefreshTokenTTL    = 24 * time.Hour
+	DefaultTokenLeeway        = 0 * time.Second
+	// The minimum estimated entropy of an HMAC secret, e.g. 32 random bytes, base64 or hex encoded, are well above it
+	MinHMACSecretBits = 128
+)
+
+// The values accepted for the signing-method and datastore configs
+var (
+	SigningMethods = []string{"rsa", "ecdsa", "eddsa", "hmac"}
+	Datastores     = []string{"memory", "sqlite"}
 )
 
 type Config struct {
-	Host          string
-	Port          string
-	KeyDir        string
-	SigningMethod string
+	Host               string
+	Port               string
+	KeyDir             string
+	SigningMethod      string // Either "rsa", "ecdsa", "eddsa" or "hmac"
+	SigningKeyID       string // kid of the active signing key in KeyDir, optional if there is a single private key
+	Datastore          string // Either "memory" or "sqlite"
+	DatastorePath      string // Path of the database file, used with the "sqlite" datastore
+	SeedSampleData     bool   // Seeds the sample users into an empty datastore, for trying out the service only
+	PasswordMinLength  int
+	PasswordBreachList string // Path of a file of known breached passwords, one per line. Empty disables the check.
+	Issuer             string // The iss claim of the issued tokens, and the issuer that the validated tokens must have
+	// The audiences that the validated tokens may have, i.e. the names this service is known by.
+	// The tokens issued on a login carry the first one.
+	Audiences       []string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	TokenLeeway     time.Duration // The clock skew tolerated on the time claims of the validated tokens
+	// The secrets of the "hmac" signing method, read from the hmac-secret-file or the HMAC_SECRETS env var, never from the config file.
+	// The first one signs the tokens, and the rest are the previous secrets, which are still accepted during a rotation.
+	HMACSecrets []string
+	// The secret of the sample confidential client, read from the SAMPLE_CLIENT_SECRET env var, never from the config file.
+	// Without it, the sample client is not registered.
+	SampleClientSecret string
+	// The password of the sample users, read from the SAMPLE_USERS_PASSWORD env var, never from the config file.
+	// Without it, the sample users can not log in.
+	SampleUsersPassword string
+	// The password of the sample admin client_user, read from the SAMPLE_ADMIN_PASSWORD env var, never from the config file.
+	// Without it, the sample admin can not log in.
+	SampleAdminPassword string
 }
 
 // defaultConfig initializes config based on a config file.
@@ -41,18 +93,182 @@ func GetConfig() (*Config, error) {
 	viper.BindEnv("port", "PORT")
 	viper.BindEnv("keydir", "KEYDIR")
 	viper.BindEnv("signing-method", "SIGNING_METHOD")
+	viper.BindEnv("signing-kid", "SIGNING_KID")
+	viper.BindEnv("datastore", "DATASTORE")
+	viper.BindEnv("datastore-path", "DATASTORE_PATH")
+	viper.BindEnv("seed-sample-data", "SEED_SAMPLE_DATA")
+	viper.BindEnv("password-min-length", "PASSWORD_MIN_LENGTH")
+	viper.BindEnv("password-breach-list", "PASSWORD_BREACH_LIST")
+	viper.BindEnv("issuer", "ISSUER")
+	viper.BindEnv("audiences", "AUDIENCES")
+	viper.BindEnv("access-token-ttl", "ACCESS_TOKEN_TTL")
+	viper.BindEnv("refresh-token-ttl", "REFRESH_TOKEN_TTL")
+	viper.BindEnv("token-leeway", "TOKEN_LEEWAY")
+	viper.BindEnv("hmac-secret-file", "HMAC_SECRET_FILE")
 
 	viper.SetDefault("host", DefaultHost)
 	viper.SetDefault("port", DefaultPort)
 	viper.SetDefault("keydir", DefaultKeyDir)
 	viper.SetDefault("signing-method", DefaultSigningMethod)
+	viper.SetDefault("datastore", DefaultDatastore)
+	viper.SetDefault("datastore-path", DefaultDatastorePath)
+	viper.SetDefault("seed-sample-data", DefaultSeedSampleData)
+	viper.SetDefault("password-min-length", DefaultPasswordMinLength)
+	viper.SetDefault("password-breach-list", DefaultPasswordBreachList)
+	viper.SetDefault("issuer", DefaultIssuer)
+	viper.SetDefault("audiences", []string{DefaultAudience})
+	viper.SetDefault("access-token-ttl", DefaultAccessTokenTTL)
+	viper.SetDefault("refresh-token-ttl", DefaultRefreshTokenTTL)
+	viper.SetDefault("token-leeway", DefaultTokenLeeway)
 
+	var err error
 	cfg := &Config{
-		Host:          viper.GetString("host"),
-		Port:          viper.GetString("port"),
-		KeyDir:        viper.GetString("keydir"),
-		SigningMethod: viper.GetString("signing-method"),
+		Host:               viper.GetString("host"),
+		Port:               viper.GetString("port"),
+		KeyDir:             viper.GetString("keydir"),
+		SigningMethod:      viper.GetString("signing-method"),
+		SigningKeyID:       viper.GetString("signing-kid"),
+		Datastore:          viper.GetString("datastore"),
+		DatastorePath:      viper.GetString("datastore-path"),
+		SeedSampleData:     viper.GetBool("seed-sample-data"),
+		PasswordMinLength:  viper.GetInt("password-min-length"),
+		PasswordBreachList: viper.GetString("password-breach-list"),
+		Issuer:             viper.GetString("issuer"),
+		Audiences:          splitList(viper.GetStringSlice("audiences")),
+		AccessTokenTTL:     viper.GetDuration("access-token-ttl"),
+		RefreshTokenTTL:    viper.GetDuration("refresh-token-ttl"),
+		TokenLeeway:        viper.GetDuration("token-leeway"),
+	}
+	cfg.SampleClientSecret = os.Getenv("SAMPLE_CLIENT_SECRET")
+	cfg.SampleUsersPassword = os.Getenv("SAMPLE_USERS_PASSWORD")
+	cfg.SampleAdminPassword = os.Getenv("SAMPLE_ADMIN_PASSWORD")
+	cfg.HMACSecrets, err = loadHMACSecrets(viper.GetString("hmac-secret-file"))
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
 	return cfg, nil
 }
+
+// splitList splits the comma-separated values, as a list is given in a single ENV var, e.g. AUDIENCES=client1,reports-service
+func splitList(values []string) []string {
+	var res []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				res = append(res, item)
+			}
+		}
+	}
+	return res
+}
+
+// Validate checks the token settings, so that a misconfigured service fails at startup, rather than on the first token.
+func (c *Config) Validate() error {
+	if !slices.Contains(SigningMethods, c.SigningMethod) {
+		return fmt.Errorf("signing-method %q must be one of %s", c.SigningMethod, strings.Join(SigningMethods, ", "))
+	}
+	if !slices.Contains(Datastores, c.Datastore) {
+		return fmt.Errorf("datastore %q must be one of %s", c.Datastore, strings.Join(Datastores, ", "))
+	}
+	if strings.TrimSpace(c.Issuer) == "" {
+		return errors.New("issuer must not be empty")
+	}
+	if err := validateIssuer(c.Issuer); err != nil {
+		return err
+	}
+	if len(c.Audiences) == 0 {
+		return errors.New("at least one audience is required")
+	}
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 {
+		return errors.New("access-token-ttl and refresh-token-ttl must be positive durations, e.g. 30m")
+	}
+	if c.RefreshTokenTTL < c.AccessTokenTTL {
+		return fmt.Errorf("refresh-token-ttl (%s) must not be shorter than access-token-ttl (%s)", c.RefreshTokenTTL, c.AccessTokenTTL)
+	}
+	// A leeway close to the lifetime of the tokens would keep the expired tokens valid for about as long again
+	if c.TokenLeeway < 0 || c.TokenLeeway >= c.AccessTokenTTL/2 {
+		return fmt.Errorf("token-leeway (%s) must be between 0 and half of access-token-ttl", c.TokenLeeway)
+	}
+	// The client secret is a shared secret, like the hmac one, so it is held to the same bar
+	if c.SampleClientSecret != "" {
+		if bits := estimateEntropy(c.SampleClientSecret); bits < MinHMACSecretBits {
+			return fmt.Errorf("the sample client secret is too weak, with an estimated entropy of %.0f bits, at least %d are required", bits, MinHMACSecretBits)
+		}
+	}
+	if c.SigningMethod == "hmac" {
+		return validateHMACSecrets(c.HMACSecrets)
+	}
+	return nil
+}
+
+// validateIssuer requires the issuer to be an https URL without a query or fragment, as per OpenID Connect Discovery 1.0,
+// since the relying parties compare it with the iss claim, and the endpoints of the discovery document are built from it.
+// Plain http is only allowed for localhost, for trying out the service.
+func validateIssuer(issuer string) error {
+	u, err := url.Parse(issuer)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("issuer %q must be an absolute URL without a query or fragment, e.g. https://users.example.com", issuer)
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	if ip := net.ParseIP(u.Hostname()); u.Scheme == "http" && (u.Hostname() == "localhost" || ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("issuer %q must be an https URL, plain http is only allowed for localhost", issuer)
+}
+
+// loadHMACSecrets reads the secrets from the file, one per line, current one first.
+// Without a file, they are taken from the comma-separated HMAC_SECRETS env var. The env var is read directly, rather than via viper,
+// so that the secrets can not be put into the config file, which tends to end up in the source control.
+func loadHMACSecrets(path string) ([]string, error) {
+	if path == "" {
+		return splitList([]string{os.Getenv("HMAC_SECRETS")}), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading hmac-secret-file: %w", err)
+	}
+	var secrets []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			secrets = append(secrets, line)
+		}
+	}
+	return secrets, nil
+}
+
+// validateHMACSecrets refuses the "hmac" signing method without a secret, or with a secret that could be guessed.
+// The previous secrets are checked as well, as a token signed with any of them is accepted.
+func validateHMACSecrets(secrets []string) error {
+	if len(secrets) == 0 {
+		return errors.New("the hmac signing method requires a secret, via hmac-secret-file or HMAC_SECRETS")
+	}
+	for i, secret := range secrets {
+		if bits := estimateEntropy(secret); bits < MinHMACSecretBits {
+			return fmt.Errorf("hmac secret #%d is too weak, with an estimated entropy of %.0f bits, at least %d are required", i+1, bits, MinHMACSecretBits)
+		}
+	}
+	return nil
+}
+
+// estimateEntropy estimates the entropy of the secret in bits, from the frequency of its characters.
+// It is only an upper bound - a long secret of a few repeated characters scores low, but a predictable phrase may still pass.
+func estimateEntropy(secret string) float64 {
+	counts := map[rune]int{}
+	n := 0
+	for _, r := range secret {
+		counts[r]++
+		n++
+	}
+	var perChar float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		perChar -= p * math.Log2(p)
+	}
+	return perChar * float64(n)
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateHMACSecrets(t *testing.T) {
+	valid := Config{
+		Issuer:          DefaultIssuer,
+		Audiences:       []string{DefaultAudience},
+		AccessTokenTTL:  DefaultAccessTokenTTL,
+		RefreshTokenTTL: DefaultRefreshTokenTTL,
+		SigningMethod:   "hmac",
+		Datastore:       DefaultDatastore,
+	}
+	tests := []struct {
+		name    string
+		secrets []string
+		wantErr bool
+	}{
+		{"no secret", nil, true},
+		{"short secret", []string{"mysupersecret"}, true},
+		{"repeated characters", []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}, true},
+		{"random hex", []string{"3f9a1c7e5b2d8f4061a7c3e9b5d2f8a41c6e0b3d9f7a5c2e8b4d1f6a0c3e7b95"}, false},
+		{"weak previous secret", []string{"3f9a1c7e5b2d8f4061a7c3e9b5d2f8a41c6e0b3d9f7a5c2e8b4d1f6a0c3e7b95", "secret"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			cfg.HMACSecrets = tt.secrets
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// The secrets are only required by the hmac signing method
+	cfg := valid
+	cfg.SigningMethod = "rsa"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected no secret to be required for rsa, got %v", err)
+	}
+	cfg.TokenLeeway = time.Hour
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for a leeway longer than half of the access-token-ttl")
+	}
+}
+
+func TestValidateIssuer(t *testing.T) {
+	tests := []struct {
+		issuer  string
+		wantErr bool
+	}{
+		{"https://users.example.com", false},
+		{"https://users.example.com/auth/", false},
+		{"http://localhost:3030", false},
+		{"http://127.0.0.1:3030", false},
+		{"http://users.example.com", true},
+		{"platform/user-service", true},
+		{"https://users.example.com?tenant=1", true},
+		{"https://users.example.com#top", true},
+	}
+	for _, tt := range tests {
+		cfg := Config{
+			Issuer:          tt.issuer,
+			Audiences:       []string{DefaultAudience},
+			AccessTokenTTL:  DefaultAccessTokenTTL,
+			RefreshTokenTTL: DefaultRefreshTokenTTL,
+			SigningMethod:   DefaultSigningMethod,
+			Datastore:       DefaultDatastore,
+		}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("expected error %v for %q, got %v", tt.wantErr, tt.issuer, err)
+		}
+	}
+}
+
+func TestValidateChoices(t *testing.T) {
+	valid := Config{
+		Issuer:          DefaultIssuer,
+		Audiences:       []string{DefaultAudience},
+		AccessTokenTTL:  DefaultAccessTokenTTL,
+		RefreshTokenTTL: DefaultRefreshTokenTTL,
+		SigningMethod:   DefaultSigningMethod,
+		Datastore:       DefaultDatastore,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %v", err)
+	}
+	cfg := valid
+	cfg.SigningMethod = "RS256"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for an unknown signing-method")
+	}
+	cfg = valid
+	cfg.Datastore = "postgres"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for an unknown datastore")
+	}
+}
+
+func TestValidateSampleClientSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr bool
+	}{
+		{"no secret", "", false},
+		{"short secret", "client1secret", true},
+		{"random hex", "3f9a1c7e5b2d8f4061a7c3e9b5d2f8a41c6e0b3d9f7a5c2e8b4d1f6a0c3e7b95", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{
+				Issuer:             DefaultIssuer,
+				Audiences:          []string{DefaultAudience},
+				AccessTokenTTL:     DefaultAccessTokenTTL,
+				RefreshTokenTTL:    DefaultRefreshTokenTTL,
+				SigningMethod:      DefaultSigningMethod,
+				Datastore:          DefaultDatastore,
+				SampleClientSecret: tt.secret,
+			}
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadHMACSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hmac-secrets")
+	if err := os.WriteFile(path, []byte("current\n\n  previous  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := loadHMACSecrets(path)
+	if err != nil {
+		t.Fatalf("error loading secrets: %v", err)
+	}
+	if len(secrets) != 2 || secrets[0] != "current" || secrets[1] != "previous" {
+		t.Errorf("unexpected secrets: %q", secrets)
+	}
+
+	t.Setenv("HMAC_SECRETS", "current, previous")
+	secrets, err = loadHMACSecrets("")
+	if err != nil || len(secrets) != 2 || secrets[1] != "previous" {
+		t.Errorf("unexpected secrets from env: %q, %v", secrets, err)
+	}
+	if _, err := loadHMACSecrets(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
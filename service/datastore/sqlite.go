@@ -0,0 +1,866 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+	"user-service/authn"
+	"user-service/authz"
+	"user-service/errorx"
+	"user-service/timesource"
+	"user-service/users"
+
+	// Pure-Go SQLite driver, so that no cgo toolchain or external database server is needed.
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order, and each one exactly once.
+// The index of a migration in this list (starting at 1) is its schema version, so existing entries must never be edited or reordered.
+var migrations = []string{
+	`CREATE TABLE users (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	CREATE TABLE user_roles (
+		user_id  TEXT NOT NULL,
+		role     TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (user_id, role)
+	);
+	CREATE TABLE rbac (
+		role        TEXT PRIMARY KEY,
+		resource    TEXT NOT NULL,
+		permissions TEXT NOT NULL,
+		conditions  TEXT NOT NULL
+	);`,
+	`CREATE TABLE refresh_tokens (
+		hash       TEXT PRIMARY KEY,
+		family_id  TEXT NOT NULL,
+		user_id    TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		used       INTEGER NOT NULL DEFAULT 0,
+		revoked    INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id);`,
+	`CREATE TABLE revoked_tokens (
+		jti        TEXT PRIMARY KEY,
+		expires_at TEXT NOT NULL
+	);
+	CREATE INDEX revoked_tokens_expires_at ON revoked_tokens (expires_at);`,
+	`CREATE TABLE clients (
+		id          TEXT PRIMARY KEY,
+		secret_hash TEXT NOT NULL,
+		scopes      TEXT NOT NULL,
+		audiences   TEXT NOT NULL
+	);`,
+	`CREATE TABLE passwords (
+		user_id TEXT PRIMARY KEY,
+		hash    TEXT NOT NULL
+	);`,
+	`CREATE TABLE login_attempts (
+		key          TEXT PRIMARY KEY,
+		failures     INTEGER NOT NULL,
+		last_failure TEXT NOT NULL
+	);
+	CREATE INDEX login_attempts_last_failure ON login_attempts (last_failure);`,
+	`ALTER TABLE refresh_tokens ADD COLUMN amr TEXT NOT NULL DEFAULT '[]';
+	CREATE TABLE mfa (
+		user_id        TEXT PRIMARY KEY,
+		secret         TEXT NOT NULL,
+		enabled        INTEGER NOT NULL,
+		last_used_step INTEGER NOT NULL
+	);
+	CREATE TABLE mfa_recovery_codes (
+		user_id TEXT NOT NULL,
+		hash    TEXT NOT NULL,
+		PRIMARY KEY (user_id, hash)
+	);
+	CREATE TABLE mfa_challenges (
+		hash       TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL,
+		expires_at TEXT NOT NULL
+	);
+	CREATE INDEX mfa_challenges_expires_at ON mfa_challenges (expires_at);`,
+	`ALTER TABLE clients ADD COLUMN redirect_uris TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE clients ADD COLUMN public INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE authorization_codes (
+		hash           TEXT PRIMARY KEY,
+		client_id      TEXT NOT NULL,
+		user_id        TEXT NOT NULL,
+		redirect_uri   TEXT NOT NULL,
+		code_challenge TEXT NOT NULL,
+		scopes         TEXT NOT NULL,
+		nonce          TEXT NOT NULL,
+		amr            TEXT NOT NULL,
+		auth_time      TEXT NOT NULL,
+		expires_at     TEXT NOT NULL
+	);
+	CREATE INDEX authorization_codes_expires_at ON authorization_codes (expires_at);`,
+	// The rbac table held a single grant per role. Its rows are carried over as is, as each of them is on a single resource.
+	`CREATE TABLE rbac_grants (
+		role        TEXT NOT NULL,
+		resource    TEXT NOT NULL,
+		permissions TEXT NOT NULL,
+		conditions  TEXT NOT NULL,
+		PRIMARY KEY (role, resource)
+	);
+	INSERT INTO rbac_grants (role, resource, permissions, conditions) SELECT role, resource, permissions, conditions FROM rbac;
+	DROP TABLE rbac;`,
+	`CREATE TABLE role_parents (
+		role     TEXT NOT NULL,
+		parent   TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (role, parent)
+	);`,
+	`CREATE INDEX users_username ON users (username, id);
+	CREATE INDEX users_created_at ON users (created_at, id);`,
+}
+
+// userSortColumns maps the sort fields of the user listing to their columns.
+// The columns sort in the same order as users.SortKey, as the created times are stored with a fixed width, and the text is compared bytewise.
+var userSortColumns = map[string]string{
+	users.SortByID:        "id",
+	users.SortByUsername:  "username",
+	users.SortByCreatedAt: "created_at",
+}
+
+// SQLiteStore implements Datastore interface on top of an embedded SQLite database.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// InitSQLiteStore opens (or creates) the database file at the supplied path and brings its schema up to date.
+func InitSQLiteStore(path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Println("ERROR: error creating datastore directory", err)
+		return nil, err
+	}
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		log.Println("ERROR: error opening sqlite datastore", err)
+		return nil, err
+	}
+	// SQLite allows a single writer at a time, so a single connection avoids "database is locked" errors between our own goroutines.
+	db.SetMaxOpenConns(1)
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		log.Println("ERROR: error creating schema_migrations table", err)
+		return err
+	}
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		log.Println("ERROR: error reading schema version", err)
+		return err
+	}
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			log.Println("ERROR: error applying migration", i+1, err)
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Println("INFO: applied datastore migration", i+1)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) GetUser(ctx context.Context, id users.UserID) (users.User, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT id, username, created_at FROM users WHERE id = ?`, string(id))
+	usr, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return users.User{}, errorx.Error{Code: errorx.NotFound}
+	}
+	return usr, err
+}
+
+func (s *SQLiteStore) ListUsers(ctx context.Context) ([]users.User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, username, created_at FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []users.User{}
+	for rows.Next() {
+		usr, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, usr)
+	}
+	return res, rows.Err()
+}
+
+// ListUsersPage runs the query as a keyset pagination, i.e. it seeks past the position of the query, rather than skipping rows.
+func (s *SQLiteStore) ListUsersPage(ctx context.Context, q users.UserQuery) ([]users.User, error) {
+	col, ok := userSortColumns[q.SortBy]
+	if !ok {
+		return nil, errorx.Error{Code: errorx.BadRequestData, Message: "Invalid sort field"}
+	}
+	query := `SELECT id, username, created_at FROM users WHERE id != ?`
+	args := []any{string(q.ExcludeID)}
+	if q.UsernamePrefix != "" {
+		// LIKE is case-insensitive, while the prefix has to match exactly
+		query += ` AND substr(username, 1, length(?)) = ?`
+		args = append(args, q.UsernamePrefix, q.UsernamePrefix)
+	}
+	op, dir := ">", "ASC"
+	if q.Desc {
+		op, dir = "<", "DESC"
+	}
+	if q.After != nil {
+		query += fmt.Sprintf(` AND (%s, id) %s (?, ?)`, col, op)
+		args = append(args, q.After.Key, string(q.After.ID))
+	}
+	query += fmt.Sprintf(` ORDER BY %s %s, id %s LIMIT ?`, col, dir, dir)
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []users.User{}
+	for rows.Next() {
+		usr, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, usr)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLiteStore) CreateUser(ctx context.Context, usr users.User) error {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO users (id, username, created_at) VALUES (?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		string(usr.ID), usr.Name, formatTime(usr.CreatedAt))
+	return expectOneRow(res, err, errorx.Conflict)
+}
+
+// UpdateUser reads and writes the user within a transaction, which holds the single connection, so no other update can come in between.
+func (s *SQLiteStore) UpdateUser(ctx context.Context, id users.UserID, update func(users.User) (users.User, error)) (users.User, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return users.User{}, err
+	}
+	defer tx.Rollback()
+	usr, err := scanUser(tx.QueryRowContext(ctx, `SELECT id, username, created_at FROM users WHERE id = ?`, string(id)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return users.User{}, errorx.Error{Code: errorx.NotFound}
+	}
+	if err != nil {
+		return users.User{}, err
+	}
+	if usr, err = update(usr); err != nil {
+		return users.User{}, err
+	}
+	usr.ID = id
+	res, err := tx.ExecContext(ctx, `UPDATE users SET username = ?, created_at = ? WHERE id = ?`, usr.Name, formatTime(usr.CreatedAt), string(id))
+	if err := expectOneRow(res, err, errorx.NotFound); err != nil {
+		return users.User{}, err
+	}
+	return usr, tx.Commit()
+}
+
+// DeleteUser removes the user along with its roles and credentials, and revokes its refresh tokens, within a single transaction.
+func (s *SQLiteStore) DeleteUser(ctx context.Context, id users.UserID) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, string(id))
+	if err := expectOneRow(res, err, errorx.NotFound); err != nil {
+		return err
+	}
+	for _, query := range []string{
+		`DELETE FROM user_roles WHERE user_id = ?`,
+		`DELETE FROM passwords WHERE user_id = ?`,
+		`DELETE FROM mfa_recovery_codes WHERE user_id = ?`,
+		`DELETE FROM mfa WHERE user_id = ?`,
+		`UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, query, string(id)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetUserRoles(ctx context.Context, id users.UserID) ([]authz.Role, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT role FROM user_roles WHERE user_id = ? ORDER BY position`, string(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []authz.Role{}
+	for rows.Next() {
+		var role authz.Role
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		res = append(res, role)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLiteStore) SetUserRoles(ctx context.Context, id users.UserID, roles []authz.Role) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_roles WHERE user_id = ?`, string(id)); err != nil {
+		return err
+	}
+	for i, role := range roles {
+		_, err := tx.ExecContext(ctx, `INSERT INTO user_roles (user_id, role, position) VALUES (?, ?, ?)`, string(id), string(role), i)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteUserRoles(ctx context.Context, id users.UserID) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM user_roles WHERE user_id = ?`, string(id))
+	return err
+}
+
+func (s *SQLiteStore) GetPolicy(ctx context.Context, role authz.Role) (authz.Policy, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT role, resource, permissions, conditions FROM rbac_grants WHERE role = ?`, string(role))
+	if err != nil {
+		return authz.Policy{}, err
+	}
+	defer rows.Close()
+	p := authz.Policy{Role: role, Grants: map[authz.Resource]authz.AccessRights{}}
+	for rows.Next() {
+		var (
+			ar                      authz.AccessRights
+			permissions, conditions string
+		)
+		if err := rows.Scan(&ar.Role, &ar.Resource, &permissions, &conditions); err != nil {
+			return authz.Policy{}, err
+		}
+		if err := json.Unmarshal([]byte(permissions), &ar.Permissions); err != nil {
+			return authz.Policy{}, err
+		}
+		if err := json.Unmarshal([]byte(conditions), &ar.Conditions); err != nil {
+			return authz.Policy{}, err
+		}
+		p.Grants[ar.Resource] = ar
+	}
+	if err := rows.Err(); err != nil {
+		return authz.Policy{}, err
+	}
+	parents, err := s.db.QueryContext(ctx, `SELECT parent FROM role_parents WHERE role = ? ORDER BY position`, string(role))
+	if err != nil {
+		return authz.Policy{}, err
+	}
+	defer parents.Close()
+	for parents.Next() {
+		var parent authz.Role
+		if err := parents.Scan(&parent); err != nil {
+			return authz.Policy{}, err
+		}
+		p.Parents = append(p.Parents, parent)
+	}
+	if err := parents.Err(); err != nil {
+		return authz.Policy{}, err
+	}
+	if len(p.Grants) == 0 && len(p.Parents) == 0 {
+		return authz.Policy{}, errorx.Error{Code: errorx.NotFound}
+	}
+	return p, nil
+}
+
+func (s *SQLiteStore) SetGrant(ctx context.Context, ar authz.AccessRights) error {
+	permissions, err := json.Marshal(ar.Permissions)
+	if err != nil {
+		return err
+	}
+	conditions, err := json.Marshal(ar.Conditions)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO rbac_grants (role, resource, permissions, conditions) VALUES (?, ?, ?, ?)
+		ON CONFLICT (role, resource) DO UPDATE SET permissions = excluded.permissions, conditions = excluded.conditions`,
+		string(ar.Role), string(ar.Resource), string(permissions), string(conditions))
+	return err
+}
+
+func (s *SQLiteStore) SetRoleParents(ctx context.Context, role authz.Role, parents []authz.Role) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM role_parents WHERE role = ?`, string(role)); err != nil {
+		return err
+	}
+	for i, parent := range parents {
+		_, err := tx.ExecContext(ctx, `INSERT INTO role_parents (role, parent, position) VALUES (?, ?, ?)`, string(role), string(parent), i)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) CreateRefreshToken(ctx context.Context, rt authn.RefreshToken) error {
+	amr, err := json.Marshal(rt.AMR)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO refresh_tokens (hash, family_id, user_id, expires_at, used, revoked, amr)
+		VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (hash) DO NOTHING`,
+		rt.Hash, rt.FamilyID, rt.UserID, formatTime(rt.ExpiresAt), rt.Used, rt.Revoked, string(amr))
+	return expectOneRow(res, err, errorx.Conflict)
+}
+
+func (s *SQLiteStore) GetRefreshToken(ctx context.Context, hash string) (authn.RefreshToken, error) {
+	return getRefreshToken(ctx, s.db, hash)
+}
+
+func (s *SQLiteStore) UseRefreshToken(ctx context.Context, hash string) (authn.RefreshToken, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return authn.RefreshToken{}, err
+	}
+	defer tx.Rollback()
+	rt, err := getRefreshToken(ctx, tx, hash)
+	if err != nil {
+		return authn.RefreshToken{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used = 1 WHERE hash = ?`, hash); err != nil {
+		return authn.RefreshToken{}, err
+	}
+	return rt, tx.Commit()
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func getRefreshToken(ctx context.Context, q querier, hash string) (authn.RefreshToken, error) {
+	var (
+		rt             authn.RefreshToken
+		expiresAt, amr string
+	)
+	err := q.QueryRowContext(ctx, `SELECT hash, family_id, user_id, expires_at, used, revoked, amr FROM refresh_tokens WHERE hash = ?`, hash).
+		Scan(&rt.Hash, &rt.FamilyID, &rt.UserID, &expiresAt, &rt.Used, &rt.Revoked, &amr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return authn.RefreshToken{}, errorx.Error{Code: errorx.NotFound}
+	}
+	if err != nil {
+		return authn.RefreshToken{}, err
+	}
+	if rt.ExpiresAt, err = time.Parse(time.RFC3339Nano, expiresAt); err != nil {
+		return authn.RefreshToken{}, err
+	}
+	if err := json.Unmarshal([]byte(amr), &rt.AMR); err != nil {
+		return authn.RefreshToken{}, err
+	}
+	return rt, nil
+}
+
+func (s *SQLiteStore) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE family_id = ?`, familyID)
+	return err
+}
+
+func (s *SQLiteStore) RevokeUserRefreshTokens(ctx context.Context, userId string, amr ...string) error {
+	query := `UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`
+	args := []any{userId}
+	for _, m := range amr {
+		query += ` AND EXISTS (SELECT 1 FROM json_each(refresh_tokens.amr) WHERE value = ?)`
+		args = append(args, m)
+	}
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (s *SQLiteStore) UserExists(ctx context.Context, userId string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, userId).Scan(&exists)
+	return exists, err
+}
+
+// RevokeToken adds the token to the deny list, pruning the entries of the tokens that have expired on their own in the meantime.
+func (s *SQLiteStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at <= ?`, formatTime(timesource.CurrentTime())); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO revoked_tokens (jti, expires_at) VALUES (?, ?)
+		ON CONFLICT (jti) DO UPDATE SET expires_at = excluded.expires_at`, jti, formatTime(expiresAt))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?`, jti).Scan(&n)
+	return n > 0, err
+}
+
+func (s *SQLiteStore) GetClient(ctx context.Context, id string) (authn.Client, error) {
+	var (
+		c                               authn.Client
+		scopes, audiences, redirectURIs string
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT id, secret_hash, scopes, audiences, redirect_uris, public FROM clients WHERE id = ?`, id).
+		Scan(&c.ID, &c.SecretHash, &scopes, &audiences, &redirectURIs, &c.Public)
+	if errors.Is(err, sql.ErrNoRows) {
+		return authn.Client{}, errorx.Error{Code: errorx.NotFound}
+	}
+	if err != nil {
+		return authn.Client{}, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &c.Scopes); err != nil {
+		return authn.Client{}, err
+	}
+	if err := json.Unmarshal([]byte(audiences), &c.Audiences); err != nil {
+		return authn.Client{}, err
+	}
+	if err := json.Unmarshal([]byte(redirectURIs), &c.RedirectURIs); err != nil {
+		return authn.Client{}, err
+	}
+	return c, nil
+}
+
+func (s *SQLiteStore) CreateClient(ctx context.Context, c authn.Client) error {
+	scopes, err := json.Marshal(c.Scopes)
+	if err != nil {
+		return err
+	}
+	audiences, err := json.Marshal(c.Audiences)
+	if err != nil {
+		return err
+	}
+	redirectURIs, err := json.Marshal(c.RedirectURIs)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO clients (id, secret_hash, scopes, audiences, redirect_uris, public) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`,
+		c.ID, c.SecretHash, string(scopes), string(audiences), string(redirectURIs), c.Public)
+	return expectOneRow(res, err, errorx.Conflict)
+}
+
+func (s *SQLiteStore) GetPasswordHash(ctx context.Context, userId string) (string, error) {
+	var hash string
+	err := s.db.QueryRowContext(ctx, `SELECT hash FROM passwords WHERE user_id = ?`, userId).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errorx.Error{Code: errorx.NotFound}
+	}
+	return hash, err
+}
+
+func (s *SQLiteStore) SetPasswordHash(ctx context.Context, userId string, hash string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO passwords (user_id, hash) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET hash = excluded.hash`, userId, hash)
+	return err
+}
+
+func (s *SQLiteStore) DeletePasswordHash(ctx context.Context, userId string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM passwords WHERE user_id = ?`, userId)
+	return err
+}
+
+func (s *SQLiteStore) GetLoginAttempts(ctx context.Context, key string) (authn.LoginAttempts, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT key, failures, last_failure FROM login_attempts WHERE key = ?`, key)
+	a, err := scanLoginAttempts(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return authn.LoginAttempts{Key: key}, nil
+	}
+	return a, err
+}
+
+// RecordLoginFailure increments the counter with a single upsert, pruning the counters that have not seen any failure since resetBefore.
+func (s *SQLiteStore) RecordLoginFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (authn.LoginAttempts, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return authn.LoginAttempts{}, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM login_attempts WHERE last_failure < ?`, formatTime(resetBefore)); err != nil {
+		return authn.LoginAttempts{}, err
+	}
+	row := tx.QueryRowContext(ctx, `INSERT INTO login_attempts (key, failures, last_failure) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET failures = failures + 1, last_failure = excluded.last_failure
+		RETURNING key, failures, last_failure`, key, formatTime(at))
+	a, err := scanLoginAttempts(row)
+	if err != nil {
+		return authn.LoginAttempts{}, err
+	}
+	return a, tx.Commit()
+}
+
+func (s *SQLiteStore) ResetLoginAttempts(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM login_attempts WHERE key = ?`, key)
+	return err
+}
+
+func (s *SQLiteStore) GetMFA(ctx context.Context, userId string) (authn.MFA, error) {
+	var mfa authn.MFA
+	err := s.db.QueryRowContext(ctx, `SELECT user_id, secret, enabled, last_used_step FROM mfa WHERE user_id = ?`, userId).
+		Scan(&mfa.UserID, &mfa.Secret, &mfa.Enabled, &mfa.LastUsedStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return authn.MFA{}, errorx.Error{Code: errorx.NotFound}
+	}
+	if err != nil {
+		return authn.MFA{}, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT hash FROM mfa_recovery_codes WHERE user_id = ? ORDER BY hash`, userId)
+	if err != nil {
+		return authn.MFA{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return authn.MFA{}, err
+		}
+		mfa.RecoveryCodes = append(mfa.RecoveryCodes, hash)
+	}
+	return mfa, rows.Err()
+}
+
+// SetMFA replaces the enrollment of the user, along with all its recovery codes.
+func (s *SQLiteStore) SetMFA(ctx context.Context, mfa authn.MFA) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `INSERT INTO mfa (user_id, secret, enabled, last_used_step) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, enabled = excluded.enabled, last_used_step = excluded.last_used_step`,
+		mfa.UserID, mfa.Secret, mfa.Enabled, mfa.LastUsedStep)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = ?`, mfa.UserID); err != nil {
+		return err
+	}
+	for _, hash := range mfa.RecoveryCodes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO mfa_recovery_codes (user_id, hash) VALUES (?, ?)`, mfa.UserID, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteMFA(ctx context.Context, userId string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = ?`, userId); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa WHERE user_id = ?`, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UseTOTPStep(ctx context.Context, userId string, step int64) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE mfa SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?`, step, userId, step)
+	return expectOneRow(res, err, errorx.Conflict)
+}
+
+func (s *SQLiteStore) UseRecoveryCode(ctx context.Context, userId string, hash string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = ? AND hash = ?`, userId, hash)
+	return expectOneRow(res, err, errorx.NotFound)
+}
+
+// CreateMFAChallenge stores the challenge, pruning the challenges that have expired in the meantime.
+func (s *SQLiteStore) CreateMFAChallenge(ctx context.Context, c authn.MFAChallenge) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_challenges WHERE expires_at <= ?`, formatTime(timesource.CurrentTime())); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO mfa_challenges (hash, user_id, expires_at) VALUES (?, ?, ?) ON CONFLICT (hash) DO NOTHING`,
+		c.Hash, c.UserID, formatTime(c.ExpiresAt))
+	if err := expectOneRow(res, err, errorx.Conflict); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseMFAChallenge deletes the challenge and returns it in a single statement, so that only one of the concurrent attempts gets it.
+func (s *SQLiteStore) UseMFAChallenge(ctx context.Context, hash string) (authn.MFAChallenge, error) {
+	var (
+		c         authn.MFAChallenge
+		expiresAt string
+	)
+	err := s.db.QueryRowContext(ctx, `DELETE FROM mfa_challenges WHERE hash = ? RETURNING hash, user_id, expires_at`, hash).
+		Scan(&c.Hash, &c.UserID, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return authn.MFAChallenge{}, errorx.Error{Code: errorx.NotFound}
+	}
+	if err != nil {
+		return authn.MFAChallenge{}, err
+	}
+	if c.ExpiresAt, err = time.Parse(time.RFC3339Nano, expiresAt); err != nil {
+		return authn.MFAChallenge{}, err
+	}
+	return c, nil
+}
+
+// CreateAuthorizationCode stores the code, pruning the codes that have expired in the meantime.
+func (s *SQLiteStore) CreateAuthorizationCode(ctx context.Context, c authn.AuthorizationCode) error {
+	scopes, err := json.Marshal(c.Scopes)
+	if err != nil {
+		return err
+	}
+	amr, err := json.Marshal(c.AMR)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM authorization_codes WHERE expires_at <= ?`, formatTime(timesource.CurrentTime())); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO authorization_codes
+		(hash, client_id, user_id, redirect_uri, code_challenge, scopes, nonce, amr, auth_time, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (hash) DO NOTHING`,
+		c.Hash, c.ClientID, c.UserID, c.RedirectURI, c.CodeChallenge, string(scopes), c.Nonce, string(amr),
+		formatTime(c.AuthTime), formatTime(c.ExpiresAt))
+	if err := expectOneRow(res, err, errorx.Conflict); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseAuthorizationCode deletes the code and returns it in a single statement, so that a code can only be used once.
+func (s *SQLiteStore) UseAuthorizationCode(ctx context.Context, hash string) (authn.AuthorizationCode, error) {
+	var (
+		c                                authn.AuthorizationCode
+		scopes, amr, authTime, expiresAt string
+	)
+	err := s.db.QueryRowContext(ctx, `DELETE FROM authorization_codes WHERE hash = ?
+		RETURNING hash, client_id, user_id, redirect_uri, code_challenge, scopes, nonce, amr, auth_time, expires_at`, hash).
+		Scan(&c.Hash, &c.ClientID, &c.UserID, &c.RedirectURI, &c.CodeChallenge, &scopes, &c.Nonce, &amr, &authTime, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return authn.AuthorizationCode{}, errorx.Error{Code: errorx.NotFound}
+	}
+	if err != nil {
+		return authn.AuthorizationCode{}, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &c.Scopes); err != nil {
+		return authn.AuthorizationCode{}, err
+	}
+	if err := json.Unmarshal([]byte(amr), &c.AMR); err != nil {
+		return authn.AuthorizationCode{}, err
+	}
+	if c.AuthTime, err = time.Parse(time.RFC3339Nano, authTime); err != nil {
+		return authn.AuthorizationCode{}, err
+	}
+	if c.ExpiresAt, err = time.Parse(time.RFC3339Nano, expiresAt); err != nil {
+		return authn.AuthorizationCode{}, err
+	}
+	return c, nil
+}
+
+func scanLoginAttempts(row scanner) (authn.LoginAttempts, error) {
+	var (
+		a           authn.LoginAttempts
+		lastFailure string
+	)
+	if err := row.Scan(&a.Key, &a.Failures, &lastFailure); err != nil {
+		return authn.LoginAttempts{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, lastFailure)
+	if err != nil {
+		return authn.LoginAttempts{}, err
+	}
+	a.LastFailure = t
+	return a, nil
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row scanner) (users.User, error) {
+	var (
+		usr       users.User
+		createdAt string
+	)
+	if err := row.Scan(&usr.ID, &usr.Name, &createdAt); err != nil {
+		return users.User{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return users.User{}, err
+	}
+	usr.CreatedAt = t
+	return usr, nil
+}
+
+// formatTime uses a fixed width layout, so that the stored times can be compared as strings within the queries.
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z07:00")
+}
+
+// expectOneRow turns a write that did not affect any row into an errorx.Error with the supplied code.
+func expectOneRow(res sql.Result, err error, code errorx.Code) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errorx.Error{Code: code}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"user-service/authz"
+	"user-service/users"
+)
+
+func TestSQLiteStoreRepositories(t *testing.T) {
+	store, err := InitSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	defer store.Close()
+	testRepositories(t, store)
+}
+
+func TestSQLiteStorePersistsAcrossRestarts(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "data", "test.db")
+	store, err := InitSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	if err := seedSampleData(ctx, store); err != nil {
+		t.Fatalf("error seeding store: %v", err)
+	}
+	if _, err := users.CreateUser(ctx, store, users.User{ID: "user3", Name: "alice"}); err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("error closing store: %v", err)
+	}
+
+	// Reopening runs the migrations again, which must be a no-op, and seeding must not overwrite existing data.
+	store, err = InitSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("error reopening store: %v", err)
+	}
+	defer store.Close()
+	if err := seedSampleData(ctx, store); err != nil {
+		t.Fatalf("error seeding store: %v", err)
+	}
+
+	all, err := store.ListUsers(ctx)
+	if err != nil || len(all) != 4 {
+		t.Fatalf("expected 4 users, got %v, err %v", all, err)
+	}
+	usr, err := store.GetUser(ctx, "user3")
+	if err != nil || usr.Name != "alice" || usr.CreatedAt.IsZero() {
+		t.Errorf("unexpected user %v, err %v", usr, err)
+	}
+	roles, err := store.GetUserRoles(ctx, "client_user")
+	if err != nil || len(roles) != 1 || roles[0] != authz.RoleAdmin {
+		t.Errorf("unexpected user roles %v, err %v", roles, err)
+	}
+	authorized, err := authz.IsRoleAuthorized(ctx, store, string(authz.RoleAdmin), string(authz.ResourceUser), string(authz.PermissionDelete),
+		authz.Conditions{authz.CondKeyResourceID: authz.ResourceIDAny})
+	if err != nil || !authorized {
+		t.Errorf("expected admin to be authorized, got %v, %v", authorized, err)
+	}
+}
+
+// A datastore created before the grants were kept per resource has its single grant per role carried over.
+func TestSQLiteStoreMigratesRbacGrants(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("error opening db: %v", err)
+	}
+	db.Exec(`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY)`)
+	for i, m := range migrations[:8] {
+		if _, err := db.Exec(m); err != nil {
+			t.Fatalf("error applying migration %d: %v", i+1, err)
+		}
+		db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1)
+	}
+	if _, err := db.Exec(`INSERT INTO rbac (role, resource, permissions, conditions) VALUES ('admin', 'user', '["read","delete"]', '{"resource_id":"*"}')`); err != nil {
+		t.Fatalf("error inserting rbac: %v", err)
+	}
+	db.Close()
+
+	store, err := InitSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	defer store.Close()
+	policy, err := store.GetPolicy(ctx, authz.RoleAdmin)
+	if err != nil || len(policy.Grants) != 1 || len(policy.Grants[authz.ResourceUser].Permissions) != 2 {
+		t.Fatalf("unexpected policy %v, err %v", policy, err)
+	}
+	authorized, err := authz.IsRoleAuthorized(ctx, store, string(authz.RoleAdmin), string(authz.ResourceUser), string(authz.PermissionDelete),
+		authz.Conditions{authz.CondKeyResourceID: authz.ResourceIDAny})
+	if err != nil || !authorized {
+		t.Errorf("expected admin to be authorized, got %v, %v", authorized, err)
+	}
+}
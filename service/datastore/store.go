@@ -1,22 +1,498 @@
-// Package datastore exposes an extremely simple key-val datastore.
+// Package datastore exposes the in-memory and SQLite implementations of the typed repositories.
 package datastore
 
-// Store implements Datastore interface
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+	"user-service/authn"
+	"user-service/authz"
+	"user-service/errorx"
+	"user-service/timesource"
+	"user-service/users"
+)
+
+// Store implements Datastore interface, keeping everything in memory.
+// It is safe for concurrent use, as it is shared across all the request handling goroutines.
+// Values are copied on both read and write, so that no caller can mutate the shared state outside of the repository methods.
 type Store struct {
-	Data map[string]interface{}
+	mu        sync.RWMutex
+	users     users.UsersInDB
+	userRoles users.UserRoles
+	rbac      authz.RbacInDB
+	// refresh tokens, keyed by their hash
+	refreshTokens map[string]authn.RefreshToken
+	// deny list of revoked access tokens, with their expiry keyed by jti
+	revokedTokens map[string]time.Time
+	clients       map[string]authn.Client
+	// password hashes, keyed by user id
+	passwords map[string]string
+	// failed login attempt counters, keyed by account or IP address
+	loginAttempts map[string]authn.LoginAttempts
+	// second factor enrollments, keyed by user id
+	mfa map[string]authn.MFA
+	// MFA challenges, keyed by their hash
+	mfaChallenges map[string]authn.MFAChallenge
+	// authorization codes, keyed by their hash
+	authorizationCodes map[string]authn.AuthorizationCode
+}
+
+func InitStore() *Store {
+	return &Store{
+		users:              users.UsersInDB{},
+		userRoles:          users.UserRoles{},
+		rbac:               authz.RbacInDB{},
+		refreshTokens:      map[string]authn.RefreshToken{},
+		revokedTokens:      map[string]time.Time{},
+		clients:            map[string]authn.Client{},
+		passwords:          map[string]string{},
+		loginAttempts:      map[string]authn.LoginAttempts{},
+		mfa:                map[string]authn.MFA{},
+		mfaChallenges:      map[string]authn.MFAChallenge{},
+		authorizationCodes: map[string]authn.AuthorizationCode{},
+	}
+}
+
+func (s *Store) GetUser(ctx context.Context, id users.UserID) (users.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	usr, ok := s.users[id]
+	if !ok {
+		return users.User{}, errorx.Error{Code: errorx.NotFound}
+	}
+	return usr, nil
 }
 
-func (s *Store) Get(key string) interface{} {
-	return s.Data[key]
+func (s *Store) ListUsers(ctx context.Context) ([]users.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]users.User, 0, len(s.users))
+	for _, usr := range s.users {
+		res = append(res, usr)
+	}
+	return res, nil
+}
+
+func (s *Store) ListUsersPage(ctx context.Context, q users.UserQuery) ([]users.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := []users.User{}
+	for _, usr := range s.users {
+		if q.Matches(usr) {
+			res = append(res, usr)
+		}
+	}
+	slices.SortFunc(res, q.Compare)
+	if len(res) > q.Limit {
+		res = res[:q.Limit]
+	}
+	return res, nil
 }
 
-func (s *Store) Set(key string, val interface{}) error {
-	s.Data[key] = val
+func (s *Store) CreateUser(ctx context.Context, usr users.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[usr.ID]; ok {
+		return errorx.Error{Code: errorx.Conflict}
+	}
+	s.users[usr.ID] = usr
 	return nil
 }
 
-func InitStore() *Store {
-	return &Store{
-		Data: map[string]interface{}{},
+func (s *Store) UpdateUser(ctx context.Context, id users.UserID, update func(users.User) (users.User, error)) (users.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usr, ok := s.users[id]
+	if !ok {
+		return users.User{}, errorx.Error{Code: errorx.NotFound}
+	}
+	usr, err := update(usr)
+	if err != nil {
+		return users.User{}, err
+	}
+	usr.ID = id
+	s.users[id] = usr
+	return usr, nil
+}
+
+// DeleteUser removes the user along with its roles and credentials, and revokes its refresh tokens, all under the one lock.
+func (s *Store) DeleteUser(ctx context.Context, id users.UserID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[id]; !ok {
+		return errorx.Error{Code: errorx.NotFound}
+	}
+	delete(s.users, id)
+	delete(s.userRoles, id)
+	delete(s.passwords, string(id))
+	delete(s.mfa, string(id))
+	for hash, rt := range s.refreshTokens {
+		if rt.UserID == string(id) {
+			rt.Revoked = true
+			s.refreshTokens[hash] = rt
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetUserRoles(ctx context.Context, id users.UserID) ([]authz.Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.userRoles[id]), nil
+}
+
+func (s *Store) SetUserRoles(ctx context.Context, id users.UserID, roles []authz.Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userRoles[id] = slices.Clone(roles)
+	return nil
+}
+
+func (s *Store) DeleteUserRoles(ctx context.Context, id users.UserID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.userRoles, id)
+	return nil
+}
+
+func (s *Store) GetPolicy(ctx context.Context, role authz.Role) (authz.Policy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.rbac[role]
+	if !ok {
+		return authz.Policy{}, errorx.Error{Code: errorx.NotFound}
+	}
+	return p.Clone(), nil
+}
+
+func (s *Store) SetGrant(ctx context.Context, ar authz.AccessRights) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.rbac[ar.Role]
+	if !ok {
+		p = authz.Policy{Role: ar.Role, Grants: map[authz.Resource]authz.AccessRights{}}
+		s.rbac[ar.Role] = p
+	}
+	p.Grants[ar.Resource] = ar.Clone()
+	return nil
+}
+
+func (s *Store) SetRoleParents(ctx context.Context, role authz.Role, parents []authz.Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.rbac[role]
+	if !ok {
+		p = authz.Policy{Role: role, Grants: map[authz.Resource]authz.AccessRights{}}
+	}
+	p.Parents = slices.Clone(parents)
+	s.rbac[role] = p
+	return nil
+}
+
+func (s *Store) CreateRefreshToken(ctx context.Context, rt authn.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.refreshTokens[rt.Hash]; ok {
+		return errorx.Error{Code: errorx.Conflict}
+	}
+	s.refreshTokens[rt.Hash] = cloneRefreshToken(rt)
+	return nil
+}
+
+func (s *Store) GetRefreshToken(ctx context.Context, hash string) (authn.RefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rt, ok := s.refreshTokens[hash]
+	if !ok {
+		return authn.RefreshToken{}, errorx.Error{Code: errorx.NotFound}
+	}
+	return cloneRefreshToken(rt), nil
+}
+
+func (s *Store) UseRefreshToken(ctx context.Context, hash string) (authn.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.refreshTokens[hash]
+	if !ok {
+		return authn.RefreshToken{}, errorx.Error{Code: errorx.NotFound}
+	}
+	used := rt
+	used.Used = true
+	s.refreshTokens[hash] = used
+	return cloneRefreshToken(rt), nil
+}
+
+func cloneRefreshToken(rt authn.RefreshToken) authn.RefreshToken {
+	rt.AMR = slices.Clone(rt.AMR)
+	return rt
+}
+
+func (s *Store) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, rt := range s.refreshTokens {
+		if rt.FamilyID == familyID {
+			rt.Revoked = true
+			s.refreshTokens[hash] = rt
+		}
+	}
+	return nil
+}
+
+func (s *Store) RevokeUserRefreshTokens(ctx context.Context, userId string, amr ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, rt := range s.refreshTokens {
+		if rt.UserID == userId && containsAll(rt.AMR, amr) {
+			rt.Revoked = true
+			s.refreshTokens[hash] = rt
+		}
+	}
+	return nil
+}
+
+// containsAll reports whether all the wanted values are in the list.
+func containsAll(list, wanted []string) bool {
+	for _, v := range wanted {
+		if !slices.Contains(list, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) UserExists(ctx context.Context, userId string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.users[users.UserID(userId)]
+	return ok, nil
+}
+
+// RevokeToken adds the token to the deny list, pruning the entries of the tokens that have expired on their own in the meantime.
+func (s *Store) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := timesource.CurrentTime()
+	for id, exp := range s.revokedTokens {
+		if !now.Before(exp) {
+			delete(s.revokedTokens, id)
+		}
 	}
+	s.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+func (s *Store) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.revokedTokens[jti]
+	return ok, nil
+}
+
+func (s *Store) GetClient(ctx context.Context, id string) (authn.Client, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.clients[id]
+	if !ok {
+		return authn.Client{}, errorx.Error{Code: errorx.NotFound}
+	}
+	return cloneClient(c), nil
+}
+
+func (s *Store) CreateClient(ctx context.Context, c authn.Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[c.ID]; ok {
+		return errorx.Error{Code: errorx.Conflict}
+	}
+	s.clients[c.ID] = cloneClient(c)
+	return nil
+}
+
+func cloneClient(c authn.Client) authn.Client {
+	c.Scopes = slices.Clone(c.Scopes)
+	c.Audiences = slices.Clone(c.Audiences)
+	c.RedirectURIs = slices.Clone(c.RedirectURIs)
+	return c
+}
+
+func (s *Store) GetPasswordHash(ctx context.Context, userId string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hash, ok := s.passwords[userId]
+	if !ok {
+		return "", errorx.Error{Code: errorx.NotFound}
+	}
+	return hash, nil
+}
+
+func (s *Store) SetPasswordHash(ctx context.Context, userId string, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwords[userId] = hash
+	return nil
+}
+
+func (s *Store) DeletePasswordHash(ctx context.Context, userId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.passwords, userId)
+	return nil
+}
+
+func (s *Store) GetLoginAttempts(ctx context.Context, key string) (authn.LoginAttempts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.loginAttempts[key]
+	if !ok {
+		return authn.LoginAttempts{Key: key}, nil
+	}
+	return a, nil
+}
+
+// RecordLoginFailure increments the counter, pruning the counters that have not seen any failure since resetBefore.
+func (s *Store) RecordLoginFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (authn.LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, a := range s.loginAttempts {
+		if a.LastFailure.Before(resetBefore) {
+			delete(s.loginAttempts, k)
+		}
+	}
+	a := s.loginAttempts[key]
+	a.Key = key
+	a.Failures++
+	a.LastFailure = at
+	s.loginAttempts[key] = a
+	return a, nil
+}
+
+func (s *Store) ResetLoginAttempts(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.loginAttempts, key)
+	return nil
+}
+
+func (s *Store) GetMFA(ctx context.Context, userId string) (authn.MFA, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	mfa, ok := s.mfa[userId]
+	if !ok {
+		return authn.MFA{}, errorx.Error{Code: errorx.NotFound}
+	}
+	return cloneMFA(mfa), nil
+}
+
+func (s *Store) SetMFA(ctx context.Context, mfa authn.MFA) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mfa[mfa.UserID] = cloneMFA(mfa)
+	return nil
+}
+
+func (s *Store) DeleteMFA(ctx context.Context, userId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mfa, userId)
+	return nil
+}
+
+func (s *Store) UseTOTPStep(ctx context.Context, userId string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mfa, ok := s.mfa[userId]
+	if !ok {
+		return errorx.Error{Code: errorx.NotFound}
+	}
+	if step <= mfa.LastUsedStep {
+		return errorx.Error{Code: errorx.Conflict}
+	}
+	mfa.LastUsedStep = step
+	s.mfa[userId] = mfa
+	return nil
+}
+
+func (s *Store) UseRecoveryCode(ctx context.Context, userId string, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mfa, ok := s.mfa[userId]
+	if !ok {
+		return errorx.Error{Code: errorx.NotFound}
+	}
+	i := slices.Index(mfa.RecoveryCodes, hash)
+	if i < 0 {
+		return errorx.Error{Code: errorx.NotFound}
+	}
+	mfa.RecoveryCodes = slices.Delete(slices.Clone(mfa.RecoveryCodes), i, i+1)
+	s.mfa[userId] = mfa
+	return nil
+}
+
+func cloneMFA(mfa authn.MFA) authn.MFA {
+	mfa.RecoveryCodes = slices.Clone(mfa.RecoveryCodes)
+	return mfa
+}
+
+// CreateMFAChallenge stores the challenge, pruning the challenges that have expired in the meantime.
+func (s *Store) CreateMFAChallenge(ctx context.Context, c authn.MFAChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := timesource.CurrentTime()
+	for hash, other := range s.mfaChallenges {
+		if !now.Before(other.ExpiresAt) {
+			delete(s.mfaChallenges, hash)
+		}
+	}
+	if _, ok := s.mfaChallenges[c.Hash]; ok {
+		return errorx.Error{Code: errorx.Conflict}
+	}
+	s.mfaChallenges[c.Hash] = c
+	return nil
+}
+
+func (s *Store) UseMFAChallenge(ctx context.Context, hash string) (authn.MFAChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.mfaChallenges[hash]
+	if !ok {
+		return authn.MFAChallenge{}, errorx.Error{Code: errorx.NotFound}
+	}
+	delete(s.mfaChallenges, hash)
+	return c, nil
+}
+
+// CreateAuthorizationCode stores the code, pruning the codes that have expired in the meantime.
+func (s *Store) CreateAuthorizationCode(ctx context.Context, c authn.AuthorizationCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := timesource.CurrentTime()
+	for hash, other := range s.authorizationCodes {
+		if !now.Before(other.ExpiresAt) {
+			delete(s.authorizationCodes, hash)
+		}
+	}
+	if _, ok := s.authorizationCodes[c.Hash]; ok {
+		return errorx.Error{Code: errorx.Conflict}
+	}
+	s.authorizationCodes[c.Hash] = cloneAuthorizationCode(c)
+	return nil
+}
+
+func (s *Store) UseAuthorizationCode(ctx context.Context, hash string) (authn.AuthorizationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.authorizationCodes[hash]
+	if !ok {
+		return authn.AuthorizationCode{}, errorx.Error{Code: errorx.NotFound}
+	}
+	delete(s.authorizationCodes, hash)
+	return c, nil
+}
+
+func cloneAuthorizationCode(c authn.AuthorizationCode) authn.AuthorizationCode {
+	c.Scopes = slices.Clone(c.Scopes)
+	c.AMR = slices.Clone(c.AMR)
+	return c
 }
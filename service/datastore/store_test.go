@@ -0,0 +1,497 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"user-service/authn"
+	"user-service/authz"
+	"user-service/commons"
+	"user-service/errorx"
+	"user-service/users"
+)
+
+func isCode(err error, code errorx.Code) bool {
+	var e errorx.Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// testRepositories checks the behavior that is expected from every Datastore implementation.
+func testRepositories(t *testing.T, store commons.Datastore) {
+	ctx := context.Background()
+
+	if _, err := store.GetUser(ctx, "user1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	usr := users.User{ID: "user1", Name: "john.doe"}
+	if err := store.CreateUser(ctx, usr); err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+	if err := store.CreateUser(ctx, usr); !isCode(err, errorx.Conflict) {
+		t.Errorf("expected conflict, got %v", err)
+	}
+	rename := func(name string) func(users.User) (users.User, error) {
+		return func(usr users.User) (users.User, error) {
+			usr.Name = name
+			return usr, nil
+		}
+	}
+	if got, err := store.UpdateUser(ctx, "user1", rename("jane.doe")); err != nil || got.Name != "jane.doe" || got.ID != "user1" {
+		t.Errorf("unexpected updated user %v, err %v", got, err)
+	}
+	if got, err := store.GetUser(ctx, "user1"); err != nil || got.Name != "jane.doe" {
+		t.Errorf("unexpected user %v, err %v", got, err)
+	}
+	if _, err := store.UpdateUser(ctx, "nobody", rename("x")); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	// A failed update leaves the user unchanged
+	failed := errorx.Error{Code: errorx.BadRequestData}
+	if _, err := store.UpdateUser(ctx, "user1", func(users.User) (users.User, error) { return users.User{}, failed }); !isCode(err, errorx.BadRequestData) {
+		t.Errorf("expected the error of the update, got %v", err)
+	}
+	// Concurrent updates are applied one after the other, so none of them is lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.UpdateUser(ctx, "user1", func(usr users.User) (users.User, error) {
+				usr.Name += "+"
+				return usr, nil
+			})
+		}()
+	}
+	wg.Wait()
+	if got, err := store.GetUser(ctx, "user1"); err != nil || got.Name != "jane.doe++++++++++" {
+		t.Errorf("expected all the concurrent updates to be applied, got %v, err %v", got, err)
+	}
+	if all, err := store.ListUsers(ctx); err != nil || len(all) != 1 {
+		t.Errorf("unexpected users %v, err %v", all, err)
+	}
+	if exists, err := store.UserExists(ctx, "user1"); err != nil || !exists {
+		t.Errorf("expected the user to exist, got %v, err %v", exists, err)
+	}
+	if err := store.DeleteUser(ctx, "user1"); err != nil {
+		t.Errorf("error deleting user: %v", err)
+	}
+	if exists, err := store.UserExists(ctx, "user1"); err != nil || exists {
+		t.Errorf("expected the user not to exist, got %v, err %v", exists, err)
+	}
+	if err := store.DeleteUser(ctx, "user1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	// The pages of the listing are selected, ordered and limited by the repository
+	created := time.Date(2025, 3, 15, 10, 0, 0, 0, time.UTC)
+	for i, u := range []users.User{{ID: "u1", Name: "bob"}, {ID: "u2", Name: "alice"}, {ID: "u3", Name: "alicia"}, {ID: "u4", Name: "Alice"}} {
+		u.CreatedAt = created.Add(-time.Duration(i) * time.Second)
+		if err := store.CreateUser(ctx, u); err != nil {
+			t.Fatalf("error creating user: %v", err)
+		}
+	}
+	ids := func(q users.UserQuery) string {
+		page, err := store.ListUsersPage(ctx, q)
+		if err != nil {
+			t.Errorf("error listing users: %v", err)
+		}
+		res := []users.UserID{}
+		for _, u := range page {
+			res = append(res, u.ID)
+		}
+		return fmt.Sprint(res)
+	}
+	pages := []struct {
+		q    users.UserQuery
+		want string
+	}{
+		{users.UserQuery{SortBy: users.SortByID, Limit: 10}, "[u1 u2 u3 u4]"},
+		{users.UserQuery{SortBy: users.SortByID, Limit: 2, ExcludeID: "u1"}, "[u2 u3]"},
+		{users.UserQuery{SortBy: users.SortByID, Limit: 10, Desc: true, After: &users.UserPosition{Key: "u3", ID: "u3"}}, "[u2 u1]"},
+		{users.UserQuery{SortBy: users.SortByUsername, Limit: 10}, "[u4 u2 u3 u1]"},
+		{users.UserQuery{SortBy: users.SortByUsername, Limit: 10, UsernamePrefix: "ali"}, "[u2 u3]"},
+		{users.UserQuery{SortBy: users.SortByUsername, Limit: 10, After: &users.UserPosition{Key: "alice", ID: "u2"}}, "[u3 u1]"},
+		{users.UserQuery{SortBy: users.SortByCreatedAt, Limit: 3}, "[u4 u3 u2]"},
+		{users.UserQuery{SortBy: users.SortByCreatedAt, Limit: 10, Desc: true, After: &users.UserPosition{Key: users.SortKey(users.User{CreatedAt: created}, users.SortByCreatedAt), ID: "u1"}}, "[u2 u3 u4]"},
+	}
+	for _, p := range pages {
+		if got := ids(p.q); got != p.want {
+			t.Errorf("unexpected page %v for %+v, want %v", got, p.q, p.want)
+		}
+	}
+	for _, id := range []users.UserID{"u1", "u2", "u3", "u4"} {
+		store.DeleteUser(ctx, id)
+	}
+
+	if roles, err := store.GetUserRoles(ctx, "user1"); err != nil || len(roles) != 0 {
+		t.Errorf("expected no roles, got %v, err %v", roles, err)
+	}
+	if err := store.SetUserRoles(ctx, "user1", []authz.Role{authz.RoleViewer, authz.RoleAdmin}); err != nil {
+		t.Errorf("error setting roles: %v", err)
+	}
+	if roles, err := store.GetUserRoles(ctx, "user1"); err != nil || fmt.Sprint(roles) != "[viewer admin]" {
+		t.Errorf("unexpected roles %v, err %v", roles, err)
+	}
+	if err := store.DeleteUserRoles(ctx, "user1"); err != nil {
+		t.Errorf("error deleting roles: %v", err)
+	}
+	if roles, _ := store.GetUserRoles(ctx, "user1"); len(roles) != 0 {
+		t.Errorf("expected no roles, got %v", roles)
+	}
+
+	if _, err := store.GetPolicy(ctx, authz.RoleViewer); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	ar := authz.AccessRights{
+		Role:        authz.RoleViewer,
+		Resource:    authz.ResourceUser,
+		Permissions: []authz.Permission{authz.PermissionRead},
+		Conditions:  authz.Conditions{authz.CondKeyResourceID: authz.ResourceIDAny},
+	}
+	if err := store.SetGrant(ctx, ar); err != nil {
+		t.Errorf("error setting grant: %v", err)
+	}
+	got, err := store.GetPolicy(ctx, authz.RoleViewer)
+	if err != nil || got.Role != authz.RoleViewer || len(got.Grants) != 1 || got.Grants[authz.ResourceUser].Permissions[0] != authz.PermissionRead ||
+		got.Grants[authz.ResourceUser].Conditions[authz.CondKeyResourceID] != authz.ResourceIDAny {
+		t.Errorf("unexpected policy %v, err %v", got, err)
+	}
+	// A role holds a grant per resource, and setting a grant on the same resource replaces it
+	clients := authz.AccessRights{Role: authz.RoleViewer, Resource: "client", Permissions: []authz.Permission{authz.PermissionRead}}
+	if err := store.SetGrant(ctx, clients); err != nil {
+		t.Errorf("error setting grant: %v", err)
+	}
+	ar.Permissions = []authz.Permission{authz.PermissionRead, authz.PermissionUpdate}
+	if err := store.SetGrant(ctx, ar); err != nil {
+		t.Errorf("error setting grant: %v", err)
+	}
+	got, err = store.GetPolicy(ctx, authz.RoleViewer)
+	if err != nil || len(got.Grants) != 2 || got.Grants["client"].Resource != "client" || len(got.Grants[authz.ResourceUser].Permissions) != 2 {
+		t.Errorf("unexpected policy %v, err %v", got, err)
+	}
+	// A role with parents only exists as well, and its parents are kept in order
+	if err := store.SetRoleParents(ctx, authz.RoleAdmin, []authz.Role{"editor", authz.RoleViewer}); err != nil {
+		t.Errorf("error setting parents: %v", err)
+	}
+	if got, err := store.GetPolicy(ctx, authz.RoleAdmin); err != nil || len(got.Grants) != 0 || fmt.Sprint(got.Parents) != "[editor viewer]" {
+		t.Errorf("unexpected policy %v, err %v", got, err)
+	}
+	store.SetRoleParents(ctx, authz.RoleAdmin, []authz.Role{authz.RoleViewer})
+	if got, _ := store.GetPolicy(ctx, authz.RoleAdmin); fmt.Sprint(got.Parents) != "[viewer]" {
+		t.Errorf("expected the parents to be replaced, got %v", got.Parents)
+	}
+	if got, _ := store.GetPolicy(ctx, authz.RoleViewer); len(got.Parents) != 0 {
+		t.Errorf("expected no parents for viewer, got %v", got.Parents)
+	}
+
+	rt := authn.RefreshToken{Hash: "hash1", FamilyID: "family1", UserID: "user1", ExpiresAt: time.Now().Add(time.Hour), AMR: []string{"pwd"}}
+	if err := store.CreateRefreshToken(ctx, rt); err != nil {
+		t.Errorf("error creating refresh token: %v", err)
+	}
+	store.CreateRefreshToken(ctx, authn.RefreshToken{Hash: "hash2", FamilyID: "family1", UserID: "user1", ExpiresAt: rt.ExpiresAt})
+	if used, err := store.UseRefreshToken(ctx, "hash1"); err != nil || used.Used || used.UserID != "user1" || !used.ExpiresAt.Equal(rt.ExpiresAt) ||
+		fmt.Sprint(used.AMR) != "[pwd]" {
+		t.Errorf("unexpected refresh token %v, err %v", used, err)
+	}
+	if used, err := store.UseRefreshToken(ctx, "hash1"); err != nil || !used.Used {
+		t.Errorf("expected the refresh token to be marked as used, got %v, err %v", used, err)
+	}
+	if err := store.RevokeRefreshTokenFamily(ctx, "family1"); err != nil {
+		t.Errorf("error revoking refresh token family: %v", err)
+	}
+	if used, err := store.UseRefreshToken(ctx, "hash2"); err != nil || !used.Revoked {
+		t.Errorf("expected the refresh token to be revoked, got %v, err %v", used, err)
+	}
+	if _, err := store.UseRefreshToken(ctx, "nope"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if got, err := store.GetRefreshToken(ctx, "hash2"); err != nil || !got.Revoked || got.FamilyID != "family1" {
+		t.Errorf("unexpected refresh token %v, err %v", got, err)
+	}
+	store.CreateRefreshToken(ctx, authn.RefreshToken{Hash: "hash3", FamilyID: "family2", UserID: "user1", ExpiresAt: rt.ExpiresAt})
+	store.CreateRefreshToken(ctx, authn.RefreshToken{Hash: "hash4", FamilyID: "family3", UserID: "user2", ExpiresAt: rt.ExpiresAt})
+	store.CreateRefreshToken(ctx, authn.RefreshToken{Hash: "hash5", FamilyID: "family4", UserID: "user2", ExpiresAt: rt.ExpiresAt, AMR: []string{"pwd", "otp", "mfa"}})
+	if err := store.RevokeUserRefreshTokens(ctx, "user2", "mfa"); err != nil {
+		t.Errorf("error revoking the user's refresh tokens: %v", err)
+	}
+	if got, err := store.GetRefreshToken(ctx, "hash5"); err != nil || !got.Revoked {
+		t.Errorf("expected the refresh token with the amr to be revoked, got %v, err %v", got, err)
+	}
+	if err := store.RevokeUserRefreshTokens(ctx, "user1"); err != nil {
+		t.Errorf("error revoking the user's refresh tokens: %v", err)
+	}
+	if got, err := store.GetRefreshToken(ctx, "hash3"); err != nil || !got.Revoked {
+		t.Errorf("expected the refresh token to be revoked, got %v, err %v", got, err)
+	}
+	if got, err := store.GetRefreshToken(ctx, "hash4"); err != nil || got.Revoked {
+		t.Errorf("expected the refresh token of another user to be unaffected, got %v, err %v", got, err)
+	}
+
+	if revoked, err := store.IsTokenRevoked(ctx, "jti1"); err != nil || revoked {
+		t.Errorf("expected the token not to be revoked, got %v, err %v", revoked, err)
+	}
+	store.RevokeToken(ctx, "expired", time.Now().Add(-time.Minute))
+	if err := store.RevokeToken(ctx, "jti1", time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("error revoking token: %v", err)
+	}
+	if revoked, err := store.IsTokenRevoked(ctx, "jti1"); err != nil || !revoked {
+		t.Errorf("expected the token to be revoked, got %v, err %v", revoked, err)
+	}
+	// Entries of already expired tokens are pruned
+	if revoked, _ := store.IsTokenRevoked(ctx, "expired"); revoked {
+		t.Error("expected the expired entry to be pruned")
+	}
+
+	if _, err := store.GetClient(ctx, "client1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	client := authn.Client{ID: "client1", SecretHash: "hash", Scopes: []string{"users:read"}, Audiences: []string{"client1", "reports"},
+		RedirectURIs: []string{"https://app.example.com/callback"}, Public: true}
+	if err := store.CreateClient(ctx, client); err != nil {
+		t.Errorf("error creating client: %v", err)
+	}
+	if err := store.CreateClient(ctx, client); !isCode(err, errorx.Conflict) {
+		t.Errorf("expected conflict, got %v", err)
+	}
+	if got, err := store.GetClient(ctx, "client1"); err != nil || fmt.Sprint(got) != fmt.Sprint(client) {
+		t.Errorf("expected %v, got %v, err %v", client, got, err)
+	}
+	if _, err := store.GetPasswordHash(ctx, "user1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	store.SetPasswordHash(ctx, "user1", "hash1")
+	if err := store.SetPasswordHash(ctx, "user1", "hash2"); err != nil {
+		t.Errorf("error setting password hash: %v", err)
+	}
+	if got, err := store.GetPasswordHash(ctx, "user1"); err != nil || got != "hash2" {
+		t.Errorf("expected hash2, got %q, err %v", got, err)
+	}
+	if err := store.DeletePasswordHash(ctx, "user1"); err != nil {
+		t.Errorf("error deleting password hash: %v", err)
+	}
+	if _, err := store.GetPasswordHash(ctx, "user1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	now := time.Now().UTC()
+	if got, err := store.GetLoginAttempts(ctx, "user:user1"); err != nil || got.Failures != 0 {
+		t.Errorf("expected no failures, got %v, err %v", got, err)
+	}
+	store.RecordLoginFailure(ctx, "user:user1", now.Add(-2*time.Hour), now.Add(-3*time.Hour))
+	store.RecordLoginFailure(ctx, "ip:192.0.2.1", now.Add(-2*time.Hour), now.Add(-3*time.Hour))
+	if got, err := store.RecordLoginFailure(ctx, "user:user1", now.Add(-time.Hour), now.Add(-3*time.Hour)); err != nil || got.Failures != 2 {
+		t.Errorf("expected 2 failures, got %v, err %v", got, err)
+	}
+	// The failures before resetBefore are forgotten
+	attempts, err := store.RecordLoginFailure(ctx, "user:user1", now, now.Add(-30*time.Minute))
+	if err != nil || attempts.Key != "user:user1" || attempts.Failures != 1 || !attempts.LastFailure.Equal(now) {
+		t.Errorf("expected a single failure at %v, got %v, err %v", now, attempts, err)
+	}
+	if got, err := store.GetLoginAttempts(ctx, "ip:192.0.2.1"); err != nil || got.Failures != 0 {
+		t.Errorf("expected the stale counter to be pruned, got %v, err %v", got, err)
+	}
+	if err := store.ResetLoginAttempts(ctx, "user:user1"); err != nil {
+		t.Errorf("error resetting login attempts: %v", err)
+	}
+	if got, err := store.GetLoginAttempts(ctx, "user:user1"); err != nil || got.Failures != 0 {
+		t.Errorf("expected no failures, got %v, err %v", got, err)
+	}
+
+	if _, err := store.GetMFA(ctx, "user1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	mfa := authn.MFA{UserID: "user1", Secret: "SECRET", Enabled: true, LastUsedStep: 10, RecoveryCodes: []string{"code1", "code2"}}
+	if err := store.SetMFA(ctx, mfa); err != nil {
+		t.Errorf("error setting MFA: %v", err)
+	}
+	if err := store.UseTOTPStep(ctx, "user1", 10); !isCode(err, errorx.Conflict) {
+		t.Errorf("expected conflict for a used step, got %v", err)
+	}
+	if err := store.UseTOTPStep(ctx, "user1", 11); err != nil {
+		t.Errorf("error using TOTP step: %v", err)
+	}
+	if err := store.UseRecoveryCode(ctx, "user1", "code1"); err != nil {
+		t.Errorf("error using recovery code: %v", err)
+	}
+	if err := store.UseRecoveryCode(ctx, "user1", "code1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found for a used recovery code, got %v", err)
+	}
+	mfa.LastUsedStep, mfa.RecoveryCodes = 11, []string{"code2"}
+	if got, err := store.GetMFA(ctx, "user1"); err != nil || fmt.Sprint(got) != fmt.Sprint(mfa) {
+		t.Errorf("expected %v, got %v, err %v", mfa, got, err)
+	}
+	if err := store.DeleteMFA(ctx, "user1"); err != nil {
+		t.Errorf("error deleting MFA: %v", err)
+	}
+	if _, err := store.GetMFA(ctx, "user1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	challenge := authn.MFAChallenge{Hash: "challenge1", UserID: "user1", ExpiresAt: now.Add(time.Minute)}
+	store.CreateMFAChallenge(ctx, authn.MFAChallenge{Hash: "expired", UserID: "user1", ExpiresAt: now.Add(-time.Minute)})
+	if err := store.CreateMFAChallenge(ctx, challenge); err != nil {
+		t.Errorf("error creating MFA challenge: %v", err)
+	}
+	if _, err := store.UseMFAChallenge(ctx, "expired"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected the expired challenge to be pruned, got %v", err)
+	}
+	// A challenge can only be used once, even by concurrent attempts
+	usedOnce := make(chan bool, 10)
+	var uses sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		uses.Add(1)
+		go func() {
+			defer uses.Done()
+			got, err := store.UseMFAChallenge(ctx, "challenge1")
+			if err == nil && (got.UserID != "user1" || !got.ExpiresAt.Equal(challenge.ExpiresAt)) {
+				t.Errorf("unexpected MFA challenge %v", got)
+			}
+			usedOnce <- err == nil
+		}()
+	}
+	uses.Wait()
+	close(usedOnce)
+	n := 0
+	for ok := range usedOnce {
+		if ok {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected the challenge to be used once, got %d", n)
+	}
+
+	code := authn.AuthorizationCode{Hash: "code1", ClientID: "client1", UserID: "user1", RedirectURI: "https://app.example.com/callback",
+		CodeChallenge: "challenge", Scopes: []string{"openid"}, Nonce: "nonce", AMR: []string{authn.AMRPassword},
+		AuthTime: now, ExpiresAt: now.Add(time.Minute)}
+	store.CreateAuthorizationCode(ctx, authn.AuthorizationCode{Hash: "expired", ExpiresAt: now.Add(-time.Minute)})
+	if err := store.CreateAuthorizationCode(ctx, code); err != nil {
+		t.Errorf("error creating authorization code: %v", err)
+	}
+	if err := store.CreateAuthorizationCode(ctx, code); !isCode(err, errorx.Conflict) {
+		t.Errorf("expected conflict, got %v", err)
+	}
+	if _, err := store.UseAuthorizationCode(ctx, "expired"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected the expired code to be pruned, got %v", err)
+	}
+	used, err := store.UseAuthorizationCode(ctx, "code1")
+	if err != nil || fmt.Sprint(used.Scopes, used.AMR, used.Nonce, used.CodeChallenge) != fmt.Sprint(code.Scopes, code.AMR, code.Nonce, code.CodeChallenge) ||
+		!used.AuthTime.Equal(code.AuthTime) || !used.ExpiresAt.Equal(code.ExpiresAt) {
+		t.Errorf("unexpected authorization code %v, err %v", used, err)
+	}
+	if _, err := store.UseAuthorizationCode(ctx, "code1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected a used code to be gone, got %v", err)
+	}
+
+	// Deleting a user takes its roles and credentials along, and revokes its refresh tokens
+	store.CreateUser(ctx, users.User{ID: "deleted1", Name: "deleted.user", CreatedAt: now})
+	store.SetUserRoles(ctx, "deleted1", []authz.Role{authz.RoleViewer})
+	store.SetPasswordHash(ctx, "deleted1", "hash")
+	store.SetMFA(ctx, authn.MFA{UserID: "deleted1", Secret: "SECRET", Enabled: true, RecoveryCodes: []string{"code1"}})
+	store.CreateRefreshToken(ctx, authn.RefreshToken{Hash: "deleted1-hash", FamilyID: "deleted1-family", UserID: "deleted1", ExpiresAt: now.Add(time.Hour)})
+	if err := store.DeleteUser(ctx, "deleted1"); err != nil {
+		t.Errorf("error deleting user: %v", err)
+	}
+	if roles, err := store.GetUserRoles(ctx, "deleted1"); err != nil || len(roles) != 0 {
+		t.Errorf("expected no roles, got %v, err %v", roles, err)
+	}
+	if _, err := store.GetPasswordHash(ctx, "deleted1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected the password to be gone, got %v", err)
+	}
+	if _, err := store.GetMFA(ctx, "deleted1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected the MFA enrollment to be gone, got %v", err)
+	}
+	if err := store.UseRecoveryCode(ctx, "deleted1", "code1"); !isCode(err, errorx.NotFound) {
+		t.Errorf("expected the recovery codes to be gone, got %v", err)
+	}
+	if got, err := store.GetRefreshToken(ctx, "deleted1-hash"); err != nil || !got.Revoked {
+		t.Errorf("expected the refresh token to be revoked, got %v, err %v", got, err)
+	}
+}
+
+// seedSampleData seeds the rbac policy and the sample users, the latter without a password.
+func seedSampleData(ctx context.Context, store interface {
+	users.Store
+	authz.PolicyRepository
+}) error {
+	if err := users.InitPolicyData(ctx, store); err != nil {
+		return err
+	}
+	return users.InitStoreData(ctx, store, "", "", nil)
+}
+
+func TestStoreRepositories(t *testing.T) {
+	testRepositories(t, InitStore())
+}
+
+func TestStoreReturnsCopies(t *testing.T) {
+	ctx := context.Background()
+	store := InitStore()
+	if err := seedSampleData(ctx, store); err != nil {
+		t.Fatalf("error seeding store: %v", err)
+	}
+
+	roles, _ := store.GetUserRoles(ctx, "client_user")
+	roles[0] = authz.RoleViewer
+	if roles, _ := store.GetUserRoles(ctx, "client_user"); roles[0] != authz.RoleAdmin {
+		t.Error("mutating the result of GetUserRoles changed the stored user roles")
+	}
+
+	policy, _ := store.GetPolicy(ctx, authz.RoleViewer)
+	policy.Grants[authz.ResourceUser].Permissions[0] = authz.PermissionDelete
+	policy.Grants[authz.ResourceUser].Conditions[authz.CondKeyResourceID] = "user1"
+	delete(policy.Grants, authz.ResourceUser)
+	stored, _ := store.GetPolicy(ctx, authz.RoleViewer)
+	if ar, ok := stored.Grants[authz.ResourceUser]; !ok || ar.Permissions[0] != authz.PermissionRead || ar.Conditions[authz.CondKeyResourceID] != authz.ResourceIDAny {
+		t.Error("mutating the result of GetPolicy changed the stored rbac")
+	}
+
+	// The values passed to the setters are copied as well
+	roles = []authz.Role{authz.RoleViewer}
+	store.SetUserRoles(ctx, "user1", roles)
+	roles[0] = authz.RoleAdmin
+	if roles, _ := store.GetUserRoles(ctx, "user1"); roles[0] != authz.RoleViewer {
+		t.Error("mutating the value after SetUserRoles changed the stored user roles")
+	}
+}
+
+// TestStoreConcurrentAccess is meant to be run with the race detector, i.e. go test -race.
+func TestStoreConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	store := InitStore()
+	if err := seedSampleData(ctx, store); err != nil {
+		t.Fatalf("error seeding store: %v", err)
+	}
+
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			id := fmt.Sprintf("user-%d", i)
+			if _, err := users.CreateUser(ctx, store, users.User{ID: users.UserID(id), Name: id}); err != nil {
+				t.Errorf("error creating user: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := users.FetchUsersFilterOne(ctx, store, "client_user", users.ListOptions{}); err != nil {
+				t.Errorf("error fetching users: %v", err)
+			}
+			if _, err := authz.IsRoleAuthorized(ctx, store, string(authz.RoleViewer), string(authz.ResourceUser), string(authz.PermissionRead),
+				authz.Conditions{authz.CondKeyResourceID: authz.ResourceIDAny}); err != nil {
+				t.Errorf("error checking authorization: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// None of the concurrent writes should have been lost
+	if all, _ := store.ListUsers(ctx); len(all) != 3+writers {
+		t.Errorf("expected %d users, got %d", 3+writers, len(all))
+	}
+}
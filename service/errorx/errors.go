@@ -20,4 +20,20 @@ const (
 	AccessDenied   Code = "ACCESS_DENIED"
 	InvalidToken   Code = "INVALID_TOKEN"
 	NoContent      Code = "NO_CONTENT"
+	NotFound       Code = "NOT_FOUND"
+	Conflict       Code = "CONFLICT"
+	InvalidClient  Code = "INVALID_CLIENT"
+	InvalidScope   Code = "INVALID_SCOPE"
+	InvalidTarget  Code = "INVALID_TARGET"
+	InvalidGrant   Code = "INVALID_GRANT"
+	// Returned for a redirect URI that is not registered for the client, so the error can not be sent to the redirect URI
+	InvalidRedirectURI Code = "INVALID_REDIRECT_URI"
+	// Returned for wrong user credentials, without telling whether the user or the password was wrong
+	InvalidCredentials Code = "INVALID_CREDENTIALS"
+	// Returned for the login attempts during a temporary lockout, after too many failed attempts
+	AccountLocked Code = "ACCOUNT_LOCKED"
+	// Returned for the requests that require a login with a second factor, made with a token that was issued without one
+	MFARequired Code = "MFA_REQUIRED"
+	// Returned for the requests made with a token that lacks a scope required by the endpoint, whatever the role of the user
+	InsufficientScope Code = "INSUFFICIENT_SCOPE"
 )
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"log"
 	"sync"
 	"user-service/authn"
@@ -23,18 +24,35 @@ type App struct {
 func getApp(ctx context.Context) *App {
 	cfg, err := config.GetConfig()
 	if err != nil {
-		log.Fatal("error initializing app config")
+		log.Fatal("error initializing app config: ", err)
 	}
 
-	store := datastore.InitStore()
+	store, err := initDatastore(cfg)
+	if err != nil {
+		log.Fatal("error initializing datastore: ", err)
+	}
 	authZSvc := authz.InitService(store)
-	authNSvc := authn.InitService()
+	authNSvc := authn.InitService(store)
 	authNSvc.Cfg = cfg
+	authNSvc.Tokens = authn.NewTokenSettings(cfg)
+	authNSvc.Secrets = cfg.HMACSecrets
+	authNSvc.PasswordPolicy, err = authn.LoadPasswordPolicy(cfg.PasswordMinLength, cfg.PasswordBreachList)
+	if err != nil {
+		log.Fatal("error loading password policy: ", err)
+	}
+	wg := &sync.WaitGroup{}
+	// Without the key cache, the keys are read from disk on every use, so the service can still work.
+	if err := authNSvc.WatchKeys(ctx, wg); err != nil {
+		log.Println("ERROR: could not watch the key directory, keys will be read from disk on every use", err)
+	}
+	if err := authNSvc.CheckSigningKey(); err != nil {
+		log.Fatal("error checking the signing key: ", err)
+	}
 
 	// Initialize App
 	a := App{
 		ctx:          ctx,
-		waitgroup:    &sync.WaitGroup{},
+		waitgroup:    wg,
 		config:       cfg,
 		db:           store,
 		authNService: authNSvc,
@@ -42,3 +60,14 @@ func getApp(ctx context.Context) *App {
 	}
 	return &a
 }
+
+func initDatastore(cfg *config.Config) (commons.Datastore, error) {
+	switch cfg.Datastore {
+	case "memory":
+		return datastore.InitStore(), nil
+	case "sqlite":
+		return datastore.InitSQLiteStore(cfg.DatastorePath)
+	default:
+		return nil, errors.New("invalid datastore")
+	}
+}
@@ -1,11 +1,24 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"user-service/authn"
 	"user-service/errorx"
 	"user-service/users"
+
+	"github.com/go-chi/chi/v5"
 )
 
+// Upper limit on the size of the request body, which is plenty for the user payloads of this service.
+const maxBodyBytes = 1 << 20
+
 func (app *App) GetUsers(w http.ResponseWriter, r *http.Request) {
 	// Since the authentication and authorization have been taken care of at the middleware level,
 	// the handler simply processes the request and respond appropriately.
@@ -18,21 +31,297 @@ func (app *App) GetUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usrs, err := users.FetchUsersFilterOne(app.db, userId)
+	opts, err := listOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Invalid query parameters"})
+		return
+	}
+	page, err := users.FetchUsersFilterOne(r.Context(), app.db, userId, opts)
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.BadRequestData {
+			RespondWithData(w, r, http.StatusBadRequest, e)
+			return
+		}
+		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError, Message: "Unexpected server error"})
+		return
+	}
+
+	RespondWithData(w, r, http.StatusOK, page)
+}
+
+// listOptionsFromQuery reads the pagination, sorting and filtering parameters of the user listing.
+// The sort parameter takes a field name, optionally prefixed with "-" for descending order.
+func listOptionsFromQuery(q url.Values) (users.ListOptions, error) {
+	opts := users.ListOptions{
+		Cursor:         q.Get("cursor"),
+		UsernamePrefix: q.Get("username"),
+	}
+	if l := q.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			return opts, errors.New("invalid limit")
+		}
+		opts.Limit = limit
+	}
+	sortBy := q.Get("sort")
+	if strings.HasPrefix(sortBy, "-") {
+		opts.Desc = true
+		sortBy = strings.TrimPrefix(sortBy, "-")
+	}
+	opts.SortBy = sortBy
+	return opts, nil
+}
+
+func (app *App) GetUser(w http.ResponseWriter, r *http.Request) {
+	usr, err := users.FetchUser(r.Context(), app.db, chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	RespondWithData(w, r, http.StatusOK, usr)
+}
+
+func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var usr users.User
+	if err := decodeBody(w, r, &usr); err != nil {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Malformed request body"})
+		return
+	}
+	usr, err := users.CreateUser(r.Context(), app.db, usr)
+	if err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	RespondWithData(w, r, http.StatusCreated, usr)
+}
+
+func (app *App) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var usr users.User
+	if err := decodeBody(w, r, &usr); err != nil {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Malformed request body"})
+		return
+	}
+	usr, err := users.UpdateUser(r.Context(), app.db, chi.URLParam(r, "id"), usr)
+	if err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	RespondWithData(w, r, http.StatusOK, usr)
+}
+
+func (app *App) PatchUser(w http.ResponseWriter, r *http.Request) {
+	var patch users.UserPatch
+	if err := decodeBody(w, r, &patch); err != nil {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Malformed request body"})
+		return
+	}
+	usr, err := users.PatchUser(r.Context(), app.db, chi.URLParam(r, "id"), patch)
 	if err != nil {
-		RespondWithData(w, r, http.StatusNoContent, errorx.Error{Code: errorx.NoContent, Message: "No users found"})
+		respondWithUserError(w, r, err)
 		return
 	}
+	RespondWithData(w, r, http.StatusOK, usr)
+}
 
-	RespondWithData(w, r, http.StatusOK, usrs)
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+// SetUserPassword sets the password of a user, which is checked against the password policy first.
+func (app *App) SetUserPassword(w http.ResponseWriter, r *http.Request) {
+	var req passwordRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Malformed request body"})
+		return
+	}
+	usr, err := users.FetchUser(r.Context(), app.db, chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	if err := app.authNService.SetPassword(r.Context(), string(usr.ID), req.Password); err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	RespondWithData(w, r, http.StatusNoContent, nil)
 }
 
-func (app *App) GetToken(w http.ResponseWriter, r *http.Request) {
-	token, err := app.authNService.GenerateToken("client_user")
+// UnlockUser lifts the lockout of a user account, which follows too many failed login attempts.
+// The lockout of the IP addresses is left to expire on its own.
+func (app *App) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	usr, err := users.FetchUser(r.Context(), app.db, chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	if err := app.authNService.UnlockAccount(r.Context(), string(usr.ID)); err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	RespondWithData(w, r, http.StatusNoContent, nil)
+}
+
+func (app *App) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	if err := users.DeleteUser(r.Context(), app.db, chi.URLParam(r, "id")); err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	RespondWithData(w, r, http.StatusNoContent, nil)
+}
+
+type loginRequest struct {
+	ID       string `json:"id"`
+	Password string `json:"password"`
+}
+
+// Login issues a token pair to a user, who authenticates with the user id and password.
+// The user id is used as the login name, since the usernames are not unique.
+// Too many failed attempts for an account, or from an IP address, result in a temporary lockout.
+// For a user with MFA enabled, the response holds an MFA challenge token instead of the token pair, see LoginMFA.
+func (app *App) Login(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := decodeBody(w, r, &req); err != nil || req.ID == "" || req.Password == "" {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Malformed request body"})
+		return
+	}
+	challenge, err := app.authNService.Login(r.Context(), req.ID, req.Password, clientIP(r))
+	if err != nil {
+		if respondWithLockout(w, r, err) {
+			return
+		}
+		switch err.Error() {
+		case string(errorx.InvalidCredentials):
+			RespondWithData(w, r, http.StatusUnauthorized, errorx.Error{Code: errorx.InvalidCredentials, Message: "Invalid user id or password"})
+		default:
+			RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError})
+		}
+		return
+	}
+	if challenge != "" {
+		RespondWithData(w, r, http.StatusOK, map[string]string{"mfa_token": challenge})
+		return
+	}
+	app.respondWithTokenPair(w, r, req.ID, authn.AMRPassword)
+}
+
+// respondWithLockout responds with 429 if the error is a lockout, and reports whether it did.
+func respondWithLockout(w http.ResponseWriter, r *http.Request, err error) bool {
+	var lockout authn.LockoutError
+	if !errors.As(err, &lockout) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockout.RetryAfter.Seconds()))))
+	RespondWithData(w, r, http.StatusTooManyRequests, errorx.Error{Code: errorx.AccountLocked, Message: "Too many failed login attempts, try again later"})
+	return true
+}
+
+// clientIP returns the IP address of the client. The proxy headers, e.g. X-Forwarded-For, are deliberately ignored, as any client
+// could set them to dodge the per-IP lockout. A deployment behind a trusted proxy should rewrite RemoteAddr, e.g. with chi RealIP.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// respondWithTokenPair issues an access token and a refresh token to the user, who authenticated with the amr methods.
+func (app *App) respondWithTokenPair(w http.ResponseWriter, r *http.Request, id string, amr ...string) {
+	token, err := app.authNService.GenerateToken(id, amr...)
+	if err != nil {
+		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError, Message: "Could not generate API Key"})
+		return
+	}
+	refreshToken, err := app.authNService.IssueRefreshToken(r.Context(), id, amr...)
 	if err != nil {
 		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError, Message: "Could not generate API Key"})
 		return
 	}
-	res := map[string]string{"token": token}
+	res := map[string]string{"token": token, "refresh_token": refreshToken}
 	RespondWithData(w, r, http.StatusOK, res)
 }
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken exchanges a refresh token for a new access token. The refresh token itself is rotated on every use.
+func (app *App) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+	if err := decodeBody(w, r, &req); err != nil || req.RefreshToken == "" {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Malformed request body"})
+		return
+	}
+	token, refreshToken, err := app.authNService.RefreshToken(r.Context(), req.RefreshToken)
+	if err != nil {
+		switch err.Error() {
+		case string(errorx.InvalidToken):
+			RespondWithData(w, r, http.StatusUnauthorized, errorx.Error{Code: errorx.InvalidToken, Message: "Invalid refresh token"})
+		default:
+			RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError, Message: "Could not refresh API Key"})
+		}
+		return
+	}
+	res := map[string]string{"token": token, "refresh_token": refreshToken}
+	RespondWithData(w, r, http.StatusOK, res)
+}
+
+// GetJWKS serves the public keys, so that other services can validate the issued tokens on their own.
+func (app *App) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	jwks, err := app.authNService.JWKS()
+	if err != nil {
+		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError, Message: "Could not load the key set"})
+		return
+	}
+	RespondWithData(w, r, http.StatusOK, jwks)
+}
+
+// RevokeToken revokes an access token or a refresh token as per RFC 7009.
+// The token is supplied as a form parameter, along with an optional token_type_hint.
+// As per the RFC, the response is a 200 even if the token was invalid or unknown.
+func (app *App) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("token") == "" {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Missing token"})
+		return
+	}
+	err := app.authNService.RevokeToken(r.Context(), r.PostForm.Get("token"), r.PostForm.Get("token_type_hint"))
+	if err != nil {
+		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError, Message: "Could not revoke the token"})
+		return
+	}
+	RespondWithData(w, r, http.StatusOK, nil)
+}
+
+// decodeBody decodes a JSON request body into dst, rejecting unknown fields and trailing data.
+func decodeBody(w http.ResponseWriter, r *http.Request, dst any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after request body")
+	}
+	return nil
+}
+
+// respondWithUserError maps the errors returned by the users package to an appropriate response.
+func respondWithUserError(w http.ResponseWriter, r *http.Request, err error) {
+	var e errorx.Error
+	if !errors.As(err, &e) {
+		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError})
+		return
+	}
+	switch e.Code {
+	case errorx.BadRequestData:
+		RespondWithData(w, r, http.StatusBadRequest, e)
+	case errorx.NotFound:
+		RespondWithData(w, r, http.StatusNotFound, errorx.Error{Code: errorx.NotFound, Message: "User not found"})
+	case errorx.Conflict:
+		RespondWithData(w, r, http.StatusConflict, errorx.Error{Code: errorx.Conflict, Message: "User already exists"})
+	default:
+		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError})
+	}
+}
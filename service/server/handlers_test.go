@@ -6,13 +6,25 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"user-service/authn"
+	"user-service/authz"
 	"user-service/config"
+	"user-service/errorx"
 	"user-service/testutils"
+	"user-service/timesource"
 	"user-service/users"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 var (
@@ -25,7 +37,7 @@ var (
 func TestMain(m *testing.M) {
 	// Setup before the tests
 	store = testutils.InitTestStore()
-	testAuthNSvc = testutils.InitTestAuthNService()
+	testAuthNSvc = testutils.InitTestAuthNService(store)
 	testAuthZSvc = testutils.InitTestAuthZService(store)
 	cfg, err := config.GetConfig()
 	if err != nil {
@@ -64,12 +76,12 @@ func TestGetUsers(t *testing.T) {
 	if w.Code != http.StatusOK {
 		t.Errorf("expected 200, got %d", w.Code)
 	}
-	var resp []users.User
+	var resp users.UserPage
 	err = json.Unmarshal(w.Body.Bytes(), &resp)
 	if err != nil {
 		log.Println("Error processing resp", err)
 	}
-	if len(resp) != 2 { // and some other checks
+	if len(resp.Users) != 2 || resp.NextCursor != "" { // and some other checks
 		t.Errorf("unexpected response data, expected %v and %v", 2, resp)
 	}
 
@@ -114,19 +126,1076 @@ func TestGetUsers(t *testing.T) {
 	}
 }
 
-func TestGetToken(t *testing.T) {
+func TestGetUsersPagination(t *testing.T) {
 	router := testRouter()
-	headers := []testutils.Header{}
-	w := testutils.MakeGetRequestWithHeaders(router, "/api/token", headers, []byte{})
+	headers := authHeaders(t, "user1")
+
+	fetchPage := func(url string) users.UserPage {
+		w := testutils.MakeGetRequestWithHeaders(router, url, headers, []byte{})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 for %s, got %d", url, w.Code)
+		}
+		var page users.UserPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("error processing resp: %v", err)
+		}
+		return page
+	}
+
+	// Walk through the listing one user at a time, sorted by username in descending order.
+	var got []users.UserID
+	page := fetchPage("/api/users?limit=1&sort=-username")
+	for {
+		for _, u := range page.Users {
+			got = append(got, u.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		page = fetchPage("/api/users?limit=1&sort=-username&cursor=" + page.NextCursor)
+	}
+	// user1 is filtered out, being the requesting user
+	expected := []users.UserID{"client_user", "user2"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	page = fetchPage("/api/users?username=jane")
+	if len(page.Users) != 1 || page.Users[0].ID != "user2" {
+		t.Errorf("unexpected filtered users %v", page.Users)
+	}
+
+	// A cursor can not be used with a different sort order
+	first := fetchPage("/api/users?limit=1&sort=id")
+	w := testutils.MakeGetRequestWithHeaders(router, "/api/users?limit=1&sort=username&cursor="+first.NextCursor, headers, []byte{})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+	for _, q := range []string{"limit=0", "limit=1000", "sort=password", "cursor=garbage"} {
+		w = testutils.MakeGetRequestWithHeaders(router, "/api/users?"+q, headers, []byte{})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", q, w.Code)
+		}
+	}
+}
+
+// clientAuthHeaders authenticates the test client with HTTP Basic authentication
+func clientAuthHeaders(id, secret string) []testutils.Header {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(id, secret)
+	return []testutils.Header{{Name: "Authorization", Value: req.Header.Get("Authorization")}}
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+	router := testRouter()
+	formHeader := testutils.Header{Name: "Content-Type", Value: "application/x-www-form-urlencoded"}
+	tokenRequest := func(headers []testutils.Header, form url.Values) (int, map[string]any, http.Header) {
+		t.Helper()
+		headers = append(headers, formHeader)
+		w := testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/oauth/token", headers, []byte(form.Encode()))
+		var resp map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("error processing resp: %v", err)
+		}
+		return w.Code, resp, w.Header()
+	}
+	basic := clientAuthHeaders(testutils.TestClientID, testutils.TestClientSecret)
+
+	// client_secret_basic, granting all the allowed scopes and audiences
+	code, resp, header := tokenRequest(basic, url.Values{"grant_type": {"client_credentials"}})
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, resp)
+	}
+	if resp["token_type"] != "Bearer" || resp["scope"] != "users:read users:write" || resp["expires_in"] != float64(1800) {
+		t.Errorf("unexpected token response %v", resp)
+	}
+	if header.Get("Cache-Control") != "no-store" {
+		t.Errorf("expected the token response not to be cached, got %q", header.Get("Cache-Control"))
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(resp["access_token"].(string), claims); err != nil {
+		t.Fatalf("error parsing token: %v", err)
+	}
+	if claims["sub"] != testutils.TestClientID || claims["scope"] != "users:read users:write" {
+		t.Errorf("unexpected token claims %v", claims)
+	}
+	if validated, err := testAuthNSvc.ValidateToken(resp["access_token"].(string)); err != nil || validated.UserID != "" || validated.Subject() != testutils.TestClientID {
+		t.Errorf("expected the token to be valid for this service, as the token of the client, got %v, err %v", validated, err)
+	}
+	// The token of a client is not the token of a user, even if a user with the same id existed
+	clientHeaders := []testutils.Header{{Name: "Authorization", Value: "Bearer " + resp["access_token"].(string)}}
+	for _, path := range []string{"/api/users", "/api/userinfo"} {
+		if w := testutils.MakeGetRequestWithHeaders(router, path, clientHeaders, []byte{}); w.Code != http.StatusForbidden {
+			t.Errorf("expected 403 for the token of a client on %s, got %d", path, w.Code)
+		}
+	}
+
+	// client_secret_post, narrowing down the scope, and the audience to another service
+	code, resp, _ = tokenRequest(nil, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {testutils.TestClientID},
+		"client_secret": {testutils.TestClientSecret},
+		"scope":         {"users:read"},
+		"audience":      {"reports-service"},
+	})
+	if code != http.StatusOK || resp["scope"] != "users:read" {
+		t.Fatalf("unexpected token response %d %v", code, resp)
+	}
+	if _, err := testAuthNSvc.ValidateToken(resp["access_token"].(string)); err == nil {
+		t.Error("expected a token for another audience to be rejected by this service")
+	}
+
+	tests := []struct {
+		name    string
+		headers []testutils.Header
+		form    url.Values
+		code    int
+		err     string
+	}{
+		{"wrong secret", clientAuthHeaders(testutils.TestClientID, "wrong"), url.Values{"grant_type": {"client_credentials"}}, http.StatusUnauthorized, "invalid_client"},
+		{"unknown client", nil, url.Values{"grant_type": {"client_credentials"}, "client_id": {"unknown"}, "client_secret": {"secret"}}, http.StatusUnauthorized, "invalid_client"},
+		{"no credentials", nil, url.Values{"grant_type": {"client_credentials"}}, http.StatusUnauthorized, "invalid_client"},
+		{"two auth methods", basic, url.Values{"grant_type": {"client_credentials"}, "client_id": {testutils.TestClientID}}, http.StatusBadRequest, "invalid_request"},
+		{"missing grant type", basic, url.Values{}, http.StatusBadRequest, "invalid_request"},
+		{"unsupported grant type", basic, url.Values{"grant_type": {"password"}}, http.StatusBadRequest, "unsupported_grant_type"},
+		{"scope not allowed", basic, url.Values{"grant_type": {"client_credentials"}, "scope": {"users:read admin"}}, http.StatusBadRequest, "invalid_scope"},
+		{"audience not allowed", basic, url.Values{"grant_type": {"client_credentials"}, "audience": {"billing-service"}}, http.StatusBadRequest, "invalid_target"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp, header := tokenRequest(tt.headers, tt.form)
+			if code != tt.code || resp["error"] != tt.err {
+				t.Errorf("expected %d %s, got %d %v", tt.code, tt.err, code, resp)
+			}
+			if code == http.StatusUnauthorized && header.Get("WWW-Authenticate") == "" {
+				t.Error("expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	router := testRouter()
+	headers := []testutils.Header{{Name: "Content-Type", Value: "application/json"}}
+	login := func(body string) (int, map[string]string) {
+		t.Helper()
+		w := testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/login", headers, []byte(body))
+		var resp map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("error processing resp: %v", err)
+		}
+		return w.Code, resp
+	}
+
+	code, resp := login(fmt.Sprintf(`{"id":"user1","password":%q}`, testutils.TestUserPassword))
+	if code != http.StatusOK || resp["token"] == "" || resp["refresh_token"] == "" {
+		t.Fatalf("unexpected login response %d %v", code, resp)
+	}
+	claims, err := testAuthNSvc.ValidateToken(resp["token"])
+	if err != nil || claims.UserID != "user1" {
+		t.Errorf("expected a token for user1, got %v, err %v", claims, err)
+	}
+
+	// A wrong password, an unknown user, and a user without a password all look the same
+	for _, body := range []string{
+		`{"id":"user1","password":"wrong-password"}`,
+		fmt.Sprintf(`{"id":"unknown","password":%q}`, testutils.TestUserPassword),
+		fmt.Sprintf(`{"id":"user2","password":%q}`, testutils.TestUserPassword),
+	} {
+		if code, resp := login(body); code != http.StatusUnauthorized || resp["code"] != string(errorx.InvalidCredentials) {
+			t.Errorf("expected 401 for %s, got %d %v", body, code, resp)
+		}
+	}
+	for _, body := range []string{`{"id":"user1"}`, `{"id":"user1","password":"x","extra":1}`, `garbage`} {
+		if code, _ := login(body); code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", body, code)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	router := testRouter()
+	login := func(password string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"id":"user1","password":%q}`, password)
+		return testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/login", []testutils.Header{}, []byte(body))
+	}
+
+	// Start over from the failures of the other tests
+	testAuthNSvc.UnlockAccount(context.Background(), "user1")
+	for i := 0; i < 5; i++ {
+		if w := login("wrong-password"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for attempt %d, got %d", i+1, w.Code)
+		}
+	}
+	// Locked out, even with the right password
+	w := login(testutils.TestUserPassword)
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusTooManyRequests || resp["code"] != string(errorx.AccountLocked) {
+		t.Fatalf("expected 429, got %d %v", w.Code, resp)
+	}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter <= 0 || retryAfter > 30 {
+		t.Errorf("unexpected Retry-After %q", w.Header().Get("Retry-After"))
+	}
+
+	unlock := func(headers []testutils.Header, id string) int {
+		return testutils.MakeRequestWithHeaders(router, http.MethodDelete, "/api/users/"+id+"/lockout", headers, nil).Code
+	}
+	if code := unlock(authHeaders(t, "user1"), "user1"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a viewer, got %d", code)
+	}
+	if code := unlock(authHeaders(t, "client_user"), "unknown"); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+	if code := unlock(authHeaders(t, "client_user"), "user1"); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if w := login(testutils.TestUserPassword); w.Code != http.StatusOK {
+		t.Errorf("expected user1 to log in after the unlock, got %d", w.Code)
+	}
+}
+
+func TestMFA(t *testing.T) {
+	router := testRouter()
+	ctx := context.Background()
+	post := func(headers []testutils.Header, path string, body any) (int, map[string]any) {
+		t.Helper()
+		b, _ := json.Marshal(body)
+		w := testutils.MakeRequestWithHeaders(router, http.MethodPost, path, headers, b)
+		var resp map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	login := func() string {
+		t.Helper()
+		code, resp := post(nil, "/api/login", map[string]string{"id": "user1", "password": testutils.TestUserPassword})
+		challenge, _ := resp["mfa_token"].(string)
+		if code != http.StatusOK || challenge == "" || resp["token"] != nil {
+			t.Fatalf("expected an MFA challenge, got %d %v", code, resp)
+		}
+		return challenge
+	}
+	testAuthNSvc.UnlockAccount(ctx, "user1")
+	t.Cleanup(func() {
+		testAuthNSvc.DisableMFA(ctx, "user1")
+		testAuthNSvc.UnlockAccount(ctx, "user1")
+	})
+
+	user1 := authHeaders(t, "user1")
+	code, resp := post(user1, "/api/mfa/totp", nil)
+	secret, _ := resp["secret"].(string)
+	uri, _ := resp["otpauth_uri"].(string)
+	if code != http.StatusOK || secret == "" || !strings.HasPrefix(uri, "otpauth://totp/users.example.com:user1?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatalf("unexpected enrollment response %d %v", code, resp)
+	}
+	if code, _ := post(user1, "/api/mfa/totp/verify", map[string]string{"code": "000000"}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a wrong code, got %d", code)
+	}
+	now := timesource.CurrentTime()
+	totp, _ := authn.TOTPCode(secret, now)
+	code, resp = post(user1, "/api/mfa/totp/verify", map[string]string{"code": totp})
+	recoveryCodes, _ := resp["recovery_codes"].([]any)
+	if code != http.StatusOK || len(recoveryCodes) != 10 {
+		t.Fatalf("unexpected verification response %d %v", code, resp)
+	}
+	if code, _ := post(user1, "/api/mfa/totp", nil); code != http.StatusConflict {
+		t.Errorf("expected 409 for a second enrollment, got %d", code)
+	}
+
+	// The password alone only returns a challenge, which needs a valid code that has not been used before
+	challenge := login()
+	for _, c := range []string{"000000", totp} {
+		if code, resp := post(nil, "/api/login/mfa", map[string]string{"mfa_token": challenge, "code": c}); code != http.StatusUnauthorized {
+			t.Errorf("expected 401 for code %s, got %d %v", c, code, resp)
+		}
+	}
+	if code, _ := post(nil, "/api/login/mfa", map[string]string{"mfa_token": "unknown", "code": totp}); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown challenge, got %d", code)
+	}
+	next, _ := authn.TOTPCode(secret, now.Add(30*time.Second))
+	code, resp = post(nil, "/api/login/mfa", map[string]string{"mfa_token": challenge, "code": next})
+	token, _ := resp["token"].(string)
+	mfaRefreshToken, _ := resp["refresh_token"].(string)
+	if code != http.StatusOK || token == "" {
+		t.Fatalf("expected a token pair, got %d %v", code, resp)
+	}
+	claims, err := testAuthNSvc.ValidateToken(token)
+	if err != nil || !slices.Equal(claims.AMR, []string{authn.AMRPassword, authn.AMROTP, authn.AMRMFA}) {
+		t.Errorf("expected the amr of an MFA login, got %v, err %v", claims.AMR, err)
+	}
+	// The challenge is single-use
+	if code, _ := post(nil, "/api/login/mfa", map[string]string{"mfa_token": challenge, "code": next}); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a used challenge, got %d", code)
+	}
+
+	// A recovery code works once, in place of a TOTP code
+	recoveryCode := recoveryCodes[0].(string)
+	challenge = login()
+	code, resp = post(nil, "/api/login/mfa", map[string]string{"mfa_token": challenge, "code": strings.ToUpper(recoveryCode)})
+	if code != http.StatusOK {
+		t.Errorf("expected 200 for a recovery code, got %d", code)
+	}
+	// A recovery code is not a one-time password, so the amr lacks otp
+	recoveryToken, _ := resp["token"].(string)
+	if claims, err := testAuthNSvc.ValidateToken(recoveryToken); err != nil || !slices.Equal(claims.AMR, []string{authn.AMRPassword, authn.AMRMFA}) {
+		t.Errorf("expected the amr of a recovery code login, got %v, err %v", claims.AMR, err)
+	}
+	challenge = login()
+	if code, _ := post(nil, "/api/login/mfa", map[string]string{"mfa_token": challenge, "code": recoveryCode}); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a used recovery code, got %d", code)
+	}
+
+	// Disabling MFA requires a token from an MFA login
+	disable := func(headers []testutils.Header) int {
+		return testutils.MakeRequestWithHeaders(router, http.MethodDelete, "/api/mfa", headers, nil).Code
+	}
+	if code := disable(user1); code != http.StatusForbidden {
+		t.Errorf("expected 403 without MFA, got %d", code)
+	}
+	pwdRefreshToken, err := testAuthNSvc.IssueRefreshToken(ctx, "user1", authn.AMRPassword)
+	if err != nil {
+		t.Fatalf("error issuing refresh token: %v", err)
+	}
+	mfaHeaders := []testutils.Header{{Name: "Authorization", Value: "Bearer " + token}}
+	if code := disable(mfaHeaders); code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", code)
+	}
+	// The sessions of the MFA logins end along with MFA, while the ones of the password logins go on
+	if code, _ := post(nil, "/api/token/refresh", map[string]string{"refresh_token": mfaRefreshToken}); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the refresh token of an MFA login, got %d", code)
+	}
+	if code, _ := post(nil, "/api/token/refresh", map[string]string{"refresh_token": pwdRefreshToken}); code != http.StatusOK {
+		t.Errorf("expected 200 for the refresh token of a password login, got %d", code)
+	}
+	code, resp = post(nil, "/api/login", map[string]string{"id": "user1", "password": testutils.TestUserPassword})
+	if code != http.StatusOK || resp["token"] == nil {
+		t.Errorf("expected a token pair without MFA, got %d %v", code, resp)
+	}
+}
+
+func TestSetUserPassword(t *testing.T) {
+	router := testRouter()
+	admin := authHeaders(t, "client_user")
+	setPassword := func(headers []testutils.Header, id, password string) int {
+		body := fmt.Sprintf(`{"password":%q}`, password)
+		return testutils.MakeRequestWithHeaders(router, http.MethodPut, "/api/users/"+id+"/password", headers, []byte(body)).Code
+	}
+
+	if code := setPassword(authHeaders(t, "user1"), "user2", "a-new-long-password"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a viewer, got %d", code)
+	}
+	if code := setPassword(admin, "unknown", "a-new-long-password"); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+	if code := setPassword(admin, "user2", "short"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a short password, got %d", code)
+	}
+	refreshToken, err := testAuthNSvc.IssueRefreshToken(context.Background(), "user2")
+	if err != nil {
+		t.Fatalf("error issuing refresh token: %v", err)
+	}
+	if code := setPassword(admin, "user2", "a-new-long-password"); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+
+	body := []byte(`{"id":"user2","password":"a-new-long-password"}`)
+	w := testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/login", []testutils.Header{}, body)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected user2 to log in with the new password, got %d", w.Code)
+	}
+	// The sessions from before the password was set are ended
+	body, _ = json.Marshal(map[string]string{"refresh_token": refreshToken})
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/token/refresh", []testutils.Header{}, body)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a refresh token issued before the password was set, got %d", w.Code)
+	}
+}
+
+func authHeaders(t *testing.T, id string) []testutils.Header {
+	token, err := testAuthNSvc.GenerateToken(id)
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	return []testutils.Header{
+		{Name: "Authorization", Value: fmt.Sprintf("Bearer %s", token)},
+		{Name: "Content-Type", Value: "application/json"},
+	}
+}
+
+func TestUserCRUD(t *testing.T) {
+	router := testRouter()
+	admin := authHeaders(t, "client_user")
+
+	// Create
+	w := testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/users", admin, []byte(`{"id":"user3","username":"alice"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/users", admin, []byte(`{"id":"user3","username":"alice"}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", w.Code)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/users", admin, []byte(`{"id":"bad id","username":"alice"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/users", admin, []byte(`{"id":"user4","username":"bob","role":"admin"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown fields, got %d", w.Code)
+	}
+
+	// Read
+	w = testutils.MakeGetRequestWithHeaders(router, "/api/users/user3", admin, []byte{})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var usr users.User
+	if err := json.Unmarshal(w.Body.Bytes(), &usr); err != nil {
+		t.Fatalf("error processing resp: %v", err)
+	}
+	if usr.ID != "user3" || usr.Name != "alice" {
+		t.Errorf("unexpected user %v", usr)
+	}
+	w = testutils.MakeGetRequestWithHeaders(router, "/api/users/nobody", admin, []byte{})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+
+	// Update
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPut, "/api/users/user3", admin, []byte(`{"username":"alice.w"}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPut, "/api/users/user3", admin, []byte(`{"id":"user9","username":"alice.w"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPut, "/api/users/nobody", admin, []byte(`{"username":"x"}`))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPatch, "/api/users/user3", admin, []byte(`{"username":"alice.m"}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &usr); err != nil || usr.Name != "alice.m" {
+		t.Errorf("unexpected user %v, err %v", usr, err)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPatch, "/api/users/user3", admin, []byte(`{"username":""}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+
+	// A viewer can read but can not manage users
+	viewer := authHeaders(t, "user1")
+	w = testutils.MakeGetRequestWithHeaders(router, "/api/users/user3", viewer, []byte{})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodDelete, "/api/users/user3", viewer, []byte{})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+
+	// Delete, which revokes the refresh tokens of the user
+	refreshToken, err := testAuthNSvc.IssueRefreshToken(context.Background(), "user3")
+	if err != nil {
+		t.Fatalf("error issuing refresh token: %v", err)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodDelete, "/api/users/user3", admin, []byte{})
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+	body, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/token/refresh", []testutils.Header{}, body)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the refresh token of a deleted user, got %d", w.Code)
+	}
+	// A refresh token that outlived its user is not renewed, even if it was not revoked on the deletion
+	refreshToken, _ = testAuthNSvc.IssueRefreshToken(context.Background(), "user3")
+	body, _ = json.Marshal(map[string]string{"refresh_token": refreshToken})
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/token/refresh", []testutils.Header{}, body)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the refresh token of a deleted user, got %d", w.Code)
+	}
+	w = testutils.MakeRequestWithHeaders(router, http.MethodDelete, "/api/users/user3", admin, []byte{})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	router := testRouter()
+	headers := []testutils.Header{{Name: "Content-Type", Value: "application/json"}}
+
+	body := fmt.Sprintf(`{"id":"user1","password":%q}`, testutils.TestUserPassword)
+	w := testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/login", headers, []byte(body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("error processing resp: %v", err)
+	}
+	first := resp["refresh_token"]
+	if first == "" {
+		t.Fatalf("expected a refresh token, got %v", resp)
+	}
+
+	refresh := func(refreshToken string) (int, map[string]string) {
+		body, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+		w := testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/token/refresh", headers, body)
+		var resp map[string]string
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, resp := refresh(first)
+	if code != http.StatusOK || resp["token"] == "" || resp["refresh_token"] == "" || resp["refresh_token"] == first {
+		t.Fatalf("expected 200 with rotated tokens, got %d, %v", code, resp)
+	}
+	second := resp["refresh_token"]
+	if claims, err := testAuthNSvc.ValidateToken(resp["token"]); err != nil || claims.UserID != "user1" {
+		t.Errorf("expected a valid access token for user1, got %v, %v", claims, err)
+	}
+
+	code, resp = refresh(second)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	third := resp["refresh_token"]
+
+	// Reusing an already rotated token revokes the whole family, including the latest token.
+	if code, _ = refresh(first); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 on reuse, got %d", code)
+	}
+	if code, _ = refresh(third); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after family revocation, got %d", code)
+	}
+
+	if code, _ = refresh("not-a-token"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", code)
+	}
+	if code, _ = refresh(""); code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", code)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	router := testRouter()
+	formHeaders := []testutils.Header{{Name: "Content-Type", Value: "application/x-www-form-urlencoded"}}
+	revoke := func(form url.Values) int {
+		w := testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/token/revoke", formHeaders, []byte(form.Encode()))
+		return w.Code
+	}
+
+	headers := authHeaders(t, "client_user")
+	w := testutils.MakeGetRequestWithHeaders(router, "/api/users", headers, []byte{})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	token := strings.TrimPrefix(headers[0].Value, "Bearer ")
+	if code := revoke(url.Values{"token": {token}}); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	w = testutils.MakeGetRequestWithHeaders(router, "/api/users", headers, []byte{})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a revoked token, got %d", w.Code)
+	}
+	// Other tokens of the same user are unaffected
+	w = testutils.MakeGetRequestWithHeaders(router, "/api/users", authHeaders(t, "client_user"), []byte{})
 	if w.Code != http.StatusOK {
 		t.Errorf("expected 200, got %d", w.Code)
 	}
+
+	refreshToken, err := testAuthNSvc.IssueRefreshToken(context.Background(), "client_user")
+	if err != nil {
+		t.Fatalf("error issuing refresh token: %v", err)
+	}
+	if code := revoke(url.Values{"token": {refreshToken}, "token_type_hint": {"refresh_token"}}); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	body, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/token/refresh", []testutils.Header{}, body)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a revoked refresh token, got %d", w.Code)
+	}
+
+	// Unknown tokens are not an error, but a missing token is
+	if code := revoke(url.Values{"token": {"unknown"}}); code != http.StatusOK {
+		t.Errorf("expected 200, got %d", code)
+	}
+	if code := revoke(url.Values{}); code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", code)
+	}
+}
+
+func TestIntrospectToken(t *testing.T) {
+	router := testRouter()
+	ctx := context.Background()
+	introspect := func(headers []testutils.Header, form url.Values) (int, map[string]any) {
+		t.Helper()
+		headers = append(headers, testutils.Header{Name: "Content-Type", Value: "application/x-www-form-urlencoded"})
+		w := testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/token/introspect", headers, []byte(form.Encode()))
+		var resp map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	client := clientAuthHeaders(testutils.TestClientID, testutils.TestClientSecret)
+
+	// Only registered clients can introspect
+	userToken, _ := testAuthNSvc.GenerateToken("user1", authn.AMRPassword)
+	if code, resp := introspect(nil, url.Values{"token": {userToken}}); code != http.StatusUnauthorized || resp["error"] != "invalid_client" {
+		t.Errorf("expected 401 for an anonymous request, got %d %v", code, resp)
+	}
+	if code, _ := introspect(clientAuthHeaders(testutils.TestClientID, "wrong"), url.Values{"token": {userToken}}); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong secret, got %d", code)
+	}
+	if code, _ := introspect(client, url.Values{}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a missing token, got %d", code)
+	}
+
+	code, resp := introspect(client, url.Values{"token": {userToken}})
+	if code != http.StatusOK || resp["active"] != true || resp["sub"] != "user1" || resp["exp"] == nil || resp["iat"] == nil || resp["client_id"] != nil {
+		t.Errorf("unexpected introspection of a user token %d %v", code, resp)
+	}
+
+	clientToken, err := testAuthNSvc.ClientCredentialsToken(ctx, authn.ClientCredentialsRequest{
+		ClientID: testutils.TestClientID, ClientSecret: testutils.TestClientSecret, Scopes: []string{"users:read"},
+	})
+	if err != nil {
+		t.Fatalf("error issuing client token: %v", err)
+	}
+	// The client credentials can be sent in the form as well
+	form := url.Values{"token": {clientToken.Token}, "client_id": {testutils.TestClientID}, "client_secret": {testutils.TestClientSecret}}
+	code, resp = introspect(nil, form)
+	if code != http.StatusOK || resp["active"] != true || resp["sub"] != testutils.TestClientID || resp["client_id"] != testutils.TestClientID ||
+		resp["scope"] != "users:read" {
+		t.Errorf("unexpected introspection of a client token %d %v", code, resp)
+	}
+
+	// Revoked, invalid and refresh tokens are all just inactive, without any other details
+	testAuthNSvc.RevokeToken(ctx, userToken, "")
+	refreshToken, _ := testAuthNSvc.IssueRefreshToken(ctx, "user1")
+	for _, token := range []string{userToken, "garbage", refreshToken} {
+		if code, resp := introspect(client, url.Values{"token": {token}}); code != http.StatusOK || fmt.Sprint(resp) != "map[active:false]" {
+			t.Errorf("expected an inactive token, got %d %v", code, resp)
+		}
+	}
+}
+
+// openIDToken gets the tokens of the user via the authorization code flow of the public test client, with the openid scope.
+func openIDToken(t *testing.T, id string) authn.AccessToken {
+	t.Helper()
+	ctx := context.Background()
+	verifier := strings.Repeat("v", 43)
+	req := authn.AuthorizationRequest{
+		ClientID:            testutils.TestPublicClientID,
+		RedirectURI:         testutils.TestRedirectURI,
+		Scopes:              []string{authn.ScopeOpenID, authn.ScopeUsersRead},
+		CodeChallenge:       authn.S256CodeChallenge(verifier),
+		CodeChallengeMethod: authn.CodeChallengeMethodS256,
+	}
+	code, err := testAuthNSvc.IssueAuthorizationCode(ctx, req, id, authn.AMRPassword)
+	if err != nil {
+		t.Fatalf("error issuing authorization code: %v", err)
+	}
+	token, err := testAuthNSvc.AuthorizationCodeToken(ctx, authn.AuthorizationCodeRequest{
+		ClientID:     testutils.TestPublicClientID,
+		Code:         code,
+		RedirectURI:  testutils.TestRedirectURI,
+		CodeVerifier: verifier,
+	})
+	if err != nil {
+		t.Fatalf("error exchanging authorization code: %v", err)
+	}
+	return token
+}
+
+func TestOpenIDConnect(t *testing.T) {
+	router := testRouter()
+
+	w := testutils.MakeGetRequestWithHeaders(router, "/.well-known/openid-configuration", nil, []byte{})
+	var metadata authn.ProviderMetadata
+	if err := json.Unmarshal(w.Body.Bytes(), &metadata); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unexpected discovery response %d, err %v", w.Code, err)
+	}
+	if metadata.Issuer != testAuthNSvc.Tokens.Issuer || metadata.JWKSURI != "https://users.example.com/.well-known/jwks.json" ||
+		metadata.UserinfoEndpoint != "https://users.example.com/api/userinfo" || !slices.Contains(metadata.ScopesSupported, "users:read") || !slices.Equal(metadata.IDTokenSigningAlgValuesSupported, []string{"EdDSA"}) {
+		t.Errorf("unexpected discovery document %+v", metadata)
+	}
+
+	// The ID tokens are only issued to the relying parties, not on a login
+	body := fmt.Sprintf(`{"id":"user1","password":%q}`, testutils.TestUserPassword)
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/login", nil, []byte(body))
 	var resp map[string]string
-	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp["token"] == "" || resp["id_token"] != "" {
+		t.Errorf("expected the token pair only, got %d %v", w.Code, resp)
+	}
+
+	token := openIDToken(t, "user1")
+	idToken, err := jwt.Parse(token.IDToken, func(*jwt.Token) (interface{}, error) { return testAuthNSvc.IDTokenKey.Public(), nil },
+		jwt.WithIssuer(testAuthNSvc.Tokens.Issuer), jwt.WithAudience(testutils.TestPublicClientID), jwt.WithExpirationRequired())
 	if err != nil {
-		log.Println("Error processing resp", err)
+		t.Fatalf("error validating ID token: %v", err)
 	}
-	if resp["token"] == "" {
-		t.Errorf("unexpected response data, expected %v and %v", 2, resp)
+	claims := idToken.Claims.(jwt.MapClaims)
+	if claims["sub"] != "user1" || claims["auth_time"] == nil || fmt.Sprint(claims["amr"]) != "[pwd]" {
+		t.Errorf("unexpected ID token claims %v", claims)
+	}
+	// An ID token is not an access token
+	idHeaders := []testutils.Header{{Name: "Authorization", Value: "Bearer " + token.IDToken}}
+	if w := testutils.MakeGetRequestWithHeaders(router, "/api/userinfo", idHeaders, []byte{}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an ID token, got %d", w.Code)
+	}
+
+	bearer := func(token string) []testutils.Header {
+		return []testutils.Header{{Name: "Authorization", Value: "Bearer " + token}}
+	}
+	w = testutils.MakeGetRequestWithHeaders(router, "/api/userinfo", bearer(token.Token), []byte{})
+	var info map[string]string
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if w.Code != http.StatusOK || info["sub"] != "user1" || info["preferred_username"] != "john.doe" {
+		t.Errorf("unexpected userinfo %d %v", w.Code, info)
+	}
+	// The userinfo endpoint requires the openid scope, which the tokens of a login lack
+	if w := testutils.MakeGetRequestWithHeaders(router, "/api/userinfo", authHeaders(t, "user1"), []byte{}); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without the openid scope, got %d", w.Code)
+	}
+	if w := testutils.MakeGetRequestWithHeaders(router, "/api/userinfo", bearer(openIDToken(t, "nobody").Token), []byte{}); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown user, got %d", w.Code)
+	}
+	if w := testutils.MakeGetRequestWithHeaders(router, "/api/userinfo", nil, []byte{}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a token, got %d", w.Code)
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	router := testRouter()
+	testAuthNSvc.UnlockAccount(context.Background(), "user1")
+	formHeader := []testutils.Header{{Name: "Content-Type", Value: "application/x-www-form-urlencoded"}}
+	// The code verifier of RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	authorizeParams := func() url.Values {
+		return url.Values{
+			"response_type":         {"code"},
+			"client_id":             {testutils.TestPublicClientID},
+			"redirect_uri":          {testutils.TestRedirectURI},
+			"scope":                 {"openid users:read"},
+			"state":                 {"xyz"},
+			"nonce":                 {"n-0S6_WzA2Mj"},
+			"code_challenge":        {authn.S256CodeChallenge(verifier)},
+			"code_challenge_method": {"S256"},
+		}
+	}
+	authorize := func(form url.Values) *httptest.ResponseRecorder {
+		return testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/oauth/authorize", formHeader, []byte(form.Encode()))
+	}
+	redirectParams := func(w *httptest.ResponseRecorder) url.Values {
+		t.Helper()
+		u, err := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusSeeOther || err != nil || !strings.HasPrefix(u.String(), testutils.TestRedirectURI+"?") {
+			t.Fatalf("expected a redirect to the client, got %d %q", w.Code, w.Header().Get("Location"))
+		}
+		return u.Query()
+	}
+
+	// An unknown client, or a redirect URI that is not registered, is not redirected to
+	for _, tt := range []struct{ key, value string }{
+		{"client_id", "unknown"},
+		{"client_id", testutils.TestClientID},
+		{"redirect_uri", "https://evil.example.com/callback"},
+	} {
+		form := authorizeParams()
+		form.Set(tt.key, tt.value)
+		if w := authorize(form); w.Code != http.StatusBadRequest || w.Header().Get("Location") != "" {
+			t.Errorf("expected 400 without a redirect for %s=%s, got %d", tt.key, tt.value, w.Code)
+		}
+	}
+	// The other errors of the request are sent to the client, along with the state
+	for _, tt := range []struct{ key, value, err string }{
+		{"code_challenge_method", "plain", "invalid_request"},
+		{"code_challenge", "", "invalid_request"},
+		{"scope", "openid users:write", "invalid_scope"},
+		{"response_type", "token", "unsupported_response_type"},
+	} {
+		form := authorizeParams()
+		form.Set(tt.key, tt.value)
+		params := redirectParams(authorize(form))
+		if params.Get("error") != tt.err || params.Get("state") != "xyz" {
+			t.Errorf("expected %s for %s=%q, got %v", tt.err, tt.key, tt.value, params)
+		}
+	}
+	// A plain redirect of the browser carries no credentials
+	w := testutils.MakeGetRequestWithHeaders(router, "/api/oauth/authorize?"+authorizeParams().Encode(), nil, []byte{})
+	if params := redirectParams(w); params.Get("error") != "login_required" {
+		t.Errorf("expected login_required, got %v", params)
+	}
+	// A failed login is returned to the login page
+	form := authorizeParams()
+	form.Set("id", "user1")
+	form.Set("password", "wrong-password")
+	if w := authorize(form); w.Code != http.StatusUnauthorized || w.Header().Get("Location") != "" {
+		t.Errorf("expected 401 without a redirect, got %d", w.Code)
+	}
+	testAuthNSvc.UnlockAccount(context.Background(), "user1")
+
+	login := func() string {
+		t.Helper()
+		form := authorizeParams()
+		form.Set("id", "user1")
+		form.Set("password", testutils.TestUserPassword)
+		params := redirectParams(authorize(form))
+		if params.Get("code") == "" || params.Get("state") != "xyz" {
+			t.Fatalf("expected a code along with the state, got %v", params)
+		}
+		return params.Get("code")
+	}
+	exchange := func(code, verifier string) (int, map[string]any) {
+		t.Helper()
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {testutils.TestPublicClientID},
+			"code":          {code},
+			"redirect_uri":  {testutils.TestRedirectURI},
+			"code_verifier": {verifier},
+		}
+		w := testutils.MakeRequestWithHeaders(router, http.MethodPost, "/api/oauth/token", formHeader, []byte(form.Encode()))
+		var resp map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("error processing resp: %v", err)
+		}
+		return w.Code, resp
+	}
+
+	// A wrong code verifier consumes the code all the same
+	code := login()
+	if status, resp := exchange(code, strings.Repeat("a", 43)); status != http.StatusBadRequest || resp["error"] != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a wrong code verifier, got %d %v", status, resp)
+	}
+	if status, resp := exchange(code, verifier); status != http.StatusBadRequest || resp["error"] != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a used code, got %d %v", status, resp)
+	}
+
+	code = login()
+	status, resp := exchange(code, verifier)
+	if status != http.StatusOK || resp["scope"] != "openid users:read" || resp["id_token"] == nil {
+		t.Fatalf("unexpected token response %d %v", status, resp)
+	}
+	claims, err := testAuthNSvc.ValidateToken(resp["access_token"].(string))
+	if err != nil || claims.UserID != "user1" || claims.ClientID != testutils.TestPublicClientID || !slices.Equal(claims.AMR, []string{authn.AMRPassword}) {
+		t.Errorf("unexpected access token claims %+v, err %v", claims, err)
+	}
+	idToken, err := jwt.Parse(resp["id_token"].(string), func(*jwt.Token) (interface{}, error) { return testAuthNSvc.IDTokenKey.Public(), nil },
+		jwt.WithIssuer(testAuthNSvc.Tokens.Issuer), jwt.WithAudience(testutils.TestPublicClientID))
+	if err != nil || idToken.Claims.(jwt.MapClaims)["nonce"] != "n-0S6_WzA2Mj" {
+		t.Errorf("unexpected ID token %v, err %v", idToken, err)
+	}
+	if status, resp := exchange(code, verifier); status != http.StatusBadRequest || resp["error"] != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a replayed code, got %d %v", status, resp)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	router := testRouter()
+	ctx := context.Background()
+	// A token that the public client got on behalf of the admin user, with the read scope only
+	verifier := strings.Repeat("v", 43)
+	req := authn.AuthorizationRequest{
+		ClientID:            testutils.TestPublicClientID,
+		RedirectURI:         testutils.TestRedirectURI,
+		Scopes:              []string{authn.ScopeUsersRead},
+		CodeChallenge:       authn.S256CodeChallenge(verifier),
+		CodeChallengeMethod: authn.CodeChallengeMethodS256,
+	}
+	code, err := testAuthNSvc.IssueAuthorizationCode(ctx, req, "client_user", authn.AMRPassword)
+	if err != nil {
+		t.Fatalf("error issuing authorization code: %v", err)
+	}
+	token, err := testAuthNSvc.AuthorizationCodeToken(ctx, authn.AuthorizationCodeRequest{
+		ClientID: testutils.TestPublicClientID, Code: code, RedirectURI: testutils.TestRedirectURI, CodeVerifier: verifier,
+	})
+	if err != nil {
+		t.Fatalf("error exchanging authorization code: %v", err)
+	}
+	headers := []testutils.Header{
+		{Name: "Authorization", Value: "Bearer " + token.Token},
+		{Name: "Content-Type", Value: "application/json"},
+	}
+
+	if w := testutils.MakeGetRequestWithHeaders(router, "/api/users/user1", headers, []byte{}); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for a read with the read scope, got %d", w.Code)
+	}
+	// The role of the user allows the write, but the scope of the token does not
+	w := testutils.MakeRequestWithHeaders(router, http.MethodPatch, "/api/users/user1", headers, []byte(`{"username":"john.smith"}`))
+	var resp errorx.Error
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusForbidden || resp.Code != errorx.InsufficientScope {
+		t.Errorf("expected 403 INSUFFICIENT_SCOPE, got %d %v", w.Code, resp)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != `Bearer error="insufficient_scope", scope="users:write"` {
+		t.Errorf("unexpected WWW-Authenticate header %q", got)
+	}
+	// The tokens of a login carry all the scopes
+	w = testutils.MakeRequestWithHeaders(router, http.MethodPatch, "/api/users/user1", authHeaders(t, "client_user"), []byte(`{"username":"john.doe"}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 for a login token, got %d", w.Code)
+	}
+}
+
+// Every endpoint that is protected by a role declares the scopes it needs as well, so that a new endpoint is not left open
+// to the tokens of any scope.
+func TestMiddlewareOptsDeclareScopes(t *testing.T) {
+	for method, paths := range middlewareOpts {
+		for path, opts := range paths {
+			if opts.AuthZ.Role != "" && len(opts.Scopes) == 0 {
+				t.Errorf("no scopes declared for %s %s", method, path)
+			}
+		}
+	}
+}
+
+func TestMultipleRoles(t *testing.T) {
+	router := testRouter()
+	ctx := context.Background()
+	// The auditor role has no policy, and it comes first, so the viewer role has to be evaluated as well
+	const auditor authz.Role = "auditor"
+	if err := store.SetUserRoles(ctx, "multi_role_user", []authz.Role{auditor, authz.RoleViewer}); err != nil {
+		t.Fatalf("error setting roles: %v", err)
+	}
+	defer store.DeleteUserRoles(ctx, "multi_role_user")
+
+	headers := authHeaders(t, "multi_role_user")
+	if w := testutils.MakeGetRequestWithHeaders(router, "/api/users", headers, []byte{}); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for a read granted by the second role, got %d", w.Code)
+	}
+	if w := testutils.MakeRequestWithHeaders(router, http.MethodDelete, "/api/users/user2", headers, []byte{}); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a delete granted by none of the roles, got %d", w.Code)
+	}
+
+	roles := []string{string(auditor), string(authz.RoleViewer)}
+	readAndDelete := []string{string(authz.PermissionRead), string(authz.PermissionDelete)}
+	conds := authz.Conditions{authz.CondKeyResourceID: authz.ResourceIDAny}
+	if ok, err := testAuthZSvc.AreRolesAuthorized(ctx, roles, string(authz.ResourceUser), readAndDelete, authz.MatchAny, conds); !ok || err != nil {
+		t.Errorf("expected any-of read and delete to be granted, got %v %v", ok, err)
+	}
+	if ok, err := testAuthZSvc.AreRolesAuthorized(ctx, roles, string(authz.ResourceUser), readAndDelete, authz.MatchAll, conds); ok || err == nil {
+		t.Errorf("expected all-of read and delete to be denied, got %v %v", ok, err)
+	}
+	// The permissions of all-of may be granted by different roles
+	if ok, err := testAuthZSvc.AreRolesAuthorized(ctx, []string{string(authz.RoleViewer), string(authz.RoleAdmin)}, string(authz.ResourceUser),
+		readAndDelete, authz.MatchAll, conds); !ok || err != nil {
+		t.Errorf("expected all-of read and delete to be granted by viewer and admin, got %v %v", ok, err)
+	}
+}
+
+func TestResourceInstanceAuthorization(t *testing.T) {
+	router := testRouter()
+	// user2 only has the user role, which grants the read and the update of its own user
+	self := authHeaders(t, "user2")
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers []testutils.Header
+		body    string
+		want    int
+	}{
+		{"read self", http.MethodGet, "/api/users/user2", self, "", http.StatusOK},
+		{"read another user", http.MethodGet, "/api/users/user1", self, "", http.StatusForbidden},
+		{"list users", http.MethodGet, "/api/users", self, "", http.StatusForbidden},
+		{"update self", http.MethodPatch, "/api/users/user2", self, `{"username":"jane.smith"}`, http.StatusOK},
+		{"replace self", http.MethodPut, "/api/users/user2", self, `{"username":"jane.smith"}`, http.StatusOK},
+		{"update another user", http.MethodPatch, "/api/users/user1", self, `{"username":"jane.smith"}`, http.StatusForbidden},
+		{"delete self", http.MethodDelete, "/api/users/user2", self, "", http.StatusForbidden},
+		{"set own password", http.MethodPut, "/api/users/user2/password", self, `{"password":"` + testutils.TestUserPassword + `"}`, http.StatusForbidden},
+		{"reset own mfa", http.MethodDelete, "/api/users/user2/mfa", self, "", http.StatusForbidden},
+		// The viewer inherits the grants on its own user, and the admin may access any user
+		{"viewer updates self", http.MethodPatch, "/api/users/user1", authHeaders(t, "user1"), `{"username":"john.doe"}`, http.StatusOK},
+		{"viewer updates another user", http.MethodPatch, "/api/users/user2", authHeaders(t, "user1"), `{"username":"jane.smith"}`, http.StatusForbidden},
+		{"admin reads another user", http.MethodGet, "/api/users/user2", authHeaders(t, "client_user"), "", http.StatusOK},
+		{"admin updates another user", http.MethodPatch, "/api/users/user2", authHeaders(t, "client_user"), `{"username":"jane.smith"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := testutils.MakeRequestWithHeaders(router, tt.method, tt.path, tt.headers, []byte(tt.body)); w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+		}
+	}
+}
+
+func TestJWKSAndKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	testutils.WriteRSAKeyPair(t, dir, "k1")
+	cfg := &config.Config{SigningMethod: "rsa", KeyDir: dir, SigningKeyID: "k1"}
+	authNSvc := authn.InitService(store)
+	authNSvc.Cfg = cfg
+	router := router(&App{
+		ctx:          context.Background(),
+		config:       cfg,
+		db:           store,
+		authNService: authNSvc,
+		authZService: testAuthZSvc,
+	})
+
+	fetchJWKS := func() authn.JWKSet {
+		w := testutils.MakeGetRequestWithHeaders(router, "/.well-known/jwks.json", []testutils.Header{}, []byte{})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		var jwks authn.JWKSet
+		if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil {
+			t.Fatalf("error processing resp: %v", err)
+		}
+		return jwks
+	}
+	issue := func(expectedKid string) string {
+		token, err := authNSvc.GenerateToken("client_user")
+		if err != nil {
+			t.Fatalf("error generating token: %v", err)
+		}
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+		if err != nil || parsed.Header["kid"] != expectedKid {
+			t.Errorf("expected kid %s, got %v, err %v", expectedKid, parsed.Header["kid"], err)
+		}
+		return token
+	}
+	getUsers := func(token string) int {
+		headers := []testutils.Header{{Name: "Authorization", Value: "Bearer " + token}}
+		return testutils.MakeGetRequestWithHeaders(router, "/api/users", headers, []byte{}).Code
+	}
+
+	jwks := fetchJWKS()
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "k1" || jwks.Keys[0].Kty != "RSA" || jwks.Keys[0].N == "" || jwks.Keys[0].E != "AQAB" {
+		t.Errorf("unexpected jwks %v", jwks)
+	}
+	token1 := issue("k1")
+
+	// Rotate to a new key, keeping the old one for validation
+	testutils.WriteRSAKeyPair(t, dir, "k2")
+	cfg.SigningKeyID = "k2"
+	token2 := issue("k2")
+	if len(fetchJWKS().Keys) != 2 {
+		t.Errorf("expected both keys in jwks")
+	}
+	if code := getUsers(token1); code != http.StatusOK {
+		t.Errorf("expected 200 for a token signed with the retiring key, got %d", code)
+	}
+	if code := getUsers(token2); code != http.StatusOK {
+		t.Errorf("expected 200 for a token signed with the active key, got %d", code)
+	}
+
+	// A retiring key only needs its public key
+	os.Remove(filepath.Join(dir, "k1.private.pem"))
+	if code := getUsers(token1); code != http.StatusOK {
+		t.Errorf("expected 200 for a token signed with the retiring key, got %d", code)
+	}
+	// Once the retiring key is removed, the tokens it signed are no longer accepted
+	os.Remove(filepath.Join(dir, "k1.public.pem"))
+	if code := getUsers(token1); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a token signed with a removed key, got %d", code)
+	}
+	if code := getUsers(token2); code != http.StatusOK {
+		t.Errorf("expected 200 for a token signed with the active key, got %d", code)
 	}
 }
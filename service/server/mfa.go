@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"user-service/errorx"
+	"user-service/users"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type loginMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// LoginMFA completes the login of a user with MFA enabled. The MFA challenge token returned by Login is exchanged for the token pair,
+// along with a TOTP code or one of the recovery codes.
+func (app *App) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req loginMFARequest
+	if err := decodeBody(w, r, &req); err != nil || req.MFAToken == "" || req.Code == "" {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Malformed request body"})
+		return
+	}
+	id, amr, err := app.authNService.VerifyMFAChallenge(r.Context(), req.MFAToken, req.Code, clientIP(r))
+	if err != nil {
+		if respondWithLockout(w, r, err) {
+			return
+		}
+		switch err.Error() {
+		case string(errorx.InvalidToken):
+			RespondWithData(w, r, http.StatusUnauthorized, errorx.Error{Code: errorx.InvalidToken, Message: "Invalid or expired MFA token"})
+		case string(errorx.InvalidCredentials):
+			RespondWithData(w, r, http.StatusUnauthorized, errorx.Error{Code: errorx.InvalidCredentials, Message: "Invalid code"})
+		default:
+			RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError})
+		}
+		return
+	}
+	app.respondWithTokenPair(w, r, id, amr...)
+}
+
+// EnrollTOTP starts the TOTP enrollment of the authenticated user, and returns the secret for the authenticator app.
+func (app *App) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userId, _ := r.Context().Value(users.UserIdInReqCtx).(string)
+	// The user may have been deleted since the token was issued
+	if _, err := users.FetchUser(r.Context(), app.db, userId); err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	enrollment, err := app.authNService.EnrollTOTP(r.Context(), userId)
+	if err != nil {
+		respondWithMFAError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	RespondWithData(w, r, http.StatusOK, enrollment)
+}
+
+type confirmTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+// ConfirmTOTP enables MFA for the authenticated user, once the enrollment is confirmed with a valid code.
+// The recovery codes are only ever returned in this response.
+func (app *App) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var req confirmTOTPRequest
+	if err := decodeBody(w, r, &req); err != nil || req.Code == "" {
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "Malformed request body"})
+		return
+	}
+	userId, _ := r.Context().Value(users.UserIdInReqCtx).(string)
+	codes, err := app.authNService.ConfirmTOTP(r.Context(), userId, req.Code)
+	if err != nil {
+		respondWithMFAError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	RespondWithData(w, r, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// DisableMFA removes the second factor of the authenticated user, who has to have logged in with it.
+func (app *App) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	userId, _ := r.Context().Value(users.UserIdInReqCtx).(string)
+	if err := app.authNService.DisableMFA(r.Context(), userId); err != nil {
+		respondWithMFAError(w, r, err)
+		return
+	}
+	RespondWithData(w, r, http.StatusNoContent, nil)
+}
+
+// ResetUserMFA removes the second factor of a user, e.g. after the loss of both the device and the recovery codes.
+func (app *App) ResetUserMFA(w http.ResponseWriter, r *http.Request) {
+	usr, err := users.FetchUser(r.Context(), app.db, chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	if err := app.authNService.DisableMFA(r.Context(), string(usr.ID)); err != nil {
+		respondWithMFAError(w, r, err)
+		return
+	}
+	RespondWithData(w, r, http.StatusNoContent, nil)
+}
+
+// respondWithMFAError maps the errors of the MFA enrollment to an appropriate response.
+func respondWithMFAError(w http.ResponseWriter, r *http.Request, err error) {
+	var e errorx.Error
+	errors.As(err, &e)
+	switch e.Code {
+	case errorx.InvalidCredentials:
+		RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.InvalidCredentials, Message: "Invalid code"})
+	case errorx.NotFound:
+		RespondWithData(w, r, http.StatusNotFound, errorx.Error{Code: errorx.NotFound, Message: "No pending MFA enrollment"})
+	case errorx.Conflict:
+		RespondWithData(w, r, http.StatusConflict, errorx.Error{Code: errorx.Conflict, Message: "MFA is already enabled"})
+	default:
+		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError})
+	}
+}
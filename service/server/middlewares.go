@@ -2,11 +2,18 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"strings"
+	"user-service/authn"
 	"user-service/authz"
 	"user-service/errorx"
+	"user-service/timesource"
 	"user-service/users"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type Method string
@@ -14,35 +21,81 @@ type Path string
 type MiddlewareFlags struct {
 	AuthN bool
 	AuthZ authz.AccessRights
+	// Whether all of the AuthZ.Permissions are required (the default), or any one of them
+	AuthZMatch authz.Match
+	// The route param that holds the id of the accessed resource, which is passed to the authorizer as its resource_id attribute
+	ResourceIDParam string
+	MFA             bool // Requires a token from a login with a second factor, as per its amr claim
+	// The scopes that the token has to carry, all of them. They limit what a client may do on behalf of a user, on top of the role.
+	Scopes []string
 }
 
+type ctxKey string
+
+// The amr and the scope claims of the token, put into the req context next to the user id
+const (
+	amrInReqCtx    ctxKey = "amr"
+	scopesInReqCtx ctxKey = "scopes"
+)
+
 // This middlewareOpts map can very well be stored in db, and populated in memory/cache during app init.
 // But, it is fine to hardcode here for this sample service.
+// The paths are the route patterns of the router, as the middlewares run once the request has been routed. A route that is not listed
+// needs neither authentication nor authorization.
+//
+// The routes on a single user pass its id to the authorizer, via their ResourceIDParam, so that the grants on the own user of the subject
+// apply. The other routes pass the ResourceIDAny id, so that only the grants on any user apply, e.g. only an admin may list the users,
+// or set the password of a user.
 var middlewareOpts = map[Method]map[Path]MiddlewareFlags{
 	http.MethodGet: {
-		basePath + "/users": {AuthN: true, AuthZ: authz.AccessRights{
-			Role:        authz.RoleViewer,
-			Resource:    authz.ResourceUser,
-			Permissions: []authz.Permission{authz.PermissionRead},
-			Conditions:  authz.Conditions{authz.CondKeyResourceID: authz.ResourceIDAny},
-		}},
-		basePath + "/token": {},
+		basePath + "/users":      {AuthN: true, Scopes: []string{authn.ScopeUsersRead}, AuthZ: userRights(authz.RoleViewer, authz.PermissionRead)},
+		basePath + "/users/{id}": {AuthN: true, Scopes: []string{authn.ScopeUsersRead}, AuthZ: userRights(authz.RoleUser, authz.PermissionRead), ResourceIDParam: "id"},
+		basePath + "/userinfo":   {AuthN: true, Scopes: []string{authn.ScopeOpenID}},
+	},
+	http.MethodPost: {
+		basePath + "/mfa/totp":        {AuthN: true},
+		basePath + "/mfa/totp/verify": {AuthN: true},
+		basePath + "/users":           {AuthN: true, Scopes: []string{authn.ScopeUsersWrite}, AuthZ: userRights(authz.RoleAdmin, authz.PermissionCreate)},
+	},
+	http.MethodPut: {
+		basePath + "/users/{id}":          {AuthN: true, Scopes: []string{authn.ScopeUsersWrite}, AuthZ: userRights(authz.RoleUser, authz.PermissionUpdate), ResourceIDParam: "id"},
+		basePath + "/users/{id}/password": {AuthN: true, Scopes: []string{authn.ScopeUsersWrite}, AuthZ: userRights(authz.RoleAdmin, authz.PermissionUpdate)},
+	},
+	http.MethodPatch: {
+		basePath + "/users/{id}": {AuthN: true, Scopes: []string{authn.ScopeUsersWrite}, AuthZ: userRights(authz.RoleUser, authz.PermissionUpdate), ResourceIDParam: "id"},
+	},
+	http.MethodDelete: {
+		basePath + "/mfa":                {AuthN: true, MFA: true},
+		basePath + "/users/{id}":         {AuthN: true, Scopes: []string{authn.ScopeUsersWrite}, AuthZ: userRights(authz.RoleAdmin, authz.PermissionDelete), ResourceIDParam: "id"},
+		basePath + "/users/{id}/lockout": {AuthN: true, Scopes: []string{authn.ScopeUsersWrite}, AuthZ: userRights(authz.RoleAdmin, authz.PermissionUpdate)},
+		basePath + "/users/{id}/mfa":     {AuthN: true, Scopes: []string{authn.ScopeUsersWrite}, AuthZ: userRights(authz.RoleAdmin, authz.PermissionUpdate)},
 	},
 }
 
-func getApiMiddlewareOpts(method Method, reqUrl string) MiddlewareFlags {
-	pathOpts := middlewareOpts[method]
-	for path, opts := range pathOpts {
-		if strings.HasPrefix(reqUrl, string(path)) {
-			return opts
-		}
+// userRights are the access-rights that a route on the users requires. The role is the least one that is granted the access, and is
+// only there for the readers, as the permission is checked against all the roles of the user. The resource id condition is the
+// default one, which a route with a ResourceIDParam replaces with the id of the accessed user.
+func userRights(role authz.Role, permission authz.Permission) authz.AccessRights {
+	return authz.AccessRights{
+		Role:        role,
+		Resource:    authz.ResourceUser,
+		Permissions: []authz.Permission{permission},
+		Conditions:  authz.Conditions{authz.CondKeyResourceID: authz.ResourceIDAny},
+	}
+}
+
+// getApiMiddlewareOpts looks up the options of the route that the request has been routed to.
+func getApiMiddlewareOpts(r *http.Request) MiddlewareFlags {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return MiddlewareFlags{}
 	}
-	return MiddlewareFlags{}
+	return middlewareOpts[Method(r.Method)][Path(rctx.RoutePattern())]
 }
 
 func (a *App) AuthenticationMiddleware(inner http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		opts := getApiMiddlewareOpts(Method(r.Method), r.URL.Path)
+		opts := getApiMiddlewareOpts(r)
 
 		// If authentication is not needed for a request, skip the checks
 		if !opts.AuthN {
@@ -62,7 +115,7 @@ func (a *App) AuthenticationMiddleware(inner http.Handler) http.Handler {
 		}
 
 		token := tokenArray[1]
-		id, err := a.authNService.ValidateToken(strings.TrimSpace(token))
+		claims, err := a.authNService.ValidateToken(strings.TrimSpace(token))
 		if err != nil {
 			switch err.Error() {
 			case string(errorx.InvalidToken):
@@ -72,16 +125,51 @@ func (a *App) AuthenticationMiddleware(inner http.Handler) http.Handler {
 			}
 			return
 		}
+		// A token with a valid signature might still have been revoked before its expiry
+		revoked, err := a.authNService.IsTokenRevoked(r.Context(), claims.ID)
+		if err != nil {
+			RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError})
+			return
+		}
+		if revoked {
+			RespondWithData(w, r, http.StatusUnauthorized, errorx.Error{Code: errorx.InvalidToken, Message: "Invalid API Key"})
+			return
+		}
+
+		// All the routes act on behalf of a user, so the tokens that the clients got for themselves are not accepted
+		if claims.UserID == "" {
+			RespondWithData(w, r, http.StatusForbidden, errorx.Error{Code: errorx.AccessDenied, Message: "Forbidden. A token issued to a user is required"})
+			return
+		}
 
-		// If token is valid, we put the id into the req context
-		r = r.Clone(context.WithValue(r.Context(), users.UserIdInReqCtx, id))
+		// If token is valid, we put the id, along with the authentication methods and the scopes, into the req context
+		ctx := context.WithValue(r.Context(), users.UserIdInReqCtx, claims.UserID)
+		ctx = context.WithValue(ctx, amrInReqCtx, claims.AMR)
+		r = r.Clone(context.WithValue(ctx, scopesInReqCtx, claims.Scopes))
 		inner.ServeHTTP(w, r)
 	})
 }
 
 func (a *App) AuthorizationMiddleware(inner http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		opts := getApiMiddlewareOpts(Method(r.Method), r.URL.Path)
+		opts := getApiMiddlewareOpts(r)
+		if opts.MFA {
+			amr, _ := r.Context().Value(amrInReqCtx).([]string)
+			if !slices.Contains(amr, authn.AMRMFA) {
+				RespondWithData(w, r, http.StatusForbidden, errorx.Error{Code: errorx.MFARequired, Message: "Forbidden. A login with a second factor is required"})
+				return
+			}
+		}
+		// The scopes are checked before the role, as a token with an insufficient scope must not get through, whatever the role
+		scopes, _ := r.Context().Value(scopesInReqCtx).([]string)
+		for _, scope := range opts.Scopes {
+			if !slices.Contains(scopes, scope) {
+				// As per RFC 6750 section 3.1, the client is told which scopes it needs
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(opts.Scopes, " ")))
+				RespondWithData(w, r, http.StatusForbidden, errorx.Error{Code: errorx.InsufficientScope, Message: "Forbidden. The token lacks the required scope"})
+				return
+			}
+		}
 		if opts.AuthZ.Role == "" {
 			inner.ServeHTTP(w, r)
 			return
@@ -92,20 +180,36 @@ func (a *App) AuthorizationMiddleware(inner http.Handler) http.Handler {
 			RespondWithData(w, r, http.StatusBadRequest, errorx.Error{Code: errorx.BadRequestData, Message: "No authenticated user found"})
 			return
 		}
-		roles, ok := a.db.Get("user_roles").(users.UserRoles)
-		if !ok {
-			RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError, Message: "No user_roles found to be matched"})
+		roles, err := a.db.GetUserRoles(r.Context(), users.UserID(userId))
+		if err != nil {
+			RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError, Message: "Could not fetch user roles to be matched"})
 			return
 		}
-		role, ok := roles[users.UserID(userId)]
-		if !ok {
+		if len(roles) == 0 {
 			RespondWithData(w, r, http.StatusForbidden, errorx.Error{Code: errorx.AccessDenied, Message: "Forbidden. Insufficient Permissions"})
 			return
 		}
-		// Since we know that we are dealing with just one role, we will take a shortcut for this sample service and get the role as role[0].
-		// A similar shortcut we will take for Permissions as well, because we are dealing with just one permission.
-		// In production scenario, these checks will be a bit more involved.
-		authorized, err := a.authZService.IsAuthorized(string(role[0]), string(opts.AuthZ.Resource), string(opts.AuthZ.Permissions[0]), opts.AuthZ.Conditions)
+		// All the roles of the user are evaluated, and any of them may grant each of the required permissions
+		roleNames := make([]string, len(roles))
+		for i, role := range roles {
+			roleNames[i] = string(role)
+		}
+		permissions := make([]string, len(opts.AuthZ.Permissions))
+		for i, permission := range opts.AuthZ.Permissions {
+			permissions[i] = string(permission)
+		}
+		// The conditions of the grants are evaluated against the attributes of the request, i.e. the ones of the route,
+		// along with the authenticated user and the time of the request
+		attrs := maps.Clone(opts.AuthZ.Conditions)
+		if attrs == nil {
+			attrs = authz.Conditions{}
+		}
+		if opts.ResourceIDParam != "" {
+			attrs[authz.CondKeyResourceID] = chi.URLParam(r, opts.ResourceIDParam)
+		}
+		attrs[authz.CondKeySubjectID] = userId
+		attrs[authz.CondKeyRequestTime] = timesource.CurrentTime()
+		authorized, err := a.authZService.AreRolesAuthorized(r.Context(), roleNames, string(opts.AuthZ.Resource), permissions, opts.AuthZMatch, attrs)
 		if err != nil {
 			switch err.Error() {
 			case string(errorx.AccessDenied):
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"user-service/authn"
+	"user-service/errorx"
+)
+
+// Grant types, as defined by RFC 6749
+const (
+	grantTypeClientCredentials = "client_credentials"
+	grantTypeAuthorizationCode = "authorization_code"
+)
+
+// The response type of the authorization code flow, as defined by RFC 6749 section 4.1.1
+const responseTypeCode = "code"
+
+// oauthTokenResponse is the successful token response, as defined by RFC 6749 section 5.1.
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// oauthErrorResponse is the error response of the OAuth endpoints, as defined by RFC 6749 section 5.2.
+// It is used instead of errorx.Error on these endpoints, as the OAuth clients expect this format.
+type oauthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func respondWithOAuthError(w http.ResponseWriter, r *http.Request, httpStatus int, code, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if httpStatus == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="user-service"`)
+	}
+	RespondWithData(w, r, httpStatus, oauthErrorResponse{Error: code, ErrorDescription: description})
+}
+
+// clientCredentials reads the client credentials of the request, which are either sent with HTTP Basic authentication
+// (client_secret_basic) or as form parameters (client_secret_post). As per RFC 6749 section 2.3, a request must not use both.
+// The form must have been parsed before.
+func clientCredentials(r *http.Request) (string, string, error) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		if r.PostForm.Has("client_id") || r.PostForm.Has("client_secret") {
+			return "", "", errors.New("more than one client authentication method")
+		}
+		// The credentials are form-urlencoded before being put in the Authorization header, as per RFC 6749 section 2.3.1
+		var err error
+		if id, err = url.QueryUnescape(id); err != nil {
+			return "", "", err
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return "", "", err
+		}
+		return id, secret, nil
+	}
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"), nil
+}
+
+// OAuthToken is the token endpoint of RFC 6749. It supports the client_credentials grant, where a registered client gets an
+// access token for itself, and the authorization_code grant, where a client gets an access token on behalf of a user.
+// The requested audiences of the client_credentials grant are passed via the audience parameter, which may be repeated.
+func (app *App) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Malformed request body")
+		return
+	}
+	grantType := r.PostForm.Get("grant_type")
+	switch grantType {
+	case grantTypeClientCredentials, grantTypeAuthorizationCode:
+	case "":
+		respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Missing grant_type")
+		return
+	default:
+		respondWithOAuthError(w, r, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	id, secret, err := clientCredentials(r)
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Malformed client credentials")
+		return
+	}
+
+	var token authn.AccessToken
+	if grantType == grantTypeAuthorizationCode {
+		token, err = app.authNService.AuthorizationCodeToken(r.Context(), authn.AuthorizationCodeRequest{
+			ClientID:     id,
+			ClientSecret: secret,
+			Code:         r.PostForm.Get("code"),
+			RedirectURI:  r.PostForm.Get("redirect_uri"),
+			CodeVerifier: r.PostForm.Get("code_verifier"),
+		})
+	} else {
+		token, err = app.authNService.ClientCredentialsToken(r.Context(), authn.ClientCredentialsRequest{
+			ClientID:     id,
+			ClientSecret: secret,
+			Scopes:       authn.ParseScope(r.PostForm.Get("scope")),
+			Audiences:    r.PostForm["audience"],
+		})
+	}
+	if err != nil {
+		var e errorx.Error
+		errors.As(err, &e)
+		switch e.Code {
+		case errorx.InvalidClient:
+			respondWithOAuthError(w, r, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		case errorx.InvalidGrant:
+			respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_grant", "Invalid, expired or already used authorization code")
+		case errorx.InvalidScope:
+			respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_scope", "The requested scope is not allowed for the client")
+		case errorx.InvalidTarget:
+			respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_target", "The requested audience is not allowed for the client")
+		default:
+			respondWithOAuthError(w, r, http.StatusInternalServerError, "server_error", "")
+		}
+		return
+	}
+
+	// As per RFC 6749 section 5.1, the responses that carry tokens must not be cached
+	w.Header().Set("Cache-Control", "no-store")
+	RespondWithData(w, r, http.StatusOK, oauthTokenResponse{
+		AccessToken: token.Token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(token.ExpiresIn.Seconds()),
+		Scope:       strings.Join(token.Scopes, " "),
+		IDToken:     token.IDToken,
+	})
+}
+
+// Authorize is the authorization endpoint of the authorization code flow (RFC 6749 section 4.1), with mandatory PKCE.
+// The service has no login page of its own - the login page of the frontend posts the parameters of the authorization request
+// along with the credentials of the user, i.e. id, password, and mfa_code for the users with MFA enabled. The credentials are only
+// read from the body, to keep them out of the URLs and the logs. The errors of the login are returned to the login page, so that the
+// user can try again, while the errors of the request are sent to the redirect URI, once it is known to be registered for the client.
+func (app *App) Authorize(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Malformed request")
+		return
+	}
+	req := authn.AuthorizationRequest{
+		ClientID:            r.Form.Get("client_id"),
+		RedirectURI:         r.Form.Get("redirect_uri"),
+		Scopes:              authn.ParseScope(r.Form.Get("scope")),
+		CodeChallenge:       r.Form.Get("code_challenge"),
+		CodeChallengeMethod: r.Form.Get("code_challenge_method"),
+		Nonce:               r.Form.Get("nonce"),
+	}
+	state := r.Form.Get("state")
+	if err := app.authNService.ValidateAuthorizationRequest(r.Context(), req); err != nil {
+		var e errorx.Error
+		errors.As(err, &e)
+		switch e.Code {
+		// The user is not sent to an unknown client, or to a redirect URI that is not registered, as it could be anywhere
+		case errorx.InvalidClient:
+			respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Unknown client_id")
+		case errorx.InvalidRedirectURI:
+			respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_request", "The redirect_uri is not registered for the client")
+		case errorx.BadRequestData:
+			redirectWithOAuthError(w, r, req.RedirectURI, state, "invalid_request", e.Message)
+		case errorx.InvalidScope:
+			redirectWithOAuthError(w, r, req.RedirectURI, state, "invalid_scope", "The requested scope is not allowed for the client")
+		default:
+			respondWithOAuthError(w, r, http.StatusInternalServerError, "server_error", "")
+		}
+		return
+	}
+	if r.Form.Get("response_type") != responseTypeCode {
+		redirectWithOAuthError(w, r, req.RedirectURI, state, "unsupported_response_type", "")
+		return
+	}
+	id, password := r.PostForm.Get("id"), r.PostForm.Get("password")
+	if id == "" || password == "" {
+		redirectWithOAuthError(w, r, req.RedirectURI, state, "login_required", "")
+		return
+	}
+	amr, ok := app.loginForAuthorization(w, r, id, password, r.PostForm.Get("mfa_code"))
+	if !ok {
+		return
+	}
+	code, err := app.authNService.IssueAuthorizationCode(r.Context(), req, id, amr...)
+	if err != nil {
+		redirectWithOAuthError(w, r, req.RedirectURI, state, "server_error", "")
+		return
+	}
+	params := url.Values{"code": {code}}
+	if state != "" {
+		params.Set("state", state)
+	}
+	redirectToClient(w, r, req.RedirectURI, params)
+}
+
+// loginForAuthorization checks the credentials of the user on the authorization endpoint, the same as the Login and the LoginMFA do,
+// and returns the methods the user authenticated with. It responds with the error, and reports false, if the login fails.
+func (app *App) loginForAuthorization(w http.ResponseWriter, r *http.Request, id, password, mfaCode string) ([]string, bool) {
+	challenge, err := app.authNService.Login(r.Context(), id, password, clientIP(r))
+	if err == nil && challenge == "" {
+		return []string{authn.AMRPassword}, true
+	}
+	if err == nil {
+		if mfaCode == "" {
+			RespondWithData(w, r, http.StatusUnauthorized, errorx.Error{Code: errorx.MFARequired, Message: "A second factor is required, in the mfa_code parameter"})
+			return nil, false
+		}
+		var amr []string
+		if _, amr, err = app.authNService.VerifyMFAChallenge(r.Context(), challenge, mfaCode, clientIP(r)); err == nil {
+			return amr, true
+		}
+	}
+	if respondWithLockout(w, r, err) {
+		return nil, false
+	}
+	switch err.Error() {
+	case string(errorx.InvalidCredentials):
+		RespondWithData(w, r, http.StatusUnauthorized, errorx.Error{Code: errorx.InvalidCredentials, Message: "Invalid user id, password or code"})
+	default:
+		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError})
+	}
+	return nil, false
+}
+
+// redirectToClient sends the user back to the redirect URI of the client, with the params added to its query, as per RFC 6749 section 4.1.2.
+// The 303 status makes the browser follow the redirect with a GET, after a posted login form.
+func redirectToClient(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// redirectWithOAuthError sends an error of the authorization request to the redirect URI, as per RFC 6749 section 4.1.2.1.
+func redirectWithOAuthError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) {
+	params := url.Values{"error": {code}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	redirectToClient(w, r, redirectURI, params)
+}
+
+// IntrospectToken is the introspection endpoint of RFC 7662, for the services that can not validate the tokens on their own.
+// The caller has to be a registered client, which authenticates in the same ways as on the token endpoint.
+// The token_type_hint parameter is ignored, as only the access tokens can be active.
+func (app *App) IntrospectToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Malformed request body")
+		return
+	}
+	id, secret, err := clientCredentials(r)
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Malformed client credentials")
+		return
+	}
+	if _, err := app.authNService.AuthenticateClient(r.Context(), id, secret); err != nil {
+		switch err.Error() {
+		case string(errorx.InvalidClient):
+			respondWithOAuthError(w, r, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		default:
+			respondWithOAuthError(w, r, http.StatusInternalServerError, "server_error", "")
+		}
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		respondWithOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Missing token")
+		return
+	}
+	introspection, err := app.authNService.IntrospectToken(r.Context(), token)
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	RespondWithData(w, r, http.StatusOK, introspection)
+}
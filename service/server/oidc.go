@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"user-service/errorx"
+	"user-service/users"
+)
+
+// userInfo holds the standard claims of OpenID Connect Core 1.0 section 5.1 that can be derived from a user.
+type userInfo struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// GetOpenIDConfiguration serves the OpenID Connect discovery document, for the relying parties to configure themselves.
+// The endpoints are built from the configured issuer rather than the request, whose Host header is up to the caller.
+// There is no discovery document with the hmac signing method, which does not issue ID tokens.
+func (app *App) GetOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	metadata, err := app.authNService.OpenIDConfiguration()
+	if err != nil {
+		var e errorx.Error
+		if errors.As(err, &e) && e.Code == errorx.NotFound {
+			RespondWithData(w, r, http.StatusNotFound, e)
+			return
+		}
+		RespondWithData(w, r, http.StatusInternalServerError, errorx.Error{Code: errorx.ServerError})
+		return
+	}
+	RespondWithData(w, r, http.StatusOK, metadata)
+}
+
+// GetUserInfo is the userinfo endpoint of OpenID Connect, which returns the claims about the authenticated user.
+// As per OpenID Connect Core 1.0 section 5.3, it requires an access token that was granted the openid scope.
+func (app *App) GetUserInfo(w http.ResponseWriter, r *http.Request) {
+	userId, _ := r.Context().Value(users.UserIdInReqCtx).(string)
+	usr, err := users.FetchUser(r.Context(), app.db, userId)
+	if err != nil {
+		respondWithUserError(w, r, err)
+		return
+	}
+	RespondWithData(w, r, http.StatusOK, userInfo{Subject: string(usr.ID), PreferredUsername: usr.Name})
+}
@@ -21,21 +21,102 @@ func router(app *App) *chi.Mux {
 	r.Use(
 		// NOTE: A CORS middleware can be placed if there is need for it
 		chimiddle.Logger,
-		app.AuthenticationMiddleware,
-		app.AuthorizationMiddleware,
 	)
 	routes := []Route{
 		{
-			// This is a helper open endpoint to get a token via an http request.
-			// Usually, token issuance happens to a registered client.
-			// During registration, the client gets issued a client_id and a client_secret.
-			// At the time of registration, the client should also provide its public key to the server.
-			// This public key is used to verify the signature of the client when the client initiates the process of token generation.
-			// But, for this sample service, in the interest of time, this open endpoint is fine.
-			Name:        "GetToken",
+			// The user id and password in the request body are the credentials, so no Authorization header is needed.
+			Name:        "Login",
+			Method:      "POST",
+			Pattern:     basePath + "/login",
+			HandlerFunc: app.Login,
+		},
+		{
+			// The MFA challenge token, returned by the Login for the users with MFA enabled, is the credential along with the code.
+			Name:        "LoginMFA",
+			Method:      "POST",
+			Pattern:     basePath + "/login/mfa",
+			HandlerFunc: app.LoginMFA,
+		},
+		{
+			// The MFA endpoints work on the authenticated user, rather than a user in the path.
+			Name:        "EnrollTOTP",
+			Method:      "POST",
+			Pattern:     basePath + "/mfa/totp",
+			HandlerFunc: app.EnrollTOTP,
+		},
+		{
+			Name:        "ConfirmTOTP",
+			Method:      "POST",
+			Pattern:     basePath + "/mfa/totp/verify",
+			HandlerFunc: app.ConfirmTOTP,
+		},
+		{
+			Name:        "DisableMFA",
+			Method:      "DELETE",
+			Pattern:     basePath + "/mfa",
+			HandlerFunc: app.DisableMFA,
+		},
+		{
+			// The authorization endpoint of the authorization code flow. The login page of the frontend posts the credentials of the user,
+			// while a plain redirect of the browser is sent back to the client with the login_required error.
+			Name:        "Authorize",
+			Method:      "GET",
+			Pattern:     basePath + "/oauth/authorize",
+			HandlerFunc: app.Authorize,
+		},
+		{
+			Name:        "AuthorizeWithLogin",
+			Method:      "POST",
+			Pattern:     basePath + "/oauth/authorize",
+			HandlerFunc: app.Authorize,
+		},
+		{
+			// The OAuth2 token endpoint, where a registered client authenticates with its client_id and client_secret,
+			// or a public client identifies itself with its client_id, and proves the possession of the PKCE code verifier.
+			Name:        "OAuthToken",
+			Method:      "POST",
+			Pattern:     basePath + "/oauth/token",
+			HandlerFunc: app.OAuthToken,
+		},
+		{
+			// The refresh token in the request body is the credential, so no Authorization header is needed.
+			Name:        "RefreshToken",
+			Method:      "POST",
+			Pattern:     basePath + "/token/refresh",
+			HandlerFunc: app.RefreshToken,
+		},
+		{
+			// Similar to the refresh endpoint, possessing the token is enough to revoke it.
+			Name:        "RevokeToken",
+			Method:      "POST",
+			Pattern:     basePath + "/token/revoke",
+			HandlerFunc: app.RevokeToken,
+		},
+		{
+			// A registered client authenticates with its client_id and client_secret, as on the OAuth2 token endpoint.
+			Name:        "IntrospectToken",
+			Method:      "POST",
+			Pattern:     basePath + "/token/introspect",
+			HandlerFunc: app.IntrospectToken,
+		},
+		{
+			// Well-known endpoints are served outside of the basePath, at the locations that clients expect them.
+			Name:        "GetJWKS",
 			Method:      "GET",
-			Pattern:     basePath + "/token",
-			HandlerFunc: app.GetToken,
+			Pattern:     "/.well-known/jwks.json",
+			HandlerFunc: app.GetJWKS,
+		},
+		{
+			Name:        "GetOpenIDConfiguration",
+			Method:      "GET",
+			Pattern:     "/.well-known/openid-configuration",
+			HandlerFunc: app.GetOpenIDConfiguration,
+		},
+		{
+			Name:        "GetUserInfo",
+			Method:      "GET",
+			Pattern:     basePath + "/userinfo",
+			HandlerFunc: app.GetUserInfo,
 		},
 		{
 			Name:        "GetUser",
@@ -43,10 +124,60 @@ func router(app *App) *chi.Mux {
 			Pattern:     basePath + "/users",
 			HandlerFunc: app.GetUsers,
 		},
+		{
+			Name:        "CreateUser",
+			Method:      "POST",
+			Pattern:     basePath + "/users",
+			HandlerFunc: app.CreateUser,
+		},
+		{
+			Name:        "GetUserByID",
+			Method:      "GET",
+			Pattern:     basePath + "/users/{id}",
+			HandlerFunc: app.GetUser,
+		},
+		{
+			Name:        "UpdateUser",
+			Method:      "PUT",
+			Pattern:     basePath + "/users/{id}",
+			HandlerFunc: app.UpdateUser,
+		},
+		{
+			Name:        "PatchUser",
+			Method:      "PATCH",
+			Pattern:     basePath + "/users/{id}",
+			HandlerFunc: app.PatchUser,
+		},
+		{
+			Name:        "SetUserPassword",
+			Method:      "PUT",
+			Pattern:     basePath + "/users/{id}/password",
+			HandlerFunc: app.SetUserPassword,
+		},
+		{
+			Name:        "UnlockUser",
+			Method:      "DELETE",
+			Pattern:     basePath + "/users/{id}/lockout",
+			HandlerFunc: app.UnlockUser,
+		},
+		{
+			Name:        "ResetUserMFA",
+			Method:      "DELETE",
+			Pattern:     basePath + "/users/{id}/mfa",
+			HandlerFunc: app.ResetUserMFA,
+		},
+		{
+			Name:        "DeleteUser",
+			Method:      "DELETE",
+			Pattern:     basePath + "/users/{id}",
+			HandlerFunc: app.DeleteUser,
+		},
 	}
 
+	// The authentication and authorization middlewares run once a request has been routed, so that they can look up the options
+	// of the route by its pattern, and read the route params.
 	for _, v := range routes {
-		r.MethodFunc(v.Method, v.Pattern, v.HandlerFunc)
+		r.With(app.AuthenticationMiddleware, app.AuthorizationMiddleware).MethodFunc(v.Method, v.Pattern, v.HandlerFunc)
 	}
 
 	return r
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -9,6 +10,8 @@ import (
 	"sync"
 	"syscall"
 	"time"
+	"user-service/authn"
+	"user-service/commons"
 	"user-service/config"
 	"user-service/users"
 
@@ -21,6 +24,7 @@ type UserService struct {
 	router  *chi.Mux
 	configs *config.Config
 	wg      *sync.WaitGroup
+	db      commons.Datastore
 }
 
 func (s *UserService) init(ctx context.Context) {
@@ -29,9 +33,22 @@ func (s *UserService) init(ctx context.Context) {
 	s.router = router(a)
 	s.configs = a.config
 	s.wg = a.waitgroup
+	s.db = a.db
 
-	// We do some db state init here, ignoring error handling in this case for this sample service.
-	users.InitStoreData(a.db)
+	// We do some db state init here. The service does not start with a partial state, e.g. when a sample password
+	// does not meet the password policy, as it would be left without the users or clients that were asked for.
+	// The sample data is only seeded into an empty datastore, and only if asked for.
+	if err := users.InitPolicyData(ctx, a.db); err != nil {
+		log.Fatal("error initializing the rbac policy: ", err)
+	}
+	if a.config.SeedSampleData {
+		if err := users.InitStoreData(ctx, a.db, a.config.SampleUsersPassword, a.config.SampleAdminPassword, a.authNService.SetPassword); err != nil {
+			log.Fatal("error seeding the sample users: ", err)
+		}
+	}
+	if err := authn.InitClientData(ctx, a.db, a.config.Audiences[0], a.config.SampleClientSecret); err != nil {
+		log.Fatal("error initializing the registered clients: ", err)
+	}
 }
 
 func GetService(ctx context.Context) *UserService {
@@ -63,12 +80,19 @@ func (s *UserService) StartServer(ctx context.Context, cancel context.CancelFunc
 	cancel()
 	log.Println("INFO: gracefully shutting down...")
 
-	ctxWithTimeOut, _ := context.WithTimeout(context.Background(), timeout)
+	ctxWithTimeOut, cancelTimeout := context.WithTimeout(context.Background(), timeout)
+	defer cancelTimeout()
 	// We start the server shutdown with the provided timeout
 	if err := srv.Shutdown(ctxWithTimeOut); err != nil {
 		log.Println("ERROR: error shutting down the server via srv.Shutdown: ", err)
 	}
 
 	s.wg.Wait()
+	// Persistent datastores hold on to resources such as open files, which need to be released.
+	if closer, ok := s.db.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Println("ERROR: error closing the datastore: ", err)
+		}
+	}
 	log.Println("INFO: server shut down gracefully")
 }
@@ -1,23 +1,141 @@
 package testutils
 
-import "user-service/authn"
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"user-service/authn"
 
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestHMACSecret is the secret that the tokens of the TestAuthNService are signed with. It is only ever used in the tests.
+const TestHMACSecret = "t3st-only-hmac-secret-8f2b6c1e9d4a7035"
+
+// TestIDTokenKeyID is the kid of the key that the ID tokens of the TestAuthNService are signed with.
+const TestIDTokenKeyID = "test-id-token"
+
+// TestAuthNService signs the access tokens with an HMAC secret, as with the hmac signing-method.
+// The ID tokens are signed with an Ed25519 key instead, as the service only issues them with an asymmetric signing-method.
 type TestAuthNService struct {
-	Name   string
-	Secret string
+	Tokens         authn.TokenSettings
+	Secret         string
+	IDTokenKey     ed25519.PrivateKey
+	PasswordPolicy *authn.PasswordPolicy
+	store          authn.Store
 }
 
-func InitTestAuthNService() *TestAuthNService {
+func InitTestAuthNService(db authn.Store) *TestAuthNService {
+	policy, _ := authn.LoadPasswordPolicy(12, "")
+	tokens := authn.DefaultTokenSettings()
+	tokens.Issuer = "https://users.example.com"
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
 	return &TestAuthNService{
-		Name:   "user-service",
-		Secret: "mysupersecret",
+		Tokens:         tokens,
+		Secret:         TestHMACSecret,
+		IDTokenKey:     key,
+		PasswordPolicy: policy,
+		store:          db,
+	}
+}
+
+func (s *TestAuthNService) GenerateToken(id string, amr ...string) (string, error) {
+	return authn.GenerateHMACSignedToken(id, s.Tokens, s.Secret, amr...)
+}
+
+func (s *TestAuthNService) ValidateToken(token string) (authn.Claims, error) {
+	return authn.ValidateHMACSignedToken(token, s.Tokens, []string{s.Secret})
+}
+
+func (s *TestAuthNService) IssueRefreshToken(ctx context.Context, id string, amr ...string) (string, error) {
+	return authn.IssueRefreshToken(ctx, s.store, s.Tokens.RefreshTokenTTL, id, "", amr)
+}
+
+func (s *TestAuthNService) RefreshToken(ctx context.Context, refreshToken string) (string, string, error) {
+	rt, newRefreshToken, err := authn.RotateRefreshToken(ctx, s.store, s.Tokens.RefreshTokenTTL, refreshToken)
+	if err != nil {
+		return "", "", err
+	}
+	token, err := s.GenerateToken(rt.UserID, rt.AMR...)
+	if err != nil {
+		return "", "", err
+	}
+	return token, newRefreshToken, nil
+}
+
+func (s *TestAuthNService) RevokeToken(ctx context.Context, token string, hint string) error {
+	return authn.RevokeToken(ctx, s.ValidateToken, s.store, token, hint)
+}
+
+func (s *TestAuthNService) IntrospectToken(ctx context.Context, token string) (authn.Introspection, error) {
+	return authn.IntrospectToken(ctx, s.ValidateToken, s.store, token)
+}
+
+func (s *TestAuthNService) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	return s.store.IsTokenRevoked(ctx, jti)
+}
+
+func (s *TestAuthNService) JWKS() (authn.JWKSet, error) {
+	keys := authn.KeySet{Keys: []authn.Key{{ID: TestIDTokenKeyID, PublicKey: s.IDTokenKey.Public(), PrivateKey: s.IDTokenKey}}, ActiveID: TestIDTokenKeyID}
+	return keys.JWKS(), nil
+}
+
+func (s *TestAuthNService) OpenIDConfiguration() (authn.ProviderMetadata, error) {
+	return authn.OpenIDConfiguration(s.Tokens.Issuer, []string{jwt.SigningMethodEdDSA.Alg()}), nil
+}
+
+func (s *TestAuthNService) AuthenticateClient(ctx context.Context, id, secret string) (authn.Client, error) {
+	return authn.AuthenticateClient(ctx, s.store, id, secret)
+}
+
+func (s *TestAuthNService) ClientCredentialsToken(ctx context.Context, req authn.ClientCredentialsRequest) (authn.AccessToken, error) {
+	sign := func(claims jwt.MapClaims) (string, error) { return authn.SignHMACToken(claims, s.Secret) }
+	return authn.IssueClientCredentialsToken(ctx, s.store, sign, s.Tokens, req)
+}
+
+func (s *TestAuthNService) ValidateAuthorizationRequest(ctx context.Context, req authn.AuthorizationRequest) error {
+	_, err := authn.ValidateAuthorizationRequest(ctx, s.store, req)
+	return err
+}
+
+func (s *TestAuthNService) IssueAuthorizationCode(ctx context.Context, req authn.AuthorizationRequest, id string, amr ...string) (string, error) {
+	return authn.IssueAuthorizationCode(ctx, s.store, req, id, amr)
+}
+
+func (s *TestAuthNService) AuthorizationCodeToken(ctx context.Context, req authn.AuthorizationCodeRequest) (authn.AccessToken, error) {
+	sign := func(claims jwt.MapClaims) (string, error) { return authn.SignHMACToken(claims, s.Secret) }
+	signIDToken := func(claims jwt.MapClaims) (string, error) {
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims, nil)
+		token.Header["kid"] = TestIDTokenKeyID
+		return token.SignedString(s.IDTokenKey)
 	}
+	return authn.ExchangeAuthorizationCode(ctx, s.store, sign, signIDToken, s.Tokens, req)
+}
+
+func (s *TestAuthNService) Login(ctx context.Context, id, password, ip string) (string, error) {
+	return authn.Login(ctx, s.store, id, password, ip)
+}
+
+func (s *TestAuthNService) VerifyMFAChallenge(ctx context.Context, challenge, code, ip string) (string, []string, error) {
+	return authn.VerifyMFAChallenge(ctx, s.store, challenge, code, ip)
+}
+
+func (s *TestAuthNService) EnrollTOTP(ctx context.Context, id string) (authn.TOTPEnrollment, error) {
+	return authn.EnrollTOTP(ctx, s.store, s.Tokens.IssuerName(), id)
+}
+
+func (s *TestAuthNService) ConfirmTOTP(ctx context.Context, id, code string) ([]string, error) {
+	return authn.ConfirmTOTP(ctx, s.store, id, code)
+}
+
+func (s *TestAuthNService) DisableMFA(ctx context.Context, id string) error {
+	return authn.DisableMFA(ctx, s.store, id)
 }
 
-func (s *TestAuthNService) GenerateToken(id string) (string, error) {
-	return authn.GenerateHMACSignedToken(id, s.Name, s.Secret)
+func (s *TestAuthNService) UnlockAccount(ctx context.Context, id string) error {
+	return authn.UnlockAccount(ctx, s.store, id)
 }
 
-func (s *TestAuthNService) ValidateToken(token string) (string, error) {
-	return authn.ValidateHMACSignedToken(token, s.Name, s.Secret)
+func (s *TestAuthNService) SetPassword(ctx context.Context, id, password string) error {
+	return authn.SetPassword(ctx, s.store, s.PasswordPolicy, id, password)
 }
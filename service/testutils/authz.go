@@ -1,21 +1,23 @@
 package testutils
 
-import "user-service/authz"
-
-type Datastore interface {
-	Get(key string) interface{}
-	Set(key string, val interface{}) error
-}
+import (
+	"context"
+	"user-service/authz"
+)
 
 type TestAuthZService struct {
-	store Datastore
+	store authz.PolicyRepository
 }
 
 // Sample initialization
-func InitTestAuthZService(db Datastore) *TestAuthZService {
+func InitTestAuthZService(db authz.PolicyRepository) *TestAuthZService {
 	return &TestAuthZService{store: db}
 }
 
-func (s *TestAuthZService) IsAuthorized(role string, resource string, permission string, conditions interface{}) (bool, error) {
-	return authz.IsRoleAuthorized(s.store, role, resource, permission, conditions)
+func (s *TestAuthZService) IsAuthorized(ctx context.Context, role string, resource string, permission string, conditions interface{}) (bool, error) {
+	return authz.IsRoleAuthorized(ctx, s.store, role, resource, permission, conditions)
+}
+
+func (s *TestAuthZService) AreRolesAuthorized(ctx context.Context, roles []string, resource string, permissions []string, match authz.Match, conditions interface{}) (bool, error) {
+	return authz.AreRolesAuthorized(ctx, s.store, roles, resource, permissions, match, conditions)
 }
@@ -1,21 +1,31 @@
 package testutils
 
 import (
+	"context"
+	"user-service/authn"
 	"user-service/authz"
+	"user-service/datastore"
 	"user-service/users"
 )
 
-type TestStore struct {
-	Data map[string]interface{}
-}
+// Password of the test users that can log in, i.e. client_user and user1.
+const TestUserPassword = "test-users-password"
 
-func (s *TestStore) Get(key string) interface{} {
-	return s.Data[key]
-}
+// Credentials of the registered test client. Its id is also the audience expected by the token validation.
+const (
+	TestClientID     = "client1"
+	TestClientSecret = "myclientsecret"
+)
+
+// The registered public test client, for the authorization code flow, along with its redirect URI.
+const (
+	TestPublicClientID = "webapp"
+	TestRedirectURI    = "https://app.example.com/callback"
+)
 
-func (s *TestStore) Set(key string, val interface{}) error {
-	s.Data[key] = val
-	return nil
+// TestStore is an in-memory datastore, seeded with the test data.
+type TestStore struct {
+	*datastore.Store
 }
 
 // Sample initialization
@@ -36,12 +46,24 @@ func InitTestStore() *TestStore {
 	}
 
 	userRoles := users.UserRoles{
-		users.UserID("client_user"): []authz.Role{authz.RoleViewer},
+		users.UserID("client_user"): []authz.Role{authz.RoleAdmin},
+		users.UserID("user1"):       []authz.Role{authz.RoleViewer},
+		users.UserID("user2"):       []authz.Role{authz.RoleUser},
 	}
 
-	// sample rbac state, with just one role viewer with permission to read all users
-	rbac := authz.RbacInDB{
-		authz.RoleViewer: authz.AccessRights{
+	// sample rbac state, with a role user with permission to read and update the own user only,
+	// a role viewer that inherits from the user, with permission to read all users,
+	// and a role admin that inherits the read permission of the viewer, with the permission to manage all users
+	grants := []authz.AccessRights{
+		{
+			Role:        authz.RoleUser,
+			Resource:    authz.ResourceUser,
+			Permissions: []authz.Permission{authz.PermissionRead, authz.PermissionUpdate},
+			Conditions: authz.Conditions{
+				authz.CondKeyResourceID: authz.Condition{Op: authz.OpEq, Value: "${" + string(authz.CondKeySubjectID) + "}"},
+			},
+		},
+		{
 			Role:        authz.RoleViewer,
 			Resource:    authz.ResourceUser,
 			Permissions: []authz.Permission{authz.PermissionRead},
@@ -49,13 +71,45 @@ func InitTestStore() *TestStore {
 				authz.CondKeyResourceID: "*",
 			},
 		},
+		{
+			Role:        authz.RoleAdmin,
+			Resource:    authz.ResourceUser,
+			Permissions: []authz.Permission{authz.PermissionCreate, authz.PermissionUpdate, authz.PermissionDelete},
+			Conditions: authz.Conditions{
+				authz.CondKeyResourceID: "*",
+			},
+		},
 	}
 
-	return &TestStore{
-		Data: map[string]interface{}{
-			"users":      sampleUsers,
-			"user_roles": userRoles,
-			"rbac":       rbac,
-		},
+	ctx := context.Background()
+	store := &TestStore{Store: datastore.InitStore()}
+	for _, usr := range sampleUsers {
+		store.CreateUser(ctx, usr)
+	}
+	for id, roles := range userRoles {
+		store.SetUserRoles(ctx, id, roles)
+	}
+	for _, ar := range grants {
+		store.SetGrant(ctx, ar)
+	}
+	authz.SetRoleParents(ctx, store, authz.RoleViewer, []authz.Role{authz.RoleUser})
+	authz.SetRoleParents(ctx, store, authz.RoleAdmin, []authz.Role{authz.RoleViewer})
+	for _, id := range []string{"client_user", "user1"} {
+		hash, _ := authn.HashPassword(TestUserPassword)
+		store.SetPasswordHash(ctx, id, hash)
 	}
+	store.CreateClient(ctx, authn.Client{
+		ID:         TestClientID,
+		SecretHash: authn.HashClientSecret(TestClientSecret),
+		Scopes:     []string{authn.ScopeUsersRead, authn.ScopeUsersWrite},
+		Audiences:  []string{TestClientID, "reports-service"},
+	})
+	store.CreateClient(ctx, authn.Client{
+		ID:           TestPublicClientID,
+		Scopes:       []string{authn.ScopeUsersRead},
+		Audiences:    []string{TestClientID},
+		RedirectURIs: []string{TestRedirectURI},
+		Public:       true,
+	})
+	return store
 }
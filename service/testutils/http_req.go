@@ -27,3 +27,7 @@ func makeRequest(router *chi.Mux, method string, url string, headers []Header, b
 func MakeGetRequestWithHeaders(router *chi.Mux, url string, headers []Header, body []byte) *httptest.ResponseRecorder {
 	return makeRequest(router, http.MethodGet, url, headers, bytes.NewReader(body))
 }
+
+func MakeRequestWithHeaders(router *chi.Mux, method string, url string, headers []Header, body []byte) *httptest.ResponseRecorder {
+	return makeRequest(router, method, url, headers, bytes.NewReader(body))
+}
@@ -0,0 +1,72 @@
+package testutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// WriteRSAKeyPair generates an RSA key pair, and writes it into dir as <kid>.private.pem and <kid>.public.pem.
+func WriteRSAKeyPair(tb testing.TB, dir, kid string) {
+	tb.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tb.Fatalf("error generating key: %v", err)
+	}
+	WriteKeyPair(tb, dir, kid, key)
+}
+
+// WriteECDSAKeyPair generates an ECDSA key pair on the curve, and writes it into dir as <kid>.private.pem and <kid>.public.pem.
+func WriteECDSAKeyPair(tb testing.TB, dir, kid string, curve elliptic.Curve) {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		tb.Fatalf("error generating key: %v", err)
+	}
+	WriteKeyPair(tb, dir, kid, key)
+}
+
+// WriteEd25519KeyPair generates an Ed25519 key pair, and writes it into dir as <kid>.private.pem and <kid>.public.pem.
+func WriteEd25519KeyPair(tb testing.TB, dir, kid string) {
+	tb.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatalf("error generating key: %v", err)
+	}
+	WriteKeyPair(tb, dir, kid, key)
+}
+
+// WriteKeyPair writes the key into dir as <kid>.private.pem and <kid>.public.pem, using PKCS #8 and PKIX encoding.
+func WriteKeyPair(tb testing.TB, dir, kid string, key crypto.Signer) {
+	tb.Helper()
+	privBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		tb.Fatalf("error encoding private key: %v", err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		tb.Fatalf("error encoding public key: %v", err)
+	}
+	WriteFile(tb, filepath.Join(dir, kid+".private.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}))
+	WriteFile(tb, filepath.Join(dir, kid+".public.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}))
+}
+
+// WriteFile writes the file via a rename, the same way as mounted secrets are updated, so that a reader never sees a partial file.
+func WriteFile(tb testing.TB, path string, data []byte) {
+	tb.Helper()
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		tb.Fatalf("error writing file: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		tb.Fatalf("error renaming file: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package users
+
+import (
+	"context"
+	"user-service/authn"
+	"user-service/authz"
+)
+
+// UserRepository persists users.
+// GetUser, UpdateUser and DeleteUser return an errorx.Error with errorx.NotFound code if the user does not exist,
+// and CreateUser returns an errorx.Error with errorx.Conflict code if it already exists.
+// UpdateUser applies the update to the stored user atomically, so that concurrent updates can not overwrite each other,
+// and returns the stored result. An error of the update is returned as is, and leaves the user unchanged. The id can not be changed.
+// DeleteUser removes the user along with its roles, password and MFA enrollment, and revokes its refresh tokens, atomically,
+// so that a failure can not leave the credentials of a deleted user behind.
+// ListUsersPage returns at most the limit of the users selected by the query, in its order.
+type UserRepository interface {
+	GetUser(ctx context.Context, id UserID) (User, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	ListUsersPage(ctx context.Context, q UserQuery) ([]User, error)
+	CreateUser(ctx context.Context, usr User) error
+	UpdateUser(ctx context.Context, id UserID, update func(User) (User, error)) (User, error)
+	DeleteUser(ctx context.Context, id UserID) error
+}
+
+// RoleBindingRepository persists the roles assigned to the users.
+// A user without any role binding has an empty list of roles.
+type RoleBindingRepository interface {
+	GetUserRoles(ctx context.Context, id UserID) ([]authz.Role, error)
+	SetUserRoles(ctx context.Context, id UserID, roles []authz.Role) error
+	DeleteUserRoles(ctx context.Context, id UserID) error
+}
+
+// Store groups the repositories that the users package works with.
+type Store interface {
+	UserRepository
+	RoleBindingRepository
+	authn.PasswordRepository
+	authn.MFARepository
+	authn.RefreshTokenRepository
+}
@@ -1,9 +1,17 @@
 package users
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
 	"user-service/authz"
-	"user-service/commons"
+	"user-service/errorx"
+	"user-service/timesource"
 )
 
 type UserID string
@@ -13,62 +21,367 @@ const (
 )
 
 type User struct {
-	ID   UserID `json:"id"`
-	Name string `json:"username"`
+	ID        UserID    `json:"id"`
+	Name      string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type UserRoles map[UserID][]authz.Role // a map of user-id and array of roles
 
 type UsersInDB map[UserID]User
 
-func FetchUsersFilterOne(db commons.Datastore, userId string) ([]User, error) {
-	usersInDB, ok := db.Get("users").(UsersInDB)
-	if !ok {
-		return nil, errors.New("no users in db")
+// UserPatch holds the fields of a User that can be partially updated.
+// A nil field means that the field should be left untouched.
+type UserPatch struct {
+	Name *string `json:"username"`
+}
+
+const maxUsernameLength = 64
+
+// User IDs end up in URL paths and token claims, so we keep them to a conservative charset.
+var userIdPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// Validate checks that the user data is acceptable to be stored.
+func (u User) Validate() error {
+	if !userIdPattern.MatchString(string(u.ID)) {
+		return errorx.Error{Code: errorx.BadRequestData, Message: "Invalid user id"}
+	}
+	return validateUsername(u.Name)
+}
+
+func validateUsername(name string) error {
+	if name == "" || len(name) > maxUsernameLength {
+		return errorx.Error{Code: errorx.BadRequestData, Message: "Invalid username"}
+	}
+	return nil
+}
+
+// Fields the user listing can be sorted by
+const (
+	SortByID        = "id"
+	SortByUsername  = "username"
+	SortByCreatedAt = "created_at"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+// ListOptions controls the pagination, sorting and filtering of the user listing.
+type ListOptions struct {
+	Limit          int
+	Cursor         string
+	SortBy         string
+	Desc           bool
+	UsernamePrefix string
+}
+
+// UserPage is a single page of the user listing.
+// NextCursor is empty when there are no more users to be fetched.
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// UserQuery selects a page of the user listing. The users are ordered by the SortBy field, and then by the id,
+// so that the order is stable. It is run by the repository, so that only a page of users is ever loaded.
+type UserQuery struct {
+	SortBy         string
+	Desc           bool
+	UsernamePrefix string
+	ExcludeID      UserID        // The user left out of the listing, i.e. the one making the request
+	After          *UserPosition // Only the users after this position are selected, if set
+	Limit          int
+}
+
+// UserPosition is the position of a user in the order of a UserQuery, i.e. the sort key of the user and its id.
+type UserPosition struct {
+	Key string
+	ID  UserID
+}
+
+// Matches reports whether the user is selected by the query, regardless of its limit.
+func (q UserQuery) Matches(u User) bool {
+	if u.ID == q.ExcludeID || !strings.HasPrefix(u.Name, q.UsernamePrefix) {
+		return false
+	}
+	return q.After == nil || compareUsers(SortKey(u, q.SortBy), u.ID, q.After.Key, q.After.ID, q.Desc) > 0
+}
+
+// Compare orders the users in the same way as the query.
+func (q UserQuery) Compare(a, b User) int {
+	return compareUsers(SortKey(a, q.SortBy), a.ID, SortKey(b, q.SortBy), b.ID, q.Desc)
+}
+
+// cursor marks the position of the last user of a page.
+// The sort field and order are part of the cursor, so that a cursor can not be reused with a different ordering.
+type cursor struct {
+	SortBy string `json:"s"`
+	Desc   bool   `json:"d"`
+	Key    string `json:"k"`
+	ID     UserID `json:"id"`
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// SortKey returns a string value for the requested field that sorts in the same order as the field itself.
+// The created time is formatted with a fixed width so that its lexical order matches the chronological order.
+func SortKey(u User, sortBy string) string {
+	switch sortBy {
+	case SortByUsername:
+		return u.Name
+	case SortByCreatedAt:
+		return u.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000000Z")
+	default:
+		return string(u.ID)
+	}
+}
+
+// compareUsers orders users by the sort key, using the user id as a tie-breaker to keep the order stable.
+func compareUsers(aKey string, aID UserID, bKey string, bID UserID, desc bool) int {
+	c := strings.Compare(aKey, bKey)
+	if c == 0 {
+		c = strings.Compare(string(aID), string(bID))
+	}
+	if desc {
+		return -c
+	}
+	return c
+}
+
+func (o *ListOptions) normalize() error {
+	if o.Limit == 0 {
+		o.Limit = DefaultPageLimit
+	}
+	if o.Limit < 0 || o.Limit > MaxPageLimit {
+		return errorx.Error{Code: errorx.BadRequestData, Message: "Invalid limit"}
+	}
+	if o.SortBy == "" {
+		o.SortBy = SortByID
+	}
+	if o.SortBy != SortByID && o.SortBy != SortByUsername && o.SortBy != SortByCreatedAt {
+		return errorx.Error{Code: errorx.BadRequestData, Message: "Invalid sort field"}
+	}
+	return nil
+}
+
+// FetchUsersFilterOne returns a page of users, filtering out the user with the supplied userId.
+func FetchUsersFilterOne(ctx context.Context, repo UserRepository, userId string, opts ListOptions) (UserPage, error) {
+	if err := opts.normalize(); err != nil {
+		return UserPage{}, err
+	}
+	q := UserQuery{
+		SortBy:         opts.SortBy,
+		Desc:           opts.Desc,
+		UsernamePrefix: opts.UsernamePrefix,
+		ExcludeID:      UserID(userId),
+		// One more user than the limit is asked for, to tell whether there is a next page
+		Limit: opts.Limit + 1,
+	}
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil || c.SortBy != opts.SortBy || c.Desc != opts.Desc {
+			return UserPage{}, errorx.Error{Code: errorx.BadRequestData, Message: "Invalid cursor"}
+		}
+		q.After = &UserPosition{Key: c.Key, ID: c.ID}
+	}
+
+	res, err := repo.ListUsersPage(ctx, q)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	page := UserPage{Users: res}
+	if len(res) > opts.Limit {
+		page.Users = res[:opts.Limit]
+		last := page.Users[len(page.Users)-1]
+		page.NextCursor = encodeCursor(cursor{SortBy: opts.SortBy, Desc: opts.Desc, Key: SortKey(last, opts.SortBy), ID: last.ID})
+	}
+	return page, nil
+}
+
+func FetchUser(ctx context.Context, repo UserRepository, userId string) (User, error) {
+	return repo.GetUser(ctx, UserID(userId))
+}
+
+func CreateUser(ctx context.Context, repo UserRepository, usr User) (User, error) {
+	if err := usr.Validate(); err != nil {
+		return User{}, err
 	}
-	res := make([]User, 0, len(usersInDB)-1)
-	for _, v := range usersInDB {
-		if v.ID != UserID(userId) {
-			res = append(res, v)
+	usr.CreatedAt = timesource.CurrentTime()
+	if err := repo.CreateUser(ctx, usr); err != nil {
+		return User{}, err
+	}
+	return usr, nil
+}
+
+// UpdateUser replaces the stored user with the supplied one. The user id itself can not be changed.
+func UpdateUser(ctx context.Context, repo UserRepository, userId string, usr User) (User, error) {
+	if usr.ID == "" {
+		usr.ID = UserID(userId)
+	}
+	if usr.ID != UserID(userId) {
+		return User{}, errorx.Error{Code: errorx.BadRequestData, Message: "User id can not be changed"}
+	}
+	if err := usr.Validate(); err != nil {
+		return User{}, err
+	}
+	return repo.UpdateUser(ctx, usr.ID, func(existing User) (User, error) {
+		// The created time is owned by the service and is kept as is
+		usr.CreatedAt = existing.CreatedAt
+		return usr, nil
+	})
+}
+
+// PatchUser applies the fields that are set in the patch to the stored user, keeping the rest as is.
+func PatchUser(ctx context.Context, repo UserRepository, userId string, patch UserPatch) (User, error) {
+	if patch.Name != nil {
+		if err := validateUsername(*patch.Name); err != nil {
+			return User{}, err
 		}
 	}
-	return res, nil
+	return repo.UpdateUser(ctx, UserID(userId), func(usr User) (User, error) {
+		if patch.Name != nil {
+			usr.Name = *patch.Name
+		}
+		return usr, nil
+	})
 }
 
-func InitStoreData(db commons.Datastore) error {
+// DeleteUser removes the user along with any roles assigned to it, and its credentials.
+// Its refresh tokens are revoked, so that the tokens issued before the deletion can not be renewed.
+func DeleteUser(ctx context.Context, repo UserRepository, userId string) error {
+	return repo.DeleteUser(ctx, UserID(userId))
+}
+
+// InitPolicyData seeds the datastore with the default rbac policy, unless the admin role already has a policy.
+// It is seeded regardless of the sample data, as no user could be managed without it.
+func InitPolicyData(ctx context.Context, policies authz.PolicyRepository) error {
+	_, err := policies.GetPolicy(ctx, authz.RoleAdmin)
+	if err == nil {
+		return nil
+	}
+	var e errorx.Error
+	if !errors.As(err, &e) || e.Code != errorx.NotFound {
+		return err
+	}
+
+	// A role user with permission to read and update the own user only,
+	// a role viewer that inherits from the user, with permission to read all users,
+	// and a role admin that inherits the read permission of the viewer, with the permission to manage all users
+	grants := []authz.AccessRights{
+		{
+			Role:        authz.RoleUser,
+			Resource:    authz.ResourceUser,
+			Permissions: []authz.Permission{authz.PermissionRead, authz.PermissionUpdate},
+			Conditions: authz.Conditions{
+				authz.CondKeyResourceID: authz.Condition{Op: authz.OpEq, Value: "${" + string(authz.CondKeySubjectID) + "}"},
+			},
+		},
+		{
+			Role:        authz.RoleViewer,
+			Resource:    authz.ResourceUser,
+			Permissions: []authz.Permission{authz.PermissionRead},
+			Conditions: authz.Conditions{
+				authz.CondKeyResourceID: authz.ResourceIDAny,
+			},
+		},
+		{
+			Role:        authz.RoleAdmin,
+			Resource:    authz.ResourceUser,
+			Permissions: []authz.Permission{authz.PermissionCreate, authz.PermissionUpdate, authz.PermissionDelete},
+			Conditions: authz.Conditions{
+				authz.CondKeyResourceID: authz.ResourceIDAny,
+			},
+		},
+	}
+	for _, ar := range grants {
+		if err := policies.SetGrant(ctx, ar); err != nil {
+			return err
+		}
+	}
+	if err := authz.SetRoleParents(ctx, policies, authz.RoleViewer, []authz.Role{authz.RoleUser}); err != nil {
+		return err
+	}
+	return authz.SetRoleParents(ctx, policies, authz.RoleAdmin, []authz.Role{authz.RoleViewer})
+}
+
+// InitStoreData seeds the datastore with the sample users, unless the datastore already holds users.
+// The sample users are given their password via setPassword, so that it is checked against the password policy.
+// The viewer and user accounts share usersPassword, while the admin client_user gets its own adminPassword,
+// so that the shared password does not give away the admin role. A user without a password can not log in.
+func InitStoreData(ctx context.Context, db Store, usersPassword, adminPassword string, setPassword func(ctx context.Context, id, password string) error) error {
+	existing, err := db.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+	now := timesource.CurrentTime()
 	sampleUsers := UsersInDB{
 		"client_user": {
-			ID:   "client_user",
-			Name: "john.doe",
+			ID:        "client_user",
+			Name:      "john.doe",
+			CreatedAt: now,
 		},
 		"user1": {
-			ID:   "user1",
-			Name: "john.doe",
+			ID:        "user1",
+			Name:      "john.doe",
+			CreatedAt: now,
 		},
 		"user2": {
-			ID:   "user2",
-			Name: "jane.smith",
+			ID:        "user2",
+			Name:      "jane.smith",
+			CreatedAt: now,
 		},
 	}
 
 	userRoles := UserRoles{
-		UserID("client_user"): []authz.Role{authz.RoleViewer},
+		UserID("client_user"): []authz.Role{authz.RoleAdmin},
+		UserID("user1"):       []authz.Role{authz.RoleViewer},
+		UserID("user2"):       []authz.Role{authz.RoleUser},
 	}
 
-	// sample rbac state, with just one role viewer with permission to read all users
-	rbac := authz.RbacInDB{
-		authz.RoleViewer: authz.AccessRights{
-			Role:        authz.RoleViewer,
-			Resource:    authz.ResourceUser,
-			Permissions: []authz.Permission{authz.PermissionRead},
-			Conditions: authz.Conditions{
-				authz.CondKeyResourceID: authz.ResourceIDAny,
-			},
-		},
+	// The passwords are set first, as they are the likely thing to fail, e.g. on the password policy.
+	// The users are only created once they are set, so that a failed seeding leaves the datastore empty, to be seeded again.
+	if adminPassword == "" {
+		log.Println("INFO: SAMPLE_ADMIN_PASSWORD is not set, the sample admin client_user can not log in")
+	} else if err := setPassword(ctx, "client_user", adminPassword); err != nil {
+		return err
+	}
+	if usersPassword == "" {
+		log.Println("INFO: SAMPLE_USERS_PASSWORD is not set, the sample users can not log in")
+	} else {
+		for _, id := range []UserID{"user1", "user2"} {
+			if err := setPassword(ctx, string(id), usersPassword); err != nil {
+				return err
+			}
+		}
+	}
+	for _, usr := range sampleUsers {
+		if err := db.CreateUser(ctx, usr); err != nil {
+			return err
+		}
+	}
+	for id, roles := range userRoles {
+		if err := db.SetUserRoles(ctx, id, roles); err != nil {
+			return err
+		}
 	}
-	db.Set("users", sampleUsers)
-	db.Set("user_roles", userRoles)
-	db.Set("rbac", rbac)
-	//ignoring error handling in this case for this sample service
 	return nil
 }